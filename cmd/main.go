@@ -7,8 +7,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/asalih/go-vdisk/dmg"
+	"github.com/asalih/go-vdisk/ewf"
+	"github.com/asalih/go-vdisk/parallels"
+	"github.com/asalih/go-vdisk/qcow2"
+	"github.com/asalih/go-vdisk/splitraw"
+	"github.com/asalih/go-vdisk/vdi"
 	"github.com/asalih/go-vdisk/vhd"
 	"github.com/asalih/go-vdisk/vhdx"
 	"github.com/asalih/go-vdisk/vmdk"
@@ -30,6 +37,18 @@ func main() {
 		openVHDX(*sourcePath)
 	case "vhd":
 		openVHD(*sourcePath)
+	case "qcow2":
+		openQCOW2(*sourcePath)
+	case "vdi":
+		openVDI(*sourcePath)
+	case "parallels":
+		openParallels(*sourcePath)
+	case "ewf":
+		openEWF(*sourcePath)
+	case "split-raw":
+		openSplitRaw(*sourcePath)
+	case "dmg":
+		openDMG(*sourcePath)
 	case "vhdx-bat-diagnostic":
 		runVHDXBatDiagnostic(*sourcePath)
 	case "vhdx-direct-read":
@@ -390,3 +409,154 @@ func openVMDK(sourcePath string) {
 
 	fmt.Println("Disk size: ", vmdkImage.Size)
 }
+
+func openQCOW2(sourcePath string) {
+	qFile, err := os.Open(sourcePath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	qcow2.FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(filepath.Dir(sourcePath), s))
+	}
+
+	qcow2Image, err := qcow2.NewQCOW2(qFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	buf := make([]byte, 65536)
+	_, err = qcow2Image.ReadAt(buf, 0)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Println("Disk size: ", qcow2Image.Size())
+}
+
+func openVDI(sourcePath string) {
+	dir := filepath.Dir(sourcePath)
+	vdi.FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(dir, s))
+	}
+
+	// differencing images name their parent only by UUID, so every image
+	// next to the source is a candidate
+	candidates, err := filepath.Glob(filepath.Join(dir, "*.vdi"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for i, candidate := range candidates {
+		candidates[i] = filepath.Base(candidate)
+	}
+
+	vdiImage, err := vdi.OpenChain(filepath.Base(sourcePath), candidates)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	buf := make([]byte, 65536)
+	_, err = vdiImage.ReadAt(buf, 0)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Println("Disk size: ", vdiImage.Size())
+}
+
+// openParallels opens an .hdd bundle directory through its descriptor.
+func openParallels(sourcePath string) {
+	descriptorFile, err := os.Open(filepath.Join(sourcePath, "DiskDescriptor.xml"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	parallels.FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(sourcePath, s))
+	}
+
+	parallelsImage, err := parallels.NewParallels(descriptorFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	buf := make([]byte, 65536)
+	_, err = parallelsImage.ReadAt(buf, 0)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Println("Disk size: ", parallelsImage.Size())
+}
+
+// openEWF opens the segment set the first segment file belongs to.
+func openEWF(sourcePath string) {
+	base := strings.TrimSuffix(sourcePath, filepath.Ext(sourcePath))
+	names, err := filepath.Glob(base + ".[EeSs][0-9A-Za-z][0-9A-Za-z]")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var segments []io.ReadSeeker
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		segments = append(segments, f)
+	}
+
+	ewfImage, err := ewf.NewEWF(segments)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	buf := make([]byte, 65536)
+	_, err = ewfImage.ReadAt(buf, 0)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Println("Disk size: ", ewfImage.Size())
+}
+
+// openSplitRaw opens a split raw image from its first segment.
+func openSplitRaw(sourcePath string) {
+	splitraw.FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(filepath.Dir(sourcePath), s))
+	}
+
+	splitImage, err := splitraw.NewSplitRaw(filepath.Base(sourcePath))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	buf := make([]byte, 65536)
+	_, err = splitImage.ReadAt(buf, 0)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Println("Disk size: ", splitImage.Size())
+}
+
+func openDMG(sourcePath string) {
+	dFile, err := os.Open(sourcePath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	dmgImage, err := dmg.NewDMG(dFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	buf := make([]byte, 65536)
+	_, err = dmgImage.ReadAt(buf, 0)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	for _, p := range dmgImage.Partitions() {
+		fmt.Println("Partition: ", p.Name, p.StartSector, p.SectorCount)
+	}
+	fmt.Println("Disk size: ", dmgImage.Size())
+}
@@ -0,0 +1,61 @@
+package dmg
+
+import "errors"
+
+var errADCCorrupt = errors.New("corrupt ADC data")
+
+// decompressADC decodes Apple Data Compression: literal runs and back
+// references with 2 or 3 byte headers.
+func decompressADC(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	for i := 0; i < len(src) && len(dst) < size; {
+		op := src[i]
+		switch {
+		case op&0x80 != 0:
+			length := int(op&0x7f) + 1
+			if i+1+length > len(src) {
+				return nil, errADCCorrupt
+			}
+			dst = append(dst, src[i+1:i+1+length]...)
+			i += 1 + length
+			continue
+		case op&0x40 != 0:
+			if i+3 > len(src) {
+				return nil, errADCCorrupt
+			}
+			length := int(op&0x3f) + 4
+			distance := int(src[i+1])<<8 | int(src[i+2])
+			if !copyMatch(&dst, distance+1, length) {
+				return nil, errADCCorrupt
+			}
+			i += 3
+		default:
+			if i+2 > len(src) {
+				return nil, errADCCorrupt
+			}
+			length := int(op>>2&0x0f) + 3
+			distance := int(op&0x03)<<8 | int(src[i+1])
+			if !copyMatch(&dst, distance+1, length) {
+				return nil, errADCCorrupt
+			}
+			i += 2
+		}
+	}
+	return dst, nil
+}
+
+// copyMatch appends length bytes starting distance bytes back, byte by byte
+// as matches may overlap their own output. It reports false when distance
+// points outside the output.
+func copyMatch(dst *[]byte, distance, length int) bool {
+	out := *dst
+	if distance <= 0 || distance > len(out) {
+		return false
+	}
+	start := len(out) - distance
+	for j := 0; j < length; j++ {
+		out = append(out, out[start+j])
+	}
+	*dst = out
+	return true
+}
@@ -0,0 +1,38 @@
+package dmg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	// a single LZFSE v2 block with FSE encoded literals and matches
+	lzfseV2, err := hex.DecodeString("62767832320000001000000100030070239db5da7b0b00509d00000020e0000b008f00f0080000008f000000870070088f06008f02003c0a000000000000000000000000000000000000000000000000c0a3f0283c0a8f020000c0a3f0283c0a8fc2a3f0283c0a8f020000003c0a8fc2a3f0280000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000008c048c04000000000000000000000062767824")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		decompress func([]byte, int) ([]byte, error)
+		src        []byte
+		want       string
+	}{
+		{"adc", decompressADC, []byte{0x83, 'a', 'b', 'c', 'd', 0x14, 0x03, 0x46, 0x00, 0x06}, "abcdabcdabcdbcdabcdbcd"},
+		{"lzfse v2", decompressLZFSE, lzfseV2, "ABCDEFGHABCDEFGHABCDEFGHABCDEFGHWXYZABCDEFGHAB1234"},
+		{"lzvn", decompressLZFSE, []byte("bvxn\x09\x00\x00\x00\x0e\x00\x00\x00\xe3abc\x18\x03\x06\x00\x00\x00\x00\x00\x00\x00bvx$"), "abcabcabc"},
+		{"uncompressed", decompressLZFSE, []byte("bvx-\x05\x00\x00\x00hellobvx$"), "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decompress(tt.src, len(tt.want))
+			if err != nil {
+				t.Fatalf("decompress error = %v", err)
+			}
+			if !bytes.Equal(got, []byte(tt.want)) {
+				t.Fatalf("decompress = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
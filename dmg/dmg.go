@@ -0,0 +1,277 @@
+package dmg
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	KOLY_MAGIC = "koly"
+	MISH_MAGIC = "mish"
+	KOLY_SIZE  = 512
+	XZ_MAGIC   = "\xfd7zXZ\x00"
+
+	SECTOR_SIZE = 512
+
+	CHUNK_ZERO       = 0x00000000
+	CHUNK_RAW        = 0x00000001
+	CHUNK_IGNORE     = 0x00000002
+	CHUNK_ADC        = 0x80000004
+	CHUNK_ZLIB       = 0x80000005
+	CHUNK_BZIP2      = 0x80000006
+	CHUNK_LZFSE      = 0x80000007
+	CHUNK_LZMA       = 0x80000008
+	CHUNK_COMMENT    = 0x7ffffffe
+	CHUNK_TERMINATOR = 0xffffffff
+)
+
+// Partition is one blkx entry of the resource fork.
+type Partition struct {
+	Name        string
+	ID          string
+	StartSector int64
+	SectorCount int64
+}
+
+// run is a chunk placed on the disk, with its data offset in the file.
+type run struct {
+	sector      int64
+	sectorCount int64
+	chunkType   uint32
+	offset      int64
+	length      int64
+}
+
+type DMG struct {
+	fh         io.ReadSeeker
+	koly       *Koly
+	partitions []Partition
+	runs       []run
+	size       int64
+
+	// the last decompressed run
+	runCache      []byte
+	runCacheIndex int
+}
+
+func NewDMG(fh io.ReadSeeker) (*DMG, error) {
+	koly, err := readKoly(fh)
+	if err != nil {
+		return nil, err
+	}
+	d := &DMG{fh: fh, koly: koly, size: int64(koly.SectorCount) * SECTOR_SIZE, runCacheIndex: -1}
+
+	if _, err := fh.Seek(int64(koly.XMLOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, koly.XMLLength)
+	if _, err := io.ReadFull(fh, data); err != nil {
+		return nil, err
+	}
+	plist, err := parsePlist(data)
+	if err != nil {
+		return nil, fmt.Errorf("dmg property list: %w", err)
+	}
+	if err := d.readBlkx(plist); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readBlkx collects the runs of every partition from the blkx array of the
+// resource fork.
+func (d *DMG) readBlkx(plist any) error {
+	root, _ := plist.(map[string]any)
+	resourceFork, _ := root["resource-fork"].(map[string]any)
+	blkx, ok := resourceFork["blkx"].([]any)
+	if !ok {
+		return errors.New("dmg property list has no blkx resources")
+	}
+
+	for _, entry := range blkx {
+		dict, _ := entry.(map[string]any)
+		data, ok := dict["Data"].([]byte)
+		if !ok {
+			return errors.New("dmg blkx resource has no data")
+		}
+		table, chunks, err := parseBlkx(data)
+		if err != nil {
+			return err
+		}
+
+		partition := Partition{StartSector: int64(table.SectorNumber), SectorCount: int64(table.SectorCount)}
+		partition.Name, _ = dict["Name"].(string)
+		if name, ok := dict["CFName"].(string); ok && partition.Name == "" {
+			partition.Name = name
+		}
+		partition.ID, _ = dict["ID"].(string)
+		d.partitions = append(d.partitions, partition)
+
+		for _, chunk := range chunks {
+			switch chunk.Type {
+			case CHUNK_COMMENT, CHUNK_TERMINATOR:
+				continue
+			case CHUNK_ZERO, CHUNK_IGNORE, CHUNK_RAW, CHUNK_ADC, CHUNK_ZLIB, CHUNK_BZIP2, CHUNK_LZFSE, CHUNK_LZMA:
+			default:
+				return fmt.Errorf("unsupported dmg chunk type: 0x%08x", chunk.Type)
+			}
+			if chunk.SectorCount == 0 {
+				continue
+			}
+			d.runs = append(d.runs, run{
+				sector:      int64(table.SectorNumber + chunk.SectorNumber),
+				sectorCount: int64(chunk.SectorCount),
+				chunkType:   chunk.Type,
+				offset:      int64(d.koly.DataForkOffset + table.DataOffset + chunk.CompressedOffset),
+				length:      int64(chunk.CompressedLength),
+			})
+		}
+	}
+
+	sort.Slice(d.runs, func(i, j int) bool {
+		return d.runs[i].sector < d.runs[j].sector
+	})
+	for i := 1; i < len(d.runs); i++ {
+		if prev := d.runs[i-1]; prev.sector+prev.sectorCount > d.runs[i].sector {
+			return fmt.Errorf("dmg chunks overlap at sector %d", d.runs[i].sector)
+		}
+	}
+	return nil
+}
+
+func (d *DMG) Koly() Koly {
+	return *d.koly
+}
+
+func (d *DMG) Partitions() []Partition {
+	return d.partitions
+}
+
+func (d *DMG) Size() int64 {
+	return d.size
+}
+
+func (d *DMG) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= d.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), d.size-offset)
+	for read := int64(0); read < length; {
+		pos := offset + read
+		sector := pos / SECTOR_SIZE
+		index := sort.Search(len(d.runs), func(i int) bool {
+			return d.runs[i].sector+d.runs[i].sectorCount > sector
+		})
+
+		// sectors no chunk covers read as zeros
+		if index == len(d.runs) || d.runs[index].sector > sector {
+			end := length
+			if index < len(d.runs) {
+				end = min(end, d.runs[index].sector*SECTOR_SIZE-offset)
+			}
+			clear(p[read:end])
+			read = end
+			continue
+		}
+
+		r := d.runs[index]
+		start := pos - r.sector*SECTOR_SIZE
+		count := min(length-read, r.sectorCount*SECTOR_SIZE-start)
+		if err := d.readRun(index, p[read:read+count], start); err != nil {
+			return int(read), err
+		}
+		read += count
+	}
+
+	if length < int64(len(p)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// readRun fills buf with the data at offset within run index.
+func (d *DMG) readRun(index int, buf []byte, offset int64) error {
+	r := d.runs[index]
+	switch r.chunkType {
+	case CHUNK_ZERO, CHUNK_IGNORE:
+		clear(buf)
+		return nil
+	case CHUNK_RAW:
+		if _, err := d.fh.Seek(r.offset+offset, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(d.fh, buf)
+		return err
+	}
+
+	if index != d.runCacheIndex {
+		data, err := d.decompressRun(r)
+		if err != nil {
+			return fmt.Errorf("dmg chunk at sector %d: %w", r.sector, err)
+		}
+		d.runCache, d.runCacheIndex = data, index
+	}
+	copy(buf, d.runCache[offset:])
+	return nil
+}
+
+func (d *DMG) decompressRun(r run) ([]byte, error) {
+	if _, err := d.fh.Seek(r.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src := make([]byte, r.length)
+	if _, err := io.ReadFull(d.fh, src); err != nil {
+		return nil, err
+	}
+	size := int(r.sectorCount * SECTOR_SIZE)
+
+	var data []byte
+	var err error
+	switch r.chunkType {
+	case CHUNK_ADC:
+		data, err = decompressADC(src, size)
+	case CHUNK_LZFSE:
+		data, err = decompressLZFSE(src, size)
+	case CHUNK_ZLIB:
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(bytes.NewReader(src)); err == nil {
+			data, err = readAtMost(zr, size)
+		}
+	case CHUNK_BZIP2:
+		data, err = readAtMost(bzip2.NewReader(bytes.NewReader(src)), size)
+	case CHUNK_LZMA:
+		// LZMA chunks are xz streams; accept raw lzma streams too
+		var lr io.Reader
+		if bytes.HasPrefix(src, []byte(XZ_MAGIC)) {
+			lr, err = xz.NewReader(bytes.NewReader(src))
+		} else {
+			lr, err = lzma.NewReader(bytes.NewReader(src))
+		}
+		if err == nil {
+			data, err = readAtMost(lr, size)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("decompressed %d bytes, %d expected", len(data), size)
+	}
+	return data, nil
+}
+
+func readAtMost(r io.Reader, size int) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r, int64(size)))
+}
@@ -0,0 +1,220 @@
+package dmg
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// testChunk is a chunk of a test partition: its type, stored data and the
+// sectors it covers.
+type testChunk struct {
+	chunkType uint32
+	stored    []byte
+	sectors   uint64
+}
+
+// testSectors returns count sectors of data that does not repeat within a
+// sector.
+func testSectors(count int, seed byte) []byte {
+	data := make([]byte, count*SECTOR_SIZE)
+	for i := range data {
+		data[i] = byte(i*int(seed)>>3) ^ seed
+	}
+	return data
+}
+
+func compressTest(t *testing.T, data []byte, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encodeADC stores data as ADC literal runs.
+func encodeADC(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); i += 128 {
+		run := data[i:min(i+128, len(data))]
+		out = append(append(out, byte(0x80|(len(run)-1))), run...)
+	}
+	return out
+}
+
+// newTestDMG builds a UDIF image with the data fork at its start, followed
+// by the property list and the koly trailer. The chunks of each partition
+// are stored one after the other, the partitions in the order of names.
+func newTestDMG(sectorCount uint64, partitions map[string][]testChunk, names []string) []byte {
+	var fork bytes.Buffer
+	var entries []string
+	var first uint64
+	for i, name := range names {
+		base := uint64(fork.Len())
+
+		var chunks []BlkxChunk
+		var sector uint64
+		for _, c := range partitions[name] {
+			chunks = append(chunks, BlkxChunk{
+				Type:             c.chunkType,
+				SectorNumber:     sector,
+				SectorCount:      c.sectors,
+				CompressedOffset: uint64(fork.Len()) - base,
+				CompressedLength: uint64(len(c.stored)),
+			})
+			fork.Write(c.stored)
+			sector += c.sectors
+		}
+		chunks = append(chunks, BlkxChunk{Type: CHUNK_TERMINATOR, SectorNumber: sector})
+
+		table := BlkxTable{
+			Version:      1,
+			SectorNumber: first,
+			SectorCount:  sector,
+			DataOffset:   base,
+			ChunkCount:   uint32(len(chunks)),
+		}
+		copy(table.Signature[:], MISH_MAGIC)
+		var mish bytes.Buffer
+		binary.Write(&mish, binary.BigEndian, &table)
+		binary.Write(&mish, binary.BigEndian, chunks)
+		entries = append(entries, fmt.Sprintf(`<dict>
+				<key>Attributes</key><string>0x0050</string>
+				<key>CFName</key><string>%s</string>
+				<key>Data</key><data>
+				%s
+				</data>
+				<key>ID</key><string>%d</string>
+				<key>Name</key><string>%s</string>
+			</dict>`, name, base64.StdEncoding.EncodeToString(mish.Bytes()), i-1, name))
+		first += sector
+	}
+
+	plist := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>resource-fork</key>
+	<dict>
+		<key>blkx</key>
+		<array>
+			` + strings.Join(entries, "\n\t\t\t") + `
+		</array>
+	</dict>
+</dict>
+</plist>
+`
+	koly := Koly{
+		Version:        4,
+		HeaderSize:     KOLY_SIZE,
+		Flags:          1,
+		DataForkLength: uint64(fork.Len()),
+		SegmentNumber:  1,
+		SegmentCount:   1,
+		XMLOffset:      uint64(fork.Len()),
+		XMLLength:      uint64(len(plist)),
+		ImageVariant:   1,
+		SectorCount:    sectorCount,
+	}
+	copy(koly.Signature[:], KOLY_MAGIC)
+
+	image := bytes.NewBuffer(fork.Bytes())
+	image.WriteString(plist)
+	binary.Write(image, binary.BigEndian, &koly)
+	return image.Bytes()
+}
+
+func TestDMG(t *testing.T) {
+	// bzip2 -9 of "bzip2 chunk " repeated over two sectors, the standard
+	// library only decompresses
+	bzip2Chunk, err := hex.DecodeString("425a6839314159265359df7a446000007f998040001000186942102000508069a680a551a0d3d4f249cc936a4d249dc93149f4932498a4c926293f177245385090df7a4460")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bzip2Data := bytes.Repeat([]byte("bzip2 chunk "), 100)[:2*SECTOR_SIZE]
+
+	raw, zlibData, xzData, lzmaData, adcData := testSectors(2, 3), testSectors(4, 5), testSectors(3, 11), testSectors(2, 13), testSectors(1, 17)
+	zlibChunk := compressTest(t, zlibData, func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil })
+	xzChunk := compressTest(t, xzData, func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) })
+	lzmaChunk := compressTest(t, lzmaData, func(w io.Writer) (io.WriteCloser, error) { return lzma.NewWriter(w) })
+
+	partitions := map[string][]testChunk{
+		"Driver Descriptor Map (DDM : 0)": {
+			{CHUNK_RAW, raw, 2},
+			{CHUNK_ZLIB, zlibChunk, 4},
+			{CHUNK_ZERO, nil, 1},
+			{CHUNK_IGNORE, nil, 2},
+			{CHUNK_COMMENT, nil, 0},
+			{CHUNK_BZIP2, bzip2Chunk, 2},
+			{CHUNK_LZMA, xzChunk, 3},
+		},
+		"disk image (Apple_HFS : 1)": {
+			{CHUNK_LZMA, lzmaChunk, 2},
+			{CHUNK_ADC, encodeADC(adcData), 1},
+		},
+	}
+	names := []string{"Driver Descriptor Map (DDM : 0)", "disk image (Apple_HFS : 1)"}
+	// the last sector is not covered by any chunk
+	want := bytes.Join([][]byte{raw, zlibData, make([]byte, 3*SECTOR_SIZE), bzip2Data, xzData, lzmaData, adcData, make([]byte, SECTOR_SIZE)}, nil)
+
+	d, err := NewDMG(bytes.NewReader(newTestDMG(18, partitions, names)))
+	if err != nil {
+		t.Fatalf("NewDMG() error = %v", err)
+	}
+	if k := d.Koly(); string(k.Signature[:]) != KOLY_MAGIC || k.SectorCount != 18 || d.Size() != int64(len(want)) {
+		t.Fatalf("Koly() sector count = %d, Size() = %d", k.SectorCount, d.Size())
+	}
+	wantPartitions := []Partition{
+		{Name: names[0], ID: "-1", StartSector: 0, SectorCount: 14},
+		{Name: names[1], ID: "0", StartSector: 14, SectorCount: 3},
+	}
+	if got := d.Partitions(); len(got) != len(wantPartitions) || got[0] != wantPartitions[0] || got[1] != wantPartitions[1] {
+		t.Fatalf("Partitions() = %+v, want %+v", got, wantPartitions)
+	}
+
+	got := make([]byte, d.Size())
+	if _, err := d.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		for i := 0; i < len(want); i += SECTOR_SIZE {
+			if !bytes.Equal(got[i:i+SECTOR_SIZE], want[i:i+SECTOR_SIZE]) {
+				t.Fatalf("ReadAt() sector %d does not match", i/SECTOR_SIZE)
+			}
+		}
+	}
+
+	// a read spanning the end of the zlib chunk and the zero chunk
+	got = make([]byte, SECTOR_SIZE)
+	if _, err := d.ReadAt(got, 6*SECTOR_SIZE-100); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, want[6*SECTOR_SIZE-100:7*SECTOR_SIZE-100]) {
+		t.Fatal("ReadAt() across chunks does not match")
+	}
+
+	partitions[names[1]] = append(partitions[names[1]], testChunk{0x80000009, []byte{0}, 1})
+	if _, err := NewDMG(bytes.NewReader(newTestDMG(18, partitions, names))); err == nil || !strings.Contains(err.Error(), "unsupported dmg chunk type") {
+		t.Fatalf("NewDMG() error = %v, want an unsupported chunk type", err)
+	}
+
+	if _, err := NewDMG(bytes.NewReader(make([]byte, KOLY_SIZE))); err == nil {
+		t.Fatal("NewDMG() accepted an image without a koly trailer")
+	}
+}
@@ -0,0 +1,61 @@
+package dmg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Koly is the UDIF trailer in the last 512 bytes of an image.
+type Koly struct {
+	Signature             [4]byte
+	Version               uint32
+	HeaderSize            uint32
+	Flags                 uint32
+	RunningDataForkOffset uint64
+	DataForkOffset        uint64
+	DataForkLength        uint64
+	RsrcForkOffset        uint64
+	RsrcForkLength        uint64
+	SegmentNumber         uint32
+	SegmentCount          uint32
+	SegmentID             [16]byte
+	DataChecksumType      uint32
+	DataChecksumSize      uint32
+	DataChecksum          [32]uint32
+	XMLOffset             uint64
+	XMLLength             uint64
+	Reserved1             [120]byte
+	ChecksumType          uint32
+	ChecksumSize          uint32
+	Checksum              [32]uint32
+	ImageVariant          uint32
+	SectorCount           uint64
+	Reserved2             uint32
+	Reserved3             uint32
+	Reserved4             uint32
+}
+
+func readKoly(fh io.ReadSeeker) (*Koly, error) {
+	if _, err := fh.Seek(-KOLY_SIZE, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	koly := &Koly{}
+	if err := binary.Read(fh, binary.BigEndian, koly); err != nil {
+		return nil, err
+	}
+	if string(koly.Signature[:]) != KOLY_MAGIC {
+		return nil, errors.New("invalid dmg trailer magic")
+	}
+	if koly.HeaderSize != KOLY_SIZE {
+		return nil, fmt.Errorf("invalid dmg trailer size: %d", koly.HeaderSize)
+	}
+	if koly.SegmentCount > 1 {
+		return nil, fmt.Errorf("segmented dmg images are not supported: %d segments", koly.SegmentCount)
+	}
+	if koly.XMLLength == 0 {
+		return nil, errors.New("dmg image has no XML property list")
+	}
+	return koly, nil
+}
@@ -0,0 +1,531 @@
+package dmg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+const (
+	LZFSE_ENDOFSTREAM_BLOCK_MAGIC    = 0x24787662 // bvx$
+	LZFSE_UNCOMPRESSED_BLOCK_MAGIC   = 0x2d787662 // bvx-
+	LZFSE_COMPRESSEDV1_BLOCK_MAGIC   = 0x31787662 // bvx1
+	LZFSE_COMPRESSEDV2_BLOCK_MAGIC   = 0x32787662 // bvx2
+	LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC = 0x6e787662 // bvxn
+
+	LZFSE_L_STATES       = 64
+	LZFSE_M_STATES       = 64
+	LZFSE_D_STATES       = 256
+	LZFSE_LITERAL_STATES = 1024
+
+	LZFSE_L_SYMBOLS       = 20
+	LZFSE_M_SYMBOLS       = 20
+	LZFSE_D_SYMBOLS       = 64
+	LZFSE_LITERAL_SYMBOLS = 256
+
+	LZFSE_MATCHES_PER_BLOCK  = 10000
+	LZFSE_LITERALS_PER_BLOCK = 4 * LZFSE_MATCHES_PER_BLOCK
+
+	lzfseV1HeaderSize = 772
+	lzfseV2HeaderSize = 32
+)
+
+var errLZFSECorrupt = errors.New("corrupt LZFSE data")
+
+var (
+	lzfseLExtraBits = [LZFSE_L_SYMBOLS]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 5, 8}
+	lzfseMExtraBits = [LZFSE_M_SYMBOLS]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 5, 8, 11}
+	lzfseDExtraBits [LZFSE_D_SYMBOLS]uint8
+
+	lzfseLBaseValue = lzfseBaseValues(lzfseLExtraBits[:])
+	lzfseMBaseValue = lzfseBaseValues(lzfseMExtraBits[:])
+	lzfseDBaseValue []int32
+)
+
+func init() {
+	// distance symbols come in groups of four sharing the number of extra bits
+	for i := range lzfseDExtraBits {
+		lzfseDExtraBits[i] = uint8(i / 4)
+	}
+	lzfseDBaseValue = lzfseBaseValues(lzfseDExtraBits[:])
+}
+
+// lzfseBaseValues returns the smallest value of each symbol, every symbol
+// covering 1<<extraBits values after the previous one.
+func lzfseBaseValues(extraBits []uint8) []int32 {
+	base := make([]int32, len(extraBits))
+	value := int32(0)
+	for i, n := range extraBits {
+		base[i] = value
+		value += 1 << n
+	}
+	return base
+}
+
+// lzfseHeader holds a compressed block header, v2 headers unpacked to the
+// v1 fields.
+type lzfseHeader struct {
+	NRawBytes            uint32
+	NPayloadBytes        uint32
+	NLiterals            uint32
+	NMatches             uint32
+	NLiteralPayloadBytes uint32
+	NLmdPayloadBytes     uint32
+	LiteralBits          int32
+	LiteralState         [4]uint16
+	LmdBits              int32
+	LState               uint16
+	MState               uint16
+	DState               uint16
+	// l, m, d and literal frequencies
+	Freq [LZFSE_L_SYMBOLS + LZFSE_M_SYMBOLS + LZFSE_D_SYMBOLS + LZFSE_LITERAL_SYMBOLS]uint16
+}
+
+// decompressLZFSE decodes an LZFSE stream up to its end of stream block.
+func decompressLZFSE(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	for {
+		if len(src) < 4 {
+			return nil, errLZFSECorrupt
+		}
+
+		var err error
+		switch binary.LittleEndian.Uint32(src) {
+		case LZFSE_ENDOFSTREAM_BLOCK_MAGIC:
+			return dst, nil
+		case LZFSE_UNCOMPRESSED_BLOCK_MAGIC:
+			if len(src) < 8 {
+				return nil, errLZFSECorrupt
+			}
+			n := int64(binary.LittleEndian.Uint32(src[4:]))
+			if int64(len(src)) < 8+n {
+				return nil, errLZFSECorrupt
+			}
+			dst = append(dst, src[8:8+n]...)
+			src = src[8+n:]
+		case LZFSE_COMPRESSEDV1_BLOCK_MAGIC, LZFSE_COMPRESSEDV2_BLOCK_MAGIC:
+			header, headerSize, err := parseLZFSEHeader(src)
+			if err != nil {
+				return nil, err
+			}
+			end := int64(headerSize) + int64(header.NLiteralPayloadBytes) + int64(header.NLmdPayloadBytes)
+			if int64(len(src)) < end {
+				return nil, errLZFSECorrupt
+			}
+			if dst, err = decodeLZFSEBlock(dst, header, src[headerSize:end]); err != nil {
+				return nil, err
+			}
+			src = src[end:]
+		case LZFSE_COMPRESSEDLZVN_BLOCK_MAGIC:
+			if len(src) < 12 {
+				return nil, errLZFSECorrupt
+			}
+			nRaw := int(binary.LittleEndian.Uint32(src[4:]))
+			end := 12 + int64(binary.LittleEndian.Uint32(src[8:]))
+			if int64(len(src)) < end {
+				return nil, errLZFSECorrupt
+			}
+			if dst, err = decodeLZVN(dst, src[12:end], nRaw); err != nil {
+				return nil, err
+			}
+			src = src[end:]
+		default:
+			return nil, errLZFSECorrupt
+		}
+	}
+}
+
+func parseLZFSEHeader(src []byte) (*lzfseHeader, int, error) {
+	header := &lzfseHeader{}
+	if binary.LittleEndian.Uint32(src) == LZFSE_COMPRESSEDV1_BLOCK_MAGIC {
+		if len(src) < lzfseV1HeaderSize {
+			return nil, 0, errLZFSECorrupt
+		}
+		if _, err := binary.Decode(src[4:], binary.LittleEndian, header); err != nil {
+			return nil, 0, err
+		}
+		return header, lzfseV1HeaderSize, nil
+	}
+
+	if len(src) < lzfseV2HeaderSize {
+		return nil, 0, errLZFSECorrupt
+	}
+	header.NRawBytes = binary.LittleEndian.Uint32(src[4:])
+	v0 := binary.LittleEndian.Uint64(src[8:])
+	v1 := binary.LittleEndian.Uint64(src[16:])
+	v2 := binary.LittleEndian.Uint64(src[24:])
+	field := func(v uint64, offset, nbits uint) uint64 {
+		return v >> offset & (1<<nbits - 1)
+	}
+
+	header.NLiterals = uint32(field(v0, 0, 20))
+	header.NLiteralPayloadBytes = uint32(field(v0, 20, 20))
+	header.NMatches = uint32(field(v0, 40, 20))
+	header.LiteralBits = int32(field(v0, 60, 3)) - 7
+	for i := range header.LiteralState {
+		header.LiteralState[i] = uint16(field(v1, uint(i)*10, 10))
+	}
+	header.NLmdPayloadBytes = uint32(field(v1, 40, 20))
+	header.LmdBits = int32(field(v1, 60, 3)) - 7
+	headerSize := int(field(v2, 0, 32))
+	header.LState = uint16(field(v2, 32, 10))
+	header.MState = uint16(field(v2, 42, 10))
+	header.DState = uint16(field(v2, 52, 10))
+	header.NPayloadBytes = header.NLiteralPayloadBytes + header.NLmdPayloadBytes
+
+	if headerSize < lzfseV2HeaderSize || headerSize > len(src) {
+		return nil, 0, errLZFSECorrupt
+	}
+	if headerSize > lzfseV2HeaderSize {
+		if err := decodeLZFSEFreqs(src[lzfseV2HeaderSize:headerSize], header.Freq[:]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return header, headerSize, nil
+}
+
+// decodeLZFSEFreqs reads the variable length frequency tables of a v2
+// header.
+func decodeLZFSEFreqs(src []byte, freq []uint16) error {
+	nbitsTable := [32]uint8{
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+	}
+	valueTable := [32]uint16{
+		0, 2, 1, 4, 0, 3, 1, 0, 0, 2, 1, 5, 0, 3, 1, 0,
+		0, 2, 1, 6, 0, 3, 1, 0, 0, 2, 1, 7, 0, 3, 1, 0,
+	}
+
+	var accum uint32
+	accumBits := uint(0)
+	for i := range freq {
+		for len(src) > 0 && accumBits+8 <= 32 {
+			accum |= uint32(src[0]) << accumBits
+			accumBits += 8
+			src = src[1:]
+		}
+
+		b := accum & 31
+		nbits := uint(nbitsTable[b])
+		if nbits > accumBits {
+			return errLZFSECorrupt
+		}
+		switch nbits {
+		case 8:
+			freq[i] = uint16(8 + (accum>>4)&0xf)
+		case 14:
+			freq[i] = uint16(24 + (accum>>4)&0x3ff)
+		default:
+			freq[i] = valueTable[b]
+		}
+		accum >>= nbits
+		accumBits -= nbits
+	}
+	if accumBits >= 8 || len(src) != 0 {
+		return errLZFSECorrupt
+	}
+	return nil
+}
+
+func decodeLZFSEBlock(dst []byte, h *lzfseHeader, payload []byte) ([]byte, error) {
+	if h.NLiterals > LZFSE_LITERALS_PER_BLOCK || h.NLiterals%4 != 0 || h.NMatches > LZFSE_MATCHES_PER_BLOCK {
+		return nil, errLZFSECorrupt
+	}
+	freq := h.Freq[:]
+	literalTable, err := fseDecoderTable(LZFSE_LITERAL_STATES, freq[LZFSE_L_SYMBOLS+LZFSE_M_SYMBOLS+LZFSE_D_SYMBOLS:])
+	if err != nil {
+		return nil, err
+	}
+	lTable, err := fseValueDecoderTable(LZFSE_L_STATES, freq[:LZFSE_L_SYMBOLS], lzfseLExtraBits[:], lzfseLBaseValue)
+	if err != nil {
+		return nil, err
+	}
+	mTable, err := fseValueDecoderTable(LZFSE_M_STATES, freq[LZFSE_L_SYMBOLS:LZFSE_L_SYMBOLS+LZFSE_M_SYMBOLS], lzfseMExtraBits[:], lzfseMBaseValue)
+	if err != nil {
+		return nil, err
+	}
+	dTable, err := fseValueDecoderTable(LZFSE_D_STATES, freq[LZFSE_L_SYMBOLS+LZFSE_M_SYMBOLS:LZFSE_L_SYMBOLS+LZFSE_M_SYMBOLS+LZFSE_D_SYMBOLS], lzfseDExtraBits[:], lzfseDBaseValue)
+	if err != nil {
+		return nil, err
+	}
+
+	// literals, four interleaved streams read backwards
+	in := &fseInStream{}
+	if err := in.init(payload[:h.NLiteralPayloadBytes], int(h.LiteralBits)); err != nil {
+		return nil, err
+	}
+	var states [4]int
+	for i, state := range h.LiteralState {
+		states[i] = int(state)
+	}
+	literals := make([]byte, h.NLiterals)
+	for i := 0; i < len(literals); i += 4 {
+		if err := in.flush(); err != nil {
+			return nil, err
+		}
+		for j := range states {
+			literals[i+j] = fseDecode(&states[j], literalTable, in)
+		}
+	}
+	if in.err != nil {
+		return nil, in.err
+	}
+
+	// literal length, match length and distance triplets
+	if err := in.init(payload[h.NLiteralPayloadBytes:], int(h.LmdBits)); err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	lState, mState, dState := int(h.LState), int(h.MState), int(h.DState)
+	d := int32(-1)
+	literalPos := 0
+	for i := uint32(0); i < h.NMatches; i++ {
+		if err := in.flush(); err != nil {
+			return nil, err
+		}
+		l := fseValueDecode(&lState, lTable, in)
+		m := fseValueDecode(&mState, mTable, in)
+		if newD := fseValueDecode(&dState, dTable, in); newD != 0 {
+			d = newD
+		}
+		if in.err != nil {
+			return nil, in.err
+		}
+
+		if literalPos+int(l) > len(literals) {
+			return nil, errLZFSECorrupt
+		}
+		dst = append(dst, literals[literalPos:literalPos+int(l)]...)
+		literalPos += int(l)
+		if m > 0 && !copyMatch(&dst, int(d), int(m)) {
+			return nil, errLZFSECorrupt
+		}
+	}
+
+	if len(dst)-start != int(h.NRawBytes) {
+		return nil, errLZFSECorrupt
+	}
+	return dst, nil
+}
+
+// fseInStream reads bits backwards from the end of buf, the way the FSE
+// encoder wrote them.
+type fseInStream struct {
+	accum uint64
+	nbits int
+	buf   []byte
+	err   error
+}
+
+func (s *fseInStream) init(buf []byte, n int) error {
+	s.err = nil
+	s.accum = 0
+	if n != 0 {
+		if len(buf) < 8 {
+			return errLZFSECorrupt
+		}
+		s.accum = binary.LittleEndian.Uint64(buf[len(buf)-8:])
+		s.buf = buf[:len(buf)-8]
+		s.nbits = n + 64
+	} else {
+		if len(buf) < 7 {
+			return errLZFSECorrupt
+		}
+		s.accum = littleEndian(buf[len(buf)-7:])
+		s.buf = buf[:len(buf)-7]
+		s.nbits = 56
+	}
+	if s.nbits < 56 || s.nbits >= 64 || s.accum>>s.nbits != 0 {
+		return errLZFSECorrupt
+	}
+	return nil
+}
+
+// flush refills the accumulator with whole bytes to hold at least 56 bits.
+func (s *fseInStream) flush() error {
+	nbits := (63 - s.nbits) &^ 7
+	n := nbits >> 3
+	if n > len(s.buf) {
+		return errLZFSECorrupt
+	}
+	s.accum = s.accum<<nbits | littleEndian(s.buf[len(s.buf)-n:])
+	s.nbits += nbits
+	s.buf = s.buf[:len(s.buf)-n]
+	return nil
+}
+
+func (s *fseInStream) pull(n int) uint64 {
+	if n > s.nbits {
+		s.err = errLZFSECorrupt
+		return 0
+	}
+	s.nbits -= n
+	result := s.accum >> s.nbits
+	s.accum &= 1<<s.nbits - 1
+	return result
+}
+
+func littleEndian(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+type fseEntry struct {
+	k      int
+	symbol byte
+	delta  int
+}
+
+type fseValueEntry struct {
+	totalBits int
+	valueBits int
+	delta     int
+	vbase     int32
+}
+
+// fseStates spreads the states of each symbol: a symbol of frequency f gets
+// f consecutive states, each reading k or k-1 bits for the next state.
+func fseStates(nstates int, freq []uint16, fn func(symbol, k, delta int)) error {
+	nclz := bits.LeadingZeros32(uint32(nstates))
+	sum := 0
+	for symbol, f16 := range freq {
+		f := int(f16)
+		if f == 0 {
+			continue
+		}
+		sum += f
+		if sum > nstates {
+			return errLZFSECorrupt
+		}
+		k := bits.LeadingZeros32(uint32(f)) - nclz
+		j0 := (2*nstates)>>k - f
+		for j := 0; j < f; j++ {
+			if j < j0 {
+				fn(symbol, k, (f+j)<<k-nstates)
+			} else {
+				fn(symbol, k-1, (j-j0)<<(k-1))
+			}
+		}
+	}
+	return nil
+}
+
+func fseDecoderTable(nstates int, freq []uint16) ([]fseEntry, error) {
+	table := make([]fseEntry, 0, nstates)
+	err := fseStates(nstates, freq, func(symbol, k, delta int) {
+		table = append(table, fseEntry{k: k, symbol: byte(symbol), delta: delta})
+	})
+	return table, err
+}
+
+func fseValueDecoderTable(nstates int, freq []uint16, extraBits []uint8, baseValue []int32) ([]fseValueEntry, error) {
+	table := make([]fseValueEntry, 0, nstates)
+	err := fseStates(nstates, freq, func(symbol, k, delta int) {
+		table = append(table, fseValueEntry{
+			totalBits: k + int(extraBits[symbol]),
+			valueBits: int(extraBits[symbol]),
+			delta:     delta,
+			vbase:     baseValue[symbol],
+		})
+	})
+	return table, err
+}
+
+func fseDecode(state *int, table []fseEntry, in *fseInStream) byte {
+	if *state >= len(table) {
+		in.err = errLZFSECorrupt
+		return 0
+	}
+	e := table[*state]
+	*state = e.delta + int(in.pull(e.k))
+	return e.symbol
+}
+
+func fseValueDecode(state *int, table []fseValueEntry, in *fseInStream) int32 {
+	if *state >= len(table) {
+		in.err = errLZFSECorrupt
+		return 0
+	}
+	e := table[*state]
+	v := in.pull(e.totalBits)
+	*state = e.delta + int(v>>e.valueBits)
+	return e.vbase + int32(v&(1<<e.valueBits-1))
+}
+
+// decodeLZVN decodes an LZVN block of nRaw bytes, whose matches may reach
+// back into the output of earlier blocks.
+func decodeLZVN(dst []byte, src []byte, nRaw int) ([]byte, error) {
+	start := len(dst)
+	d := 0
+	for i := 0; i < len(src); {
+		op := src[i]
+		l, m, opLen := 0, 0, 1
+		newD := d
+		need := func(n int) bool { return i+n <= len(src) }
+
+		switch {
+		case op == 0x06: // end of stream
+			if len(dst)-start != nRaw {
+				return nil, errLZFSECorrupt
+			}
+			return dst, nil
+		case op == 0x0e || op == 0x16: // nop
+		case op >= 0xf0: // match with the previous distance
+			m = int(op & 0x0f)
+			if op == 0xf0 {
+				if !need(2) {
+					return nil, errLZFSECorrupt
+				}
+				m, opLen = int(src[i+1])+16, 2
+			}
+		case op >= 0xe0: // literals only
+			l = int(op & 0x0f)
+			if op == 0xe0 {
+				if !need(2) {
+					return nil, errLZFSECorrupt
+				}
+				l, opLen = int(src[i+1])+16, 2
+			}
+		case op >= 0xd0 || (op >= 0x70 && op < 0x80):
+			return nil, errLZFSECorrupt
+		case op >= 0xa0 && op < 0xc0: // medium distance
+			if !need(3) {
+				return nil, errLZFSECorrupt
+			}
+			b := int(binary.LittleEndian.Uint16(src[i+1:]))
+			l, m, newD, opLen = int(op>>3&3), (int(op&7)<<2|b&3)+3, b>>2, 3
+		case op&7 == 7: // large distance
+			if !need(3) {
+				return nil, errLZFSECorrupt
+			}
+			l, m, newD, opLen = int(op>>6), int(op>>3&7)+3, int(binary.LittleEndian.Uint16(src[i+1:])), 3
+		case op&7 == 6: // previous distance
+			if op < 0x40 {
+				return nil, errLZFSECorrupt
+			}
+			l, m = int(op>>6), int(op>>3&7)+3
+		default: // small distance
+			if !need(2) {
+				return nil, errLZFSECorrupt
+			}
+			l, m, newD, opLen = int(op>>6), int(op>>3&7)+3, int(op&7)<<8|int(src[i+1]), 2
+		}
+		i += opLen
+
+		if !need(l) {
+			return nil, errLZFSECorrupt
+		}
+		dst = append(dst, src[i:i+l]...)
+		i += l
+		if m > 0 {
+			if !copyMatch(&dst, newD, m) {
+				return nil, errLZFSECorrupt
+			}
+			d = newD
+		}
+	}
+	return nil, errLZFSECorrupt
+}
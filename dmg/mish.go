@@ -0,0 +1,55 @@
+package dmg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// BlkxTable is the header of a mish block table, describing one partition
+// of the image as a list of chunks.
+type BlkxTable struct {
+	Signature        [4]byte
+	Version          uint32
+	SectorNumber     uint64
+	SectorCount      uint64
+	DataOffset       uint64
+	BuffersNeeded    uint32
+	BlockDescriptors uint32
+	Reserved         [6]uint32
+	ChecksumType     uint32
+	ChecksumSize     uint32
+	Checksum         [32]uint32
+	ChunkCount       uint32
+}
+
+// BlkxChunk is a run of sectors stored with one chunk type. Sectors are
+// relative to the table, offsets to its DataOffset.
+type BlkxChunk struct {
+	Type             uint32
+	Comment          uint32
+	SectorNumber     uint64
+	SectorCount      uint64
+	CompressedOffset uint64
+	CompressedLength uint64
+}
+
+func parseBlkx(data []byte) (*BlkxTable, []BlkxChunk, error) {
+	r := bytes.NewReader(data)
+	table := &BlkxTable{}
+	if err := binary.Read(r, binary.BigEndian, table); err != nil {
+		return nil, nil, err
+	}
+	if string(table.Signature[:]) != MISH_MAGIC {
+		return nil, nil, errors.New("invalid dmg block table magic")
+	}
+	if uint64(table.ChunkCount)*uint64(binary.Size(BlkxChunk{})) > uint64(r.Len()) {
+		return nil, nil, fmt.Errorf("dmg block table has %d chunks but room for fewer", table.ChunkCount)
+	}
+	chunks := make([]BlkxChunk, table.ChunkCount)
+	if err := binary.Read(r, binary.BigEndian, chunks); err != nil {
+		return nil, nil, err
+	}
+	return table, chunks, nil
+}
@@ -0,0 +1,424 @@
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	COMPRESSION_NONE = 0
+	COMPRESSION_FAST = 1
+	COMPRESSION_BEST = 2
+
+	DEFAULT_SEGMENT_SIZE      = 1500 << 20
+	MIN_SEGMENT_SIZE          = 1 << 20
+	DEFAULT_SECTORS_PER_CHUNK = 64
+	MAX_TABLE_ENTRIES         = 16375
+
+	MEDIA_TYPE_FIXED = 0x01
+	MEDIA_FLAG_IMAGE = 0x01
+
+	// room kept at the end of a segment for the closing sections
+	segmentTrailerSize = 1024
+)
+
+type FileCreatorFn func(string) (io.WriteSeeker, error)
+
+// FileCreator creates the segment files of new images.
+var FileCreator FileCreatorFn
+
+var ErrFileCreatorNotAvailable = errors.New("file creator needed to create segment files")
+
+type CreateOptions struct {
+	// SegmentSize limits the size of each segment file, defaults to 1500 MiB.
+	SegmentSize     int64
+	SectorsPerChunk uint32
+	// CompressionLevel is one of the COMPRESSION_* levels.
+	CompressionLevel uint8
+
+	CaseNumber     string
+	EvidenceNumber string
+	Description    string
+	Examiner       string
+	Notes          string
+}
+
+// segmentWriter writes the sections of a segment set, starting a new
+// segment file when the current one is full.
+type segmentWriter struct {
+	name    string
+	volume  []byte
+	headers [][]byte
+
+	w       io.WriteSeeker
+	segment int
+	offset  int64
+
+	// the open sectors section and the table entries of its chunks
+	sectorsOffset int64
+	entries       []uint32
+}
+
+// Create writes an EWF segment set of the size bytes in src. name is the
+// first segment file, e.g. "evidence.E01"; the following ones are named by
+// SegmentName. The MD5 and SHA1 of the media are stored in the last segment.
+func Create(name string, src io.ReaderAt, size int64, opts *CreateOptions) error {
+	if FileCreator == nil {
+		return ErrFileCreatorNotAvailable
+	}
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	segmentSize := opts.SegmentSize
+	if segmentSize == 0 {
+		segmentSize = DEFAULT_SEGMENT_SIZE
+	}
+	sectorsPerChunk := opts.SectorsPerChunk
+	if sectorsPerChunk == 0 {
+		sectorsPerChunk = DEFAULT_SECTORS_PER_CHUNK
+	}
+	chunkSize := int64(sectorsPerChunk) * SECTOR_SIZE
+	if segmentSize < MIN_SEGMENT_SIZE || segmentSize > TABLE_OFFSET_MASK || segmentSize < 4*chunkSize {
+		return fmt.Errorf("invalid ewf segment size: %d", segmentSize)
+	}
+	if size < 0 || size%SECTOR_SIZE != 0 {
+		return fmt.Errorf("ewf media size must be a multiple of %d: %d", SECTOR_SIZE, size)
+	}
+
+	zlibLevel := zlib.NoCompression
+	switch opts.CompressionLevel {
+	case COMPRESSION_NONE:
+	case COMPRESSION_FAST:
+		zlibLevel = zlib.BestSpeed
+	case COMPRESSION_BEST:
+		zlibLevel = zlib.BestCompression
+	default:
+		return fmt.Errorf("unknown ewf compression level: %d", opts.CompressionLevel)
+	}
+
+	chunkCount := (size + chunkSize - 1) / chunkSize
+	volume := Volume{
+		MediaType:        MEDIA_TYPE_FIXED,
+		ChunkCount:       uint32(chunkCount),
+		SectorsPerChunk:  sectorsPerChunk,
+		BytesPerSector:   SECTOR_SIZE,
+		SectorCount:      uint64(size / SECTOR_SIZE),
+		MediaFlags:       MEDIA_FLAG_IMAGE,
+		CompressionLevel: opts.CompressionLevel,
+		ErrorGranularity: sectorsPerChunk,
+		SetIdentifier:    uuid.New(),
+	}
+	volumeData, err := volumeBytes(&volume)
+	if err != nil {
+		return err
+	}
+	headers, err := headerSections(opts, time.Now())
+	if err != nil {
+		return err
+	}
+
+	sw := &segmentWriter{name: name, volume: volumeData, headers: headers}
+	if err := sw.openSegment(1); err != nil {
+		return err
+	}
+	defer sw.close()
+
+	md5Hash, sha1Hash := md5.New(), sha1.New()
+	buf := make([]byte, chunkSize)
+	for index := int64(0); index < chunkCount; index++ {
+		data := buf[:min(chunkSize, size-index*chunkSize)]
+		if n, err := src.ReadAt(data, index*chunkSize); n < len(data) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("reading ewf source at %d: %w", index*chunkSize+int64(n), err)
+		}
+		md5Hash.Write(data)
+		sha1Hash.Write(data)
+
+		stored, compressed, err := encodeChunk(data, zlibLevel)
+		if err != nil {
+			return err
+		}
+
+		full := sw.offset+int64(len(stored))+2*tableSectionSize(len(sw.entries)+1)+segmentTrailerSize > segmentSize
+		if len(sw.entries) > 0 && (full || len(sw.entries) == MAX_TABLE_ENTRIES) {
+			if err := sw.closeSectors(); err != nil {
+				return err
+			}
+			if full {
+				if err := sw.nextSegment(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := sw.writeChunk(stored, compressed); err != nil {
+			return err
+		}
+	}
+
+	if err := sw.closeSectors(); err != nil {
+		return err
+	}
+	return sw.finish(md5Hash, sha1Hash)
+}
+
+// encodeChunk compresses a chunk when that saves space, otherwise stores it
+// followed by its Adler-32.
+func encodeChunk(data []byte, level int) ([]byte, bool, error) {
+	if level != zlib.NoCompression {
+		var buf bytes.Buffer
+		zw, err := zlib.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return nil, false, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, false, err
+		}
+		if buf.Len() < len(data) {
+			return buf.Bytes(), true, nil
+		}
+	}
+	return binary.LittleEndian.AppendUint32(bytes.Clone(data), adler32.Checksum(data)), false, nil
+}
+
+func (sw *segmentWriter) openSegment(number int) error {
+	name, err := SegmentName(sw.name, number)
+	if err != nil {
+		return err
+	}
+	sw.w, err = FileCreator(name)
+	if err != nil {
+		return err
+	}
+	sw.segment, sw.offset = number, 0
+
+	header := fileHeader{SegmentNumber: uint16(number), FieldsStart: 1}
+	copy(header.Signature[:], EVF_SIGNATURE)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &header)
+	if err := sw.write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	// the first segment describes the acquisition, the others repeat the
+	// volume in a data section
+	if number == 1 {
+		if err := sw.writeSection(SECTION_HEADER2, sw.headers[0]); err != nil {
+			return err
+		}
+		if err := sw.writeSection(SECTION_HEADER, sw.headers[1]); err != nil {
+			return err
+		}
+		return sw.writeSection(SECTION_VOLUME, sw.volume)
+	}
+	return sw.writeSection(SECTION_DATA, sw.volume)
+}
+
+func (sw *segmentWriter) nextSegment() error {
+	if err := sw.writeLastSection(SECTION_NEXT); err != nil {
+		return err
+	}
+	if err := sw.close(); err != nil {
+		return err
+	}
+	return sw.openSegment(sw.segment + 1)
+}
+
+func (sw *segmentWriter) close() error {
+	if sw.w == nil {
+		return nil
+	}
+	var err error
+	if c, ok := sw.w.(io.Closer); ok {
+		err = c.Close()
+	}
+	sw.w = nil
+	return err
+}
+
+// writeChunk appends a chunk to the open sectors section, opening one when
+// needed.
+func (sw *segmentWriter) writeChunk(data []byte, compressed bool) error {
+	if len(sw.entries) == 0 {
+		sw.sectorsOffset = sw.offset
+		if err := sw.write(make([]byte, SECTION_DESCRIPTOR_SIZE)); err != nil {
+			return err
+		}
+	}
+	entry := uint32(sw.offset)
+	if compressed {
+		entry |= TABLE_COMPRESSED
+	}
+	sw.entries = append(sw.entries, entry)
+	return sw.write(data)
+}
+
+// closeSectors completes the open sectors section and writes its table and
+// the table2 copy.
+func (sw *segmentWriter) closeSectors() error {
+	if len(sw.entries) == 0 {
+		return nil
+	}
+	end := sw.offset
+	descriptor := sectionDescriptorBytes(SECTION_SECTORS, uint64(end), uint64(end-sw.sectorsOffset))
+	if _, err := sw.w.Seek(sw.sectorsOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(descriptor); err != nil {
+		return err
+	}
+	if _, err := sw.w.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+
+	var table bytes.Buffer
+	header := tableHeader{EntryCount: uint32(len(sw.entries))}
+	binary.Write(&table, binary.LittleEndian, &header)
+	binary.LittleEndian.PutUint32(table.Bytes()[TABLE_HEADER_SIZE-4:], adler32.Checksum(table.Bytes()[:TABLE_HEADER_SIZE-4]))
+	binary.Write(&table, binary.LittleEndian, sw.entries)
+	binary.Write(&table, binary.LittleEndian, adler32.Checksum(table.Bytes()[TABLE_HEADER_SIZE:]))
+	sw.entries = sw.entries[:0]
+
+	if err := sw.writeSection(SECTION_TABLE, table.Bytes()); err != nil {
+		return err
+	}
+	return sw.writeSection(SECTION_TABLE2, table.Bytes())
+}
+
+// finish writes the hashes and closes the segment set.
+func (sw *segmentWriter) finish(md5Hash, sha1Hash hash.Hash) error {
+	digest := append(md5Hash.Sum(nil), sha1Hash.Sum(nil)...)
+	digest = append(digest, make([]byte, 40)...)
+	if err := sw.writeSection(SECTION_DIGEST, binary.LittleEndian.AppendUint32(digest, adler32.Checksum(digest))); err != nil {
+		return err
+	}
+	hashData := append(md5Hash.Sum(nil), make([]byte, 16)...)
+	if err := sw.writeSection(SECTION_HASH, binary.LittleEndian.AppendUint32(hashData, adler32.Checksum(hashData))); err != nil {
+		return err
+	}
+	if err := sw.writeLastSection(SECTION_DONE); err != nil {
+		return err
+	}
+	return sw.close()
+}
+
+func (sw *segmentWriter) writeSection(sectionType string, data []byte) error {
+	size := uint64(SECTION_DESCRIPTOR_SIZE + len(data))
+	if err := sw.write(sectionDescriptorBytes(sectionType, uint64(sw.offset)+size, size)); err != nil {
+		return err
+	}
+	return sw.write(data)
+}
+
+// writeLastSection writes a next or done section, which points to itself.
+func (sw *segmentWriter) writeLastSection(sectionType string) error {
+	return sw.write(sectionDescriptorBytes(sectionType, uint64(sw.offset), SECTION_DESCRIPTOR_SIZE))
+}
+
+func (sw *segmentWriter) write(data []byte) error {
+	if _, err := sw.w.Write(data); err != nil {
+		return err
+	}
+	sw.offset += int64(len(data))
+	return nil
+}
+
+func sectionDescriptorBytes(sectionType string, next, size uint64) []byte {
+	d := sectionDescriptor{Next: next, Size: size}
+	copy(d.Type[:], sectionType)
+	buf, _ := binary.Append(nil, binary.LittleEndian, &d)
+	binary.LittleEndian.PutUint32(buf[SECTION_DESCRIPTOR_SIZE-4:], adler32.Checksum(buf[:SECTION_DESCRIPTOR_SIZE-4]))
+	return buf
+}
+
+func volumeBytes(volume *Volume) ([]byte, error) {
+	buf, err := binary.Append(nil, binary.LittleEndian, volume)
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(buf[VOLUME_SIZE-4:], adler32.Checksum(buf[:VOLUME_SIZE-4]))
+	return buf, nil
+}
+
+// tableSectionSize is the size of a table section with entries entries.
+func tableSectionSize(entries int) int64 {
+	return SECTION_DESCRIPTOR_SIZE + TABLE_HEADER_SIZE + int64(entries)*4 + 4
+}
+
+// headerSections returns the compressed header2 and header sections
+// holding the case metadata. The acquisition and system dates are Unix
+// timestamps in header2 and "year month day hour minute second" in header.
+func headerSections(opts *CreateOptions, now time.Time) ([][]byte, error) {
+	text := func(date string) string {
+		values := []string{opts.CaseNumber, opts.EvidenceNumber, opts.Description, opts.Examiner, opts.Notes, "go-vdisk", runtime.GOOS, date, date, "0"}
+		for i, value := range values {
+			values[i] = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(value)
+		}
+		return "1\nmain\nc\tn\ta\te\tt\tav\tov\tm\tu\tp\n" + strings.Join(values, "\t") + "\n\n"
+	}
+
+	header2 := []byte{0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(text(strconv.FormatInt(now.Unix(), 10)))) {
+		header2 = binary.LittleEndian.AppendUint16(header2, u)
+	}
+	header := text(fmt.Sprintf("%d %d %d %d %d %d", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second()))
+
+	var sections [][]byte
+	for _, data := range [][]byte{header2, []byte(header)} {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		sections = append(sections, buf.Bytes())
+	}
+	return sections, nil
+}
+
+// SegmentName returns the name of segment number of the set whose first
+// segment is first: E01 to E99, then EAA to EZZ, FAA and so on.
+func SegmentName(first string, number int) (string, error) {
+	dot := strings.LastIndex(first, ".")
+	if dot < 0 || len(first)-dot != 4 {
+		return "", fmt.Errorf("invalid ewf segment file name: %s", first)
+	}
+	base, letter := first[:dot+1], first[dot+1]
+	if number < 1 {
+		return "", fmt.Errorf("invalid ewf segment number: %d", number)
+	}
+	if number < 100 {
+		return fmt.Sprintf("%s%c%02d", base, letter, number), nil
+	}
+
+	a, z := byte('A'), byte('Z')
+	if letter >= 'a' && letter <= 'z' {
+		a, z = 'a', 'z'
+	}
+	n := number - 100
+	if int(letter)+n/676 > int(z) {
+		return "", fmt.Errorf("too many ewf segments: %d", number)
+	}
+	return fmt.Sprintf("%s%c%c%c", base, letter+byte(n/676), a+byte(n/26%26), a+byte(n%26)), nil
+}
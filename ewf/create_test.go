@@ -0,0 +1,154 @@
+package ewf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestMedia mixes incompressible, compressible and zero chunks.
+func newTestMedia(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data[:size/2])
+	for i := size / 2; i < size*3/4; i++ {
+		data[i] = byte(i / 512)
+	}
+	return data
+}
+
+func openTestSegments(t *testing.T, dir string) *EWF {
+	names, err := filepath.Glob(filepath.Join(dir, "*.E*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments []io.ReadSeeker
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		segments = append(segments, f)
+	}
+	e, err := NewEWF(segments)
+	if err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	return e
+}
+
+func TestCreateRoundTrip(t *testing.T) {
+	data := newTestMedia(3<<20 + 5*SECTOR_SIZE)
+
+	tests := []struct {
+		name string
+		opts *CreateOptions
+	}{
+		{"uncompressed", &CreateOptions{SegmentSize: MIN_SEGMENT_SIZE}},
+		{"fast", &CreateOptions{SegmentSize: MIN_SEGMENT_SIZE, CompressionLevel: COMPRESSION_FAST, CaseNumber: "42", Examiner: "examiner"}},
+		{"best", &CreateOptions{CompressionLevel: COMPRESSION_BEST, SectorsPerChunk: 128}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			dir := t.TempDir()
+			FileCreator = func(s string) (io.WriteSeeker, error) {
+				return os.Create(filepath.Join(dir, s))
+			}
+			t.Cleanup(func() { FileCreator = nil })
+			if err := Create("image.E01", bytes.NewReader(data), int64(len(data)), tt.opts); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			e := openTestSegments(t, dir)
+			if got, want := e.Size(), int64(len(data)); got != want {
+				t.Fatalf("Size() = %d, want %d", got, want)
+			}
+			got := make([]byte, len(data))
+			if _, err := e.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() error = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("read data does not match source")
+			}
+			if err := e.Verify(); err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if got := e.Header()["c"]; got != tt.opts.CaseNumber {
+				t.Fatalf("case number = %q, want %q", got, tt.opts.CaseNumber)
+			}
+			if acquired, err := e.AcquisitionTime(); err != nil || acquired.Before(start.Truncate(time.Second)) || acquired.After(time.Now()) {
+				t.Fatalf("AcquisitionTime() = %v, %v, want the time of Create", acquired, err)
+			}
+		})
+	}
+}
+
+func TestCreateShortSource(t *testing.T) {
+	dir := t.TempDir()
+	FileCreator = func(s string) (io.WriteSeeker, error) {
+		return os.Create(filepath.Join(dir, s))
+	}
+	t.Cleanup(func() { FileCreator = nil })
+
+	data := newTestMedia(1 << 20)
+	if err := Create("image.E01", bytes.NewReader(data), int64(len(data))+SECTOR_SIZE, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Create() from a short source error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestSegmentName(t *testing.T) {
+	tests := []struct {
+		number int
+		want   string
+	}{
+		{1, "image.E01"},
+		{99, "image.E99"},
+		{100, "image.EAA"},
+		{101, "image.EAB"},
+		{776, "image.FAA"},
+	}
+	for _, tt := range tests {
+		got, err := SegmentName("image.E01", tt.number)
+		if err != nil || got != tt.want {
+			t.Errorf("SegmentName(%d) = %q, %v, want %q", tt.number, got, err, tt.want)
+		}
+	}
+}
+
+func TestHeaderSections(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	sections, err := headerSections(&CreateOptions{CaseNumber: "42"}, now)
+	if err != nil {
+		t.Fatalf("headerSections() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		utf16le bool
+		date    string
+	}{
+		{"header2", sections[0], true, strconv.FormatInt(now.Unix(), 10)},
+		{"header", sections[1], false, "2024 1 2 3 4 5"},
+	}
+	for _, tt := range tests {
+		header, err := parseHeader(tt.data, tt.utf16le)
+		if err != nil {
+			t.Fatalf("parseHeader(%s) error = %v", tt.name, err)
+		}
+		if header["c"] != "42" || header["m"] != tt.date || header["u"] != tt.date {
+			t.Fatalf("%s = %v, want dates %q", tt.name, header, tt.date)
+		}
+		e := &EWF{header: header}
+		if acquired, err := e.AcquisitionTime(); err != nil || !acquired.Equal(now) {
+			t.Fatalf("%s AcquisitionTime() = %v, %v, want %v", tt.name, acquired, err, now)
+		}
+	}
+}
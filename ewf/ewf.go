@@ -0,0 +1,494 @@
+package ewf
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EVF_SIGNATURE  = "EVF\x09\x0d\x0a\xff\x00"
+	LVF_SIGNATURE  = "LVF\x09\x0d\x0a\xff\x00"
+	EVF2_SIGNATURE = "EVF2\x0d\x0a\x81\x00"
+	LEF2_SIGNATURE = "LEF2\x0d\x0a\x81\x00"
+
+	FILE_HEADER_SIZE        = 13
+	SECTION_DESCRIPTOR_SIZE = 76
+	VOLUME_SIZE             = 1052
+	SMART_VOLUME_SIZE       = 94
+	TABLE_HEADER_SIZE       = 24
+	MAX_SECTION_DATA_SIZE   = 64 << 20
+
+	SECTION_HEADER  = "header"
+	SECTION_HEADER2 = "header2"
+	SECTION_VOLUME  = "volume"
+	SECTION_DISK    = "disk"
+	SECTION_DATA    = "data"
+	SECTION_SECTORS = "sectors"
+	SECTION_TABLE   = "table"
+	SECTION_TABLE2  = "table2"
+	SECTION_HASH    = "hash"
+	SECTION_DIGEST  = "digest"
+	SECTION_NEXT    = "next"
+	SECTION_DONE    = "done"
+
+	TABLE_COMPRESSED  = 0x80000000
+	TABLE_OFFSET_MASK = 0x7fffffff
+
+	SECTOR_SIZE = 512
+)
+
+var ErrNoHash = errors.New("ewf image stores no hash")
+
+// ChecksumError reports an Adler-32 mismatch in a section or chunk.
+type ChecksumError struct {
+	What     string
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("ewf %s checksum mismatch: stored 0x%08x, computed 0x%08x", e.What, e.Stored, e.Computed)
+}
+
+type chunk struct {
+	offset     int64
+	size       int64
+	segment    int
+	compressed bool
+	// checksum is set when an Adler-32 follows the uncompressed data, always
+	// the case in EWF1
+	checksum bool
+	// pattern is the 8 bytes repeated over a pattern filled EWF2 chunk
+	pattern []byte
+}
+
+// EWF is an EnCase (E01, Ex01) or SMART (S01) segment set.
+type EWF struct {
+	segments []io.ReadSeeker
+	// version is the EWF format version, 1 or 2, of all segments
+	version           int
+	compressionMethod uint16
+	volume            *Volume
+	header            map[string]string
+	md5               []byte
+	sha1              []byte
+	chunks            []chunk
+
+	size      int64
+	chunkSize int64
+
+	// the last decoded chunk
+	chunkCache      []byte
+	chunkCacheIndex int
+}
+
+// NewEWF opens a segment set from all its segment files, in any order.
+func NewEWF(fhs []io.ReadSeeker) (*EWF, error) {
+	if len(fhs) == 0 {
+		return nil, errors.New("no ewf segment files")
+	}
+
+	e := &EWF{chunkCacheIndex: -1}
+	type segment struct {
+		fh     io.ReadSeeker
+		number uint32
+	}
+	segments := make([]segment, 0, len(fhs))
+	for i, fh := range fhs {
+		header, err := readFileHeader(fh)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && header.version != e.version {
+			return nil, errors.New("ewf segments mix format versions")
+		}
+		e.version, e.compressionMethod = header.version, header.compressionMethod
+		segments = append(segments, segment{fh: fh, number: header.segmentNumber})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].number < segments[j].number
+	})
+
+	for i, segment := range segments {
+		if int(segment.number) != i+1 {
+			return nil, fmt.Errorf("ewf segment %d is missing", i+1)
+		}
+		e.segments = append(e.segments, segment.fh)
+		readSegment := e.readSegment
+		if e.version == 2 {
+			readSegment = e.readSegmentV2
+		}
+		if err := readSegment(i); err != nil {
+			return nil, fmt.Errorf("ewf segment %d: %w", segment.number, err)
+		}
+	}
+
+	if e.version == 2 && e.header != nil {
+		var err error
+		if e.volume, err = volumeFromHeader(e.header); err != nil {
+			return nil, err
+		}
+	}
+	if e.volume == nil {
+		return nil, errors.New("ewf image has no volume section")
+	}
+	e.chunkSize = int64(e.volume.SectorsPerChunk) * int64(e.volume.BytesPerSector)
+	e.size = int64(e.volume.SectorCount) * int64(e.volume.BytesPerSector)
+	if required := (e.size + e.chunkSize - 1) / e.chunkSize; int64(len(e.chunks)) < required {
+		return nil, fmt.Errorf("ewf tables list %d chunks, %d needed for the media size", len(e.chunks), required)
+	}
+	return e, nil
+}
+
+// segmentHeader is what the EWF1 and EWF2 file headers have in common.
+type segmentHeader struct {
+	version           int
+	segmentNumber     uint32
+	compressionMethod uint16
+}
+
+func readFileHeader(fh io.ReadSeeker) (*segmentHeader, error) {
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, FILE_HEADER_V2_SIZE)
+	if _, err := io.ReadFull(fh, buf[:FILE_HEADER_SIZE]); err != nil {
+		return nil, err
+	}
+	switch string(buf[:8]) {
+	case EVF_SIGNATURE:
+		header := &fileHeader{}
+		if _, err := binary.Decode(buf, binary.LittleEndian, header); err != nil {
+			return nil, err
+		}
+		return &segmentHeader{version: 1, segmentNumber: uint32(header.SegmentNumber), compressionMethod: COMPRESSION_METHOD_DEFLATE}, nil
+	case EVF2_SIGNATURE:
+		if _, err := io.ReadFull(fh, buf[FILE_HEADER_SIZE:]); err != nil {
+			return nil, err
+		}
+		header := &fileHeaderV2{}
+		if _, err := binary.Decode(buf, binary.LittleEndian, header); err != nil {
+			return nil, err
+		}
+		if header.MajorVersion != 2 {
+			return nil, fmt.Errorf("unsupported ewf version: %d.%d", header.MajorVersion, header.MinorVersion)
+		}
+		return &segmentHeader{version: 2, segmentNumber: header.SegmentNumber, compressionMethod: header.CompressionMethod}, nil
+	case LVF_SIGNATURE, LEF2_SIGNATURE:
+		return nil, errors.New("logical evidence files are not supported")
+	default:
+		return nil, errors.New("invalid ewf signature")
+	}
+}
+
+// readSegment walks the sections of a segment file, collecting the media
+// description, metadata and chunk locations.
+func (e *EWF) readSegment(index int) error {
+	fh := e.segments[index]
+	var sectorsStart, sectorsEnd int64
+	// a damaged table is replaced by the table2 copy following it
+	var tableErr error
+
+	for offset := int64(FILE_HEADER_SIZE); ; {
+		d, err := readSectionDescriptor(fh, offset)
+		if err != nil {
+			return err
+		}
+
+		switch sectionType := d.typeString(); sectionType {
+		case SECTION_HEADER, SECTION_HEADER2:
+			if e.header != nil && sectionType == SECTION_HEADER {
+				break
+			}
+			data, err := readSectionData(fh, offset, d)
+			if err != nil {
+				return err
+			}
+			if e.header, err = parseHeader(data, sectionType == SECTION_HEADER2); err != nil {
+				return fmt.Errorf("%s section: %w", sectionType, err)
+			}
+		case SECTION_VOLUME, SECTION_DISK:
+			data, err := readSectionData(fh, offset, d)
+			if err != nil {
+				return err
+			}
+			if e.volume, err = parseVolume(data); err != nil {
+				return err
+			}
+		case SECTION_SECTORS:
+			sectorsStart, sectorsEnd = offset+SECTION_DESCRIPTOR_SIZE, offset+int64(d.Size)
+		case SECTION_TABLE, SECTION_TABLE2:
+			if sectionType == SECTION_TABLE && tableErr != nil {
+				return tableErr
+			}
+			if sectionType == SECTION_TABLE2 && tableErr == nil {
+				break
+			}
+			data, err := readSectionData(fh, offset, d)
+			if err != nil {
+				return err
+			}
+			offsets, compressed, err := parseTable(data)
+			var checksumErr *ChecksumError
+			if sectionType == SECTION_TABLE && errors.As(err, &checksumErr) {
+				tableErr = err
+				break
+			}
+			if err != nil {
+				return err
+			}
+			tableErr = nil
+
+			for i, chunkOffset := range offsets {
+				// the last chunk ends with the sectors section, or with the
+				// table section in SMART images storing chunks after the table
+				end := offset + int64(d.Size)
+				if i+1 < len(offsets) {
+					end = offsets[i+1]
+				} else if chunkOffset >= sectorsStart && chunkOffset < sectorsEnd {
+					end = sectorsEnd
+				}
+				if end <= chunkOffset {
+					return fmt.Errorf("invalid ewf chunk offset: 0x%x", chunkOffset)
+				}
+				e.chunks = append(e.chunks, chunk{offset: chunkOffset, size: end - chunkOffset, segment: index, compressed: compressed[i], checksum: !compressed[i]})
+			}
+		case SECTION_HASH, SECTION_DIGEST:
+			data, err := readSectionData(fh, offset, d)
+			if err != nil {
+				return err
+			}
+			if err := e.parseHash(sectionType, data); err != nil {
+				return err
+			}
+		case SECTION_NEXT, SECTION_DONE:
+			return tableErr
+		}
+
+		if int64(d.Next) <= offset {
+			return tableErr
+		}
+		offset = int64(d.Next)
+	}
+}
+
+// parseHash reads the MD5 of a hash section, or the MD5 and SHA1 of a
+// digest section.
+func (e *EWF) parseHash(sectionType string, data []byte) error {
+	length := 32
+	if sectionType == SECTION_DIGEST {
+		length = 76
+	}
+	if len(data) < length+4 {
+		return fmt.Errorf("ewf %s section is truncated", sectionType)
+	}
+	stored := binary.LittleEndian.Uint32(data[length:])
+	if checksum := adler32.Checksum(data[:length]); checksum != stored {
+		return &ChecksumError{What: sectionType + " section", Stored: stored, Computed: checksum}
+	}
+
+	// unset hashes are stored as zeros
+	if sum := data[:md5.Size]; !isZero(sum) {
+		e.md5 = sum
+	}
+	if sum := data[md5.Size : md5.Size+sha1.Size]; sectionType == SECTION_DIGEST && !isZero(sum) {
+		e.sha1 = sum
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Volume returns the media description. For EWF2 images it is derived from
+// the device information and case data.
+func (e *EWF) Volume() Volume {
+	return *e.volume
+}
+
+// Header returns the acquisition metadata keyed by the EWF identifiers,
+// e.g. "c" for the case number or "e" for the examiner. The case data of
+// EWF2 images is mapped to the same identifiers and merged with the device
+// information, whose keys are kept as is.
+func (e *EWF) Header() map[string]string {
+	return e.header
+}
+
+// AcquisitionTime returns the acquisition date, the "m" header value. It is
+// a Unix timestamp in header2 sections and EWF2 case data, and "year month
+// day hour minute second" in local time in header sections.
+func (e *EWF) AcquisitionTime() (time.Time, error) {
+	value := e.header["m"]
+	if fields := strings.Fields(value); len(fields) == 6 {
+		var date [6]int
+		for i, field := range fields {
+			n, err := strconv.Atoi(field)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid ewf acquisition date: %q", value)
+			}
+			date[i] = n
+		}
+		return time.Date(date[0], time.Month(date[1]), date[2], date[3], date[4], date[5], 0, time.Local), nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid ewf acquisition date: %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// MD5 returns the stored hash of the media, nil when there is none.
+func (e *EWF) MD5() []byte {
+	return e.md5
+}
+
+// SHA1 returns the stored hash of the media, nil when there is none.
+func (e *EWF) SHA1() []byte {
+	return e.sha1
+}
+
+func (e *EWF) Size() int64 {
+	return e.size
+}
+
+func (e *EWF) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= e.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), e.size-offset)
+	for read := int64(0); read < length; {
+		pos := offset + read
+		data, err := e.readChunk(int(pos / e.chunkSize))
+		if err != nil {
+			return int(read), err
+		}
+		read += int64(copy(p[read:length], data[pos%e.chunkSize:]))
+	}
+
+	if length < int64(len(p)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// readChunk returns the media data of a chunk, validating the Adler-32 of
+// uncompressed chunks; the compressed streams check their own.
+func (e *EWF) readChunk(index int) ([]byte, error) {
+	if index == e.chunkCacheIndex {
+		return e.chunkCache, nil
+	}
+
+	c := e.chunks[index]
+	expected := min(e.chunkSize, e.size-int64(index)*e.chunkSize)
+	var data []byte
+	switch {
+	case c.pattern != nil:
+		data = bytes.Repeat(c.pattern, int(expected+7)/8)[:expected]
+	case c.compressed:
+		raw, err := e.readChunkData(c, c.size)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = e.decompressChunk(raw); err != nil {
+			return nil, fmt.Errorf("ewf chunk %d: %w", index, err)
+		}
+		if int64(len(data)) < expected {
+			return nil, fmt.Errorf("ewf chunk %d is short: %d bytes", index, len(data))
+		}
+	default:
+		size := expected
+		if c.checksum {
+			size += 4
+		}
+		if c.size != size {
+			return nil, fmt.Errorf("ewf chunk %d is %d bytes, want %d", index, c.size, size)
+		}
+		raw, err := e.readChunkData(c, size)
+		if err != nil {
+			return nil, err
+		}
+		data = raw[:expected]
+		if c.checksum {
+			stored := binary.LittleEndian.Uint32(raw[expected:])
+			if checksum := adler32.Checksum(data); checksum != stored {
+				return nil, &ChecksumError{What: fmt.Sprintf("chunk %d", index), Stored: stored, Computed: checksum}
+			}
+		}
+	}
+
+	e.chunkCache, e.chunkCacheIndex = data, index
+	return data, nil
+}
+
+func (e *EWF) readChunkData(c chunk, size int64) ([]byte, error) {
+	fh := e.segments[c.segment]
+	if _, err := fh.Seek(c.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(fh, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (e *EWF) decompressChunk(raw []byte) ([]byte, error) {
+	var r io.Reader
+	switch e.compressionMethod {
+	case COMPRESSION_METHOD_DEFLATE:
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case COMPRESSION_METHOD_BZIP2:
+		r = bzip2.NewReader(bytes.NewReader(raw))
+	default:
+		return nil, fmt.Errorf("unsupported ewf compression method: %d", e.compressionMethod)
+	}
+	return io.ReadAll(io.LimitReader(r, e.chunkSize))
+}
+
+// Verify reads the whole media and compares it against the stored MD5 and
+// SHA1 hashes.
+func (e *EWF) Verify() error {
+	if e.md5 == nil && e.sha1 == nil {
+		return ErrNoHash
+	}
+
+	md5Hash, sha1Hash := md5.New(), sha1.New()
+	w := io.MultiWriter(md5Hash, sha1Hash)
+	if _, err := io.Copy(w, io.NewSectionReader(e, 0, e.size)); err != nil {
+		return err
+	}
+
+	if sum := md5Hash.Sum(nil); e.md5 != nil && !bytes.Equal(sum, e.md5) {
+		return fmt.Errorf("ewf md5 mismatch: stored %x, computed %x", e.md5, sum)
+	}
+	if sum := sha1Hash.Sum(nil); e.sha1 != nil && !bytes.Equal(sum, e.sha1) {
+		return fmt.Errorf("ewf sha1 mismatch: stored %x, computed %x", e.sha1, sum)
+	}
+	return nil
+}
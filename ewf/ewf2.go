@@ -0,0 +1,332 @@
+package ewf
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	FILE_HEADER_V2_SIZE        = 32
+	SECTION_DESCRIPTOR_V2_SIZE = 64
+	SECTOR_TABLE_HEADER_SIZE   = 32
+	SECTOR_TABLE_ENTRY_SIZE    = 16
+
+	COMPRESSION_METHOD_NONE    = 0
+	COMPRESSION_METHOD_DEFLATE = 1
+	COMPRESSION_METHOD_BZIP2   = 2
+
+	SECTION_TYPE_DEVICE_INFORMATION = 0x01
+	SECTION_TYPE_CASE_DATA          = 0x02
+	SECTION_TYPE_SECTOR_DATA        = 0x03
+	SECTION_TYPE_SECTOR_TABLE       = 0x04
+	SECTION_TYPE_ERROR_TABLE        = 0x05
+	SECTION_TYPE_SESSION_TABLE      = 0x06
+	SECTION_TYPE_INCREMENT_DATA     = 0x07
+	SECTION_TYPE_MD5_HASH           = 0x08
+	SECTION_TYPE_SHA1_HASH          = 0x09
+	SECTION_TYPE_RESTART_DATA       = 0x0a
+	SECTION_TYPE_ENCRYPTION_KEYS    = 0x0b
+	SECTION_TYPE_MEMORY_EXTENTS     = 0x0c
+	SECTION_TYPE_NEXT               = 0x0d
+	SECTION_TYPE_FINAL_INFORMATION  = 0x0e
+	SECTION_TYPE_DONE               = 0x0f
+	SECTION_TYPE_ANALYTICAL_DATA    = 0x10
+
+	SECTION_FLAG_MD5_HASHED = 0x01
+	SECTION_FLAG_ENCRYPTED  = 0x02
+
+	CHUNK_FLAG_COMPRESSED   = 0x01
+	CHUNK_FLAG_CHECKSUM     = 0x02
+	CHUNK_FLAG_PATTERN_FILL = 0x04
+)
+
+type fileHeaderV2 struct {
+	Signature         [8]byte
+	MajorVersion      uint8
+	MinorVersion      uint8
+	CompressionMethod uint16
+	SegmentNumber     uint32
+	SetIdentifier     [16]byte
+}
+
+// sectionDescriptorV2 follows the data of an EWF2 section and its padding.
+// PreviousOffset is the offset of the descriptor of the previous section,
+// 0 for the first one.
+type sectionDescriptorV2 struct {
+	Type           uint32
+	DataFlags      uint32
+	PreviousOffset uint64
+	DataSize       uint64
+	DescriptorSize uint32
+	PaddingSize    uint32
+	DataHash       [16]byte
+	_              [12]byte
+	Checksum       uint32
+}
+
+type sectorTableHeader struct {
+	FirstChunk uint64
+	EntryCount uint32
+	_          [4]byte
+	Checksum   uint32
+	_          [12]byte
+}
+
+type sectorTableEntry struct {
+	Offset uint64
+	Size   uint32
+	Flags  uint32
+}
+
+// caseDataKeys maps the EWF2 case data identifiers to the EWF1 header ones.
+var caseDataKeys = map[string]string{
+	"nm": "a",
+	"cn": "c",
+	"en": "n",
+	"ex": "e",
+	"nt": "t",
+	"av": "av",
+	"os": "ov",
+	"at": "m",
+	"tt": "u",
+}
+
+func readSectionDescriptorV2(fh io.ReadSeeker, offset int64) (*sectionDescriptorV2, error) {
+	if _, err := fh.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, SECTION_DESCRIPTOR_V2_SIZE)
+	if _, err := io.ReadFull(fh, buf); err != nil {
+		return nil, err
+	}
+	d := &sectionDescriptorV2{}
+	if _, err := binary.Decode(buf, binary.LittleEndian, d); err != nil {
+		return nil, err
+	}
+	if checksum := adler32.Checksum(buf[:SECTION_DESCRIPTOR_V2_SIZE-4]); checksum != d.Checksum {
+		return nil, &ChecksumError{What: fmt.Sprintf("section descriptor at 0x%x", offset), Stored: d.Checksum, Computed: checksum}
+	}
+	return d, nil
+}
+
+// readSectionDataV2 reads the data preceding the section descriptor at
+// offset and checks its MD5 when the descriptor stores one.
+func readSectionDataV2(fh io.ReadSeeker, offset int64, d *sectionDescriptorV2) ([]byte, error) {
+	if d.DataFlags&SECTION_FLAG_ENCRYPTED != 0 {
+		return nil, errors.New("encrypted ewf sections are not supported")
+	}
+	start := offset - int64(d.PaddingSize) - int64(d.DataSize)
+	if d.DataSize > MAX_SECTION_DATA_SIZE || start < FILE_HEADER_V2_SIZE {
+		return nil, fmt.Errorf("invalid ewf section 0x%x size: %d", d.Type, d.DataSize)
+	}
+	if _, err := fh.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, d.DataSize)
+	if _, err := io.ReadFull(fh, data); err != nil {
+		return nil, err
+	}
+	if d.DataFlags&SECTION_FLAG_MD5_HASHED != 0 {
+		if sum := md5.Sum(data); !bytes.Equal(sum[:], d.DataHash[:]) {
+			return nil, fmt.Errorf("ewf section 0x%x data hash mismatch", d.Type)
+		}
+	}
+	return data, nil
+}
+
+// readSegmentV2 walks the sections of an EWF2 segment file back from the
+// descriptor at its end, then handles them in file order.
+func (e *EWF) readSegmentV2(index int) error {
+	fh := e.segments[index]
+	end, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	type section struct {
+		offset     int64
+		descriptor *sectionDescriptorV2
+	}
+	var sections []section
+	for offset := end - SECTION_DESCRIPTOR_V2_SIZE; ; {
+		if offset < FILE_HEADER_V2_SIZE || len(sections) > int(end/SECTION_DESCRIPTOR_V2_SIZE) {
+			return fmt.Errorf("invalid ewf section descriptor offset: 0x%x", offset)
+		}
+		d, err := readSectionDescriptorV2(fh, offset)
+		if err != nil {
+			return err
+		}
+		sections = append(sections, section{offset: offset, descriptor: d})
+		if d.PreviousOffset == 0 {
+			break
+		}
+		if int64(d.PreviousOffset) >= offset {
+			return fmt.Errorf("invalid ewf previous section offset: 0x%x", d.PreviousOffset)
+		}
+		offset = int64(d.PreviousOffset)
+	}
+
+	for i := len(sections) - 1; i >= 0; i-- {
+		offset, d := sections[i].offset, sections[i].descriptor
+		switch d.Type {
+		case SECTION_TYPE_DEVICE_INFORMATION, SECTION_TYPE_CASE_DATA:
+			data, err := readSectionDataV2(fh, offset, d)
+			if err != nil {
+				return err
+			}
+			values, err := parseHeader(data, true)
+			if err != nil {
+				return fmt.Errorf("ewf section 0x%x: %w", d.Type, err)
+			}
+			if e.header == nil {
+				e.header = map[string]string{}
+			}
+			for key, value := range values {
+				if mapped, ok := caseDataKeys[key]; ok && d.Type == SECTION_TYPE_CASE_DATA {
+					key = mapped
+				}
+				e.header[key] = value
+			}
+		case SECTION_TYPE_SECTOR_TABLE:
+			data, err := readSectionDataV2(fh, offset, d)
+			if err != nil {
+				return err
+			}
+			if err := e.parseSectorTable(index, data); err != nil {
+				return err
+			}
+		case SECTION_TYPE_MD5_HASH, SECTION_TYPE_SHA1_HASH:
+			data, err := readSectionDataV2(fh, offset, d)
+			if err != nil {
+				return err
+			}
+			if err := e.parseHashV2(d.Type, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseSectorTable appends the chunks of a sector table, which must
+// continue where the previous table ended.
+func (e *EWF) parseSectorTable(segment int, data []byte) error {
+	header := &sectorTableHeader{}
+	if len(data) < SECTOR_TABLE_HEADER_SIZE {
+		return fmt.Errorf("ewf sector table is truncated: %d bytes", len(data))
+	}
+	if _, err := binary.Decode(data, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if checksum := adler32.Checksum(data[:16]); checksum != header.Checksum {
+		return &ChecksumError{What: "sector table header", Stored: header.Checksum, Computed: checksum}
+	}
+	if header.FirstChunk != uint64(len(e.chunks)) {
+		return fmt.Errorf("ewf sector table starts at chunk %d, want %d", header.FirstChunk, len(e.chunks))
+	}
+
+	entries := data[SECTOR_TABLE_HEADER_SIZE:]
+	end := uint64(header.EntryCount) * SECTOR_TABLE_ENTRY_SIZE
+	if uint64(len(entries)) < end+4 {
+		return fmt.Errorf("ewf sector table has %d entries but room for %d", header.EntryCount, len(entries)/SECTOR_TABLE_ENTRY_SIZE)
+	}
+	stored := binary.LittleEndian.Uint32(entries[end:])
+	if checksum := adler32.Checksum(entries[:end]); checksum != stored {
+		return &ChecksumError{What: "sector table entries", Stored: stored, Computed: checksum}
+	}
+
+	for i := uint64(0); i < uint64(header.EntryCount); i++ {
+		entry := &sectorTableEntry{}
+		if _, err := binary.Decode(entries[i*SECTOR_TABLE_ENTRY_SIZE:], binary.LittleEndian, entry); err != nil {
+			return err
+		}
+		c := chunk{
+			offset:     int64(entry.Offset),
+			size:       int64(entry.Size),
+			segment:    segment,
+			compressed: entry.Flags&CHUNK_FLAG_COMPRESSED != 0,
+			checksum:   entry.Flags&CHUNK_FLAG_CHECKSUM != 0,
+		}
+		if entry.Flags&CHUNK_FLAG_PATTERN_FILL != 0 {
+			c.pattern = binary.LittleEndian.AppendUint64(nil, entry.Offset)
+		}
+		e.chunks = append(e.chunks, c)
+	}
+	return nil
+}
+
+// parseHashV2 reads an MD5 or SHA1 hash section: the hash followed by its
+// Adler-32.
+func (e *EWF) parseHashV2(sectionType uint32, data []byte) error {
+	length := md5.Size
+	if sectionType == SECTION_TYPE_SHA1_HASH {
+		length = sha1.Size
+	}
+	if len(data) < length+4 {
+		return fmt.Errorf("ewf hash section 0x%x is truncated", sectionType)
+	}
+	stored := binary.LittleEndian.Uint32(data[length:])
+	if checksum := adler32.Checksum(data[:length]); checksum != stored {
+		return &ChecksumError{What: "hash section", Stored: stored, Computed: checksum}
+	}
+	// unset hashes are stored as zeros
+	switch sum := data[:length]; {
+	case isZero(sum):
+	case sectionType == SECTION_TYPE_SHA1_HASH:
+		e.sha1 = sum
+	default:
+		e.md5 = sum
+	}
+	return nil
+}
+
+// volumeFromHeader derives the media description of an EWF2 image from its
+// device information ("ts" sectors of "bp" bytes) and case data ("sb"
+// sectors per chunk).
+func volumeFromHeader(header map[string]string) (*Volume, error) {
+	number := func(key string, fallback uint64) (uint64, error) {
+		value := header[key]
+		if value == "" {
+			return fallback, nil
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ewf %s value: %q", key, value)
+		}
+		return n, nil
+	}
+	if header["ts"] == "" {
+		return nil, errors.New("ewf device information has no sector count")
+	}
+	sectorCount, err := number("ts", 0)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerSector, err := number("bp", SECTOR_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	sectorsPerChunk, err := number("sb", DEFAULT_SECTORS_PER_CHUNK)
+	if err != nil {
+		return nil, err
+	}
+	if sectorsPerChunk == 0 || sectorsPerChunk > math.MaxUint32 || bytesPerSector == 0 || bytesPerSector > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid ewf chunk geometry: %d sectors of %d bytes", sectorsPerChunk, bytesPerSector)
+	}
+
+	chunkSize := sectorsPerChunk * bytesPerSector
+	return &Volume{
+		ChunkCount:      uint32((sectorCount*bytesPerSector + chunkSize - 1) / chunkSize),
+		SectorsPerChunk: uint32(sectorsPerChunk),
+		BytesPerSector:  uint32(bytesPerSector),
+		SectorCount:     sectorCount,
+	}, nil
+}
@@ -0,0 +1,411 @@
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/adler32"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	testSectorsPerChunk = 2
+	testChunkSize       = testSectorsPerChunk * SECTOR_SIZE
+	// five chunks, the last one a single sector
+	testSectorCount = 9
+)
+
+func newTestChunks() [][]byte {
+	media := make([]byte, testSectorCount*SECTOR_SIZE)
+	for i := range media {
+		media[i] = byte(i*7 + i/SECTOR_SIZE)
+	}
+	// chunk 1 compresses well
+	copy(media[testChunkSize:], bytes.Repeat([]byte("compressible "), testChunkSize/13+1)[:testChunkSize])
+
+	var chunks [][]byte
+	for offset := 0; offset < len(media); offset += testChunkSize {
+		chunks = append(chunks, media[offset:min(offset+testChunkSize, len(media))])
+	}
+	return chunks
+}
+
+func zlibCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// testSegment assembles an EWF1 segment file in memory.
+type testSegment struct {
+	bytes.Buffer
+}
+
+func newTestSegment(number uint16) *testSegment {
+	s := &testSegment{}
+	header := fileHeader{FieldsStart: 1, SegmentNumber: number}
+	copy(header.Signature[:], EVF_SIGNATURE)
+	binary.Write(s, binary.LittleEndian, &header)
+	return s
+}
+
+// section appends a section and returns the offset of its data.
+func (s *testSegment) section(sectionType string, data []byte) int {
+	size := uint64(SECTION_DESCRIPTOR_SIZE + len(data))
+	s.Write(sectionDescriptorBytes(sectionType, uint64(s.Len())+size, size))
+	offset := s.Len()
+	s.Write(data)
+	return offset
+}
+
+func (s *testSegment) last(sectionType string) {
+	s.Write(sectionDescriptorBytes(sectionType, uint64(s.Len()), SECTION_DESCRIPTOR_SIZE))
+}
+
+// sectors appends a sectors section holding the stored chunks followed by a
+// table and a table2 section, and returns the offsets of the chunks and of
+// the data of both tables.
+func (s *testSegment) sectors(stored [][]byte, compressed []bool) ([]int, [2]int) {
+	start := s.Len()
+	s.Write(make([]byte, SECTION_DESCRIPTOR_SIZE))
+	var offsets []int
+	var entries []uint32
+	for i, data := range stored {
+		offsets = append(offsets, s.Len())
+		entry := uint32(s.Len())
+		if compressed[i] {
+			entry |= TABLE_COMPRESSED
+		}
+		entries = append(entries, entry)
+		s.Write(data)
+	}
+	copy(s.Bytes()[start:], sectionDescriptorBytes(SECTION_SECTORS, uint64(s.Len()), uint64(s.Len()-start)))
+
+	table := make([]byte, TABLE_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(table, uint32(len(entries)))
+	binary.LittleEndian.PutUint32(table[TABLE_HEADER_SIZE-4:], adler32.Checksum(table[:TABLE_HEADER_SIZE-4]))
+	table, _ = binary.Append(table, binary.LittleEndian, entries)
+	table = binary.LittleEndian.AppendUint32(table, adler32.Checksum(table[TABLE_HEADER_SIZE:]))
+	return offsets, [2]int{s.section(SECTION_TABLE, table), s.section(SECTION_TABLE2, table)}
+}
+
+type testImageOptions struct {
+	noHash bool
+	// padding is stored after the checksum of chunk 0
+	padding int
+}
+
+// newTestImage stores newTestChunks in two EWF1 segments and returns them
+// with the offsets of the volume data, of chunk 0 and of the table data of
+// the first segment.
+func newTestImage(t *testing.T, opts testImageOptions) ([][]byte, map[string]int) {
+	chunks := newTestChunks()
+	volume := Volume{ChunkCount: uint32(len(chunks)), SectorsPerChunk: testSectorsPerChunk, BytesPerSector: SECTOR_SIZE, SectorCount: testSectorCount}
+	volumeData, err := volumeBytes(&volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := headerSections(&CreateOptions{CaseNumber: "42", Examiner: "examiner"}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func(i int) []byte {
+		return binary.LittleEndian.AppendUint32(bytes.Clone(chunks[i]), adler32.Checksum(chunks[i]))
+	}
+
+	first := newTestSegment(1)
+	first.section(SECTION_HEADER2, headers[0])
+	first.section(SECTION_HEADER, headers[1])
+	offsets := map[string]int{"volume": first.section(SECTION_VOLUME, volumeData)}
+	chunk0 := append(stored(0), make([]byte, opts.padding)...)
+	chunkOffsets, tables := first.sectors([][]byte{chunk0, zlibCompress(chunks[1]), stored(2)}, []bool{false, true, false})
+	offsets["chunk0"], offsets["table"], offsets["table2"] = chunkOffsets[0], tables[0], tables[1]
+	first.last(SECTION_NEXT)
+
+	second := newTestSegment(2)
+	second.section(SECTION_DATA, volumeData)
+	second.sectors([][]byte{stored(3), zlibCompress(chunks[4])}, []bool{false, true})
+	if !opts.noHash {
+		media := bytes.Join(chunks, nil)
+		md5Sum, sha1Sum := md5.Sum(media), sha1.Sum(media)
+		digest := append(append(md5Sum[:], sha1Sum[:]...), make([]byte, 40)...)
+		second.section(SECTION_DIGEST, binary.LittleEndian.AppendUint32(digest, adler32.Checksum(digest)))
+		hash := append(md5Sum[:], make([]byte, 16)...)
+		second.section(SECTION_HASH, binary.LittleEndian.AppendUint32(hash, adler32.Checksum(hash)))
+	}
+	second.last(SECTION_DONE)
+	return [][]byte{first.Bytes(), second.Bytes()}, offsets
+}
+
+func openTestImage(segments ...[]byte) (*EWF, error) {
+	var fhs []io.ReadSeeker
+	for _, segment := range segments {
+		fhs = append(fhs, bytes.NewReader(segment))
+	}
+	return NewEWF(fhs)
+}
+
+func readTestImage(t *testing.T, e *EWF) []byte {
+	got := make([]byte, e.Size())
+	if _, err := e.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	return got
+}
+
+func TestEWF(t *testing.T) {
+	want := bytes.Join(newTestChunks(), nil)
+	segments, offsets := newTestImage(t, testImageOptions{})
+
+	e, err := openTestImage(segments[1], segments[0])
+	if err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	if v := e.Volume(); v.SectorCount != testSectorCount || v.SectorsPerChunk != testSectorsPerChunk || e.Size() != int64(len(want)) {
+		t.Fatalf("Volume() = %d sectors, %d per chunk, Size() = %d", v.SectorCount, v.SectorsPerChunk, e.Size())
+	}
+	if e.Header()["c"] != "42" || e.Header()["e"] != "examiner" {
+		t.Fatalf("Header() = %v", e.Header())
+	}
+	if !bytes.Equal(readTestImage(t, e), want) {
+		t.Fatal("ReadAt() data does not match")
+	}
+	if err := e.Verify(); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	if _, err := openTestImage(segments[1]); err == nil || !strings.Contains(err.Error(), "segment 1 is missing") {
+		t.Fatalf("NewEWF() error = %v, want a missing segment", err)
+	}
+
+	corrupt := func(segment []byte, offsets ...int) []byte {
+		segment = bytes.Clone(segment)
+		for _, offset := range offsets {
+			segment[offset] ^= 0xff
+		}
+		return segment
+	}
+
+	// a damaged table is replaced by table2
+	e, err = openTestImage(corrupt(segments[0], offsets["table"]+TABLE_HEADER_SIZE), segments[1])
+	if err != nil {
+		t.Fatalf("NewEWF() with a corrupt table error = %v", err)
+	}
+	if !bytes.Equal(readTestImage(t, e), want) {
+		t.Fatal("ReadAt() through table2 data does not match")
+	}
+
+	checksumErrors := []struct {
+		name    string
+		segment []byte
+	}{
+		{"tables", corrupt(segments[0], offsets["table"]+TABLE_HEADER_SIZE, offsets["table2"]+TABLE_HEADER_SIZE)},
+		{"volume", corrupt(segments[0], offsets["volume"]+4)},
+		{"descriptor", corrupt(segments[0], offsets["volume"]-SECTION_DESCRIPTOR_SIZE+20)},
+	}
+	for _, tt := range checksumErrors {
+		var checksumErr *ChecksumError
+		if _, err := openTestImage(tt.segment, segments[1]); !errors.As(err, &checksumErr) {
+			t.Fatalf("NewEWF() with a corrupt %s error = %v, want a ChecksumError", tt.name, err)
+		}
+	}
+
+	e, err = openTestImage(corrupt(segments[0], offsets["chunk0"]), segments[1])
+	if err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	var checksumErr *ChecksumError
+	if _, err := e.ReadAt(make([]byte, 16), 0); !errors.As(err, &checksumErr) || checksumErr.What != "chunk 0" {
+		t.Fatalf("ReadAt() of a corrupt chunk error = %v, want a ChecksumError", err)
+	}
+
+	// an uncompressed chunk must be exactly its data and checksum
+	padded, _ := newTestImage(t, testImageOptions{padding: 2})
+	e, err = openTestImage(padded...)
+	if err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	if _, err := e.ReadAt(make([]byte, 16), 0); err == nil || !strings.Contains(err.Error(), "want 1028") {
+		t.Fatalf("ReadAt() of an oversized chunk error = %v", err)
+	}
+
+	unhashed, _ := newTestImage(t, testImageOptions{noHash: true})
+	e, err = openTestImage(unhashed...)
+	if err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	if err := e.Verify(); !errors.Is(err, ErrNoHash) {
+		t.Fatalf("Verify() error = %v, want ErrNoHash", err)
+	}
+}
+
+// testSegmentV2 assembles an EWF2 segment file in memory.
+type testSegmentV2 struct {
+	bytes.Buffer
+	previous int
+}
+
+func newTestSegmentV2(number uint32, compressionMethod uint16) *testSegmentV2 {
+	s := &testSegmentV2{}
+	header := fileHeaderV2{MajorVersion: 2, CompressionMethod: compressionMethod, SegmentNumber: number}
+	copy(header.Signature[:], EVF2_SIGNATURE)
+	binary.Write(s, binary.LittleEndian, &header)
+	return s
+}
+
+// section appends the data of a section, its padding to 16 bytes and its
+// descriptor, and returns the offset of the data.
+func (s *testSegmentV2) section(sectionType, flags uint32, data []byte) int {
+	offset := s.Len()
+	s.Write(data)
+	padding := -len(data) & 15
+	s.Write(make([]byte, padding))
+
+	d := sectionDescriptorV2{
+		Type:           sectionType,
+		DataFlags:      flags,
+		PreviousOffset: uint64(s.previous),
+		DataSize:       uint64(len(data)),
+		DescriptorSize: SECTION_DESCRIPTOR_V2_SIZE,
+		PaddingSize:    uint32(padding),
+	}
+	if flags&SECTION_FLAG_MD5_HASHED != 0 {
+		d.DataHash = md5.Sum(data)
+	}
+	buf, _ := binary.Append(nil, binary.LittleEndian, &d)
+	binary.LittleEndian.PutUint32(buf[SECTION_DESCRIPTOR_V2_SIZE-4:], adler32.Checksum(buf[:SECTION_DESCRIPTOR_V2_SIZE-4]))
+	s.previous = s.Len()
+	s.Write(buf)
+	return offset
+}
+
+// header appends a device information or case data section.
+func (s *testSegmentV2) header(sectionType, flags uint32, keys, values string) int {
+	var text []byte
+	for _, u := range utf16.Encode([]rune("1\nmain\n" + keys + "\n" + values + "\n\n")) {
+		text = binary.LittleEndian.AppendUint16(text, u)
+	}
+	return s.section(sectionType, flags, zlibCompress(text))
+}
+
+// sectors appends a sector data section and the sector table of its
+// chunks; a chunk without data is pattern filled.
+func (s *testSegmentV2) sectors(firstChunk uint64, stored [][]byte, flags []uint32, patterns []uint64) []int {
+	var offsets []int
+	for offset, i := s.Len(), 0; i < len(stored); offset, i = offset+len(stored[i]), i+1 {
+		offsets = append(offsets, offset)
+	}
+	s.section(SECTION_TYPE_SECTOR_DATA, 0, bytes.Join(stored, nil))
+
+	table, _ := binary.Append(nil, binary.LittleEndian, &sectorTableHeader{FirstChunk: firstChunk, EntryCount: uint32(len(stored))})
+	binary.LittleEndian.PutUint32(table[16:], adler32.Checksum(table[:16]))
+	for i, data := range stored {
+		entry := sectorTableEntry{Offset: uint64(offsets[i]), Size: uint32(len(data)), Flags: flags[i]}
+		if flags[i]&CHUNK_FLAG_PATTERN_FILL != 0 {
+			entry.Offset, entry.Size = patterns[i], 8
+		}
+		table, _ = binary.Append(table, binary.LittleEndian, &entry)
+	}
+	table = binary.LittleEndian.AppendUint32(table, adler32.Checksum(table[SECTOR_TABLE_HEADER_SIZE:]))
+	s.section(SECTION_TYPE_SECTOR_TABLE, 0, append(table, make([]byte, 12)...))
+	return offsets
+}
+
+func (s *testSegmentV2) hash(sectionType uint32, sum []byte) {
+	s.section(sectionType, 0, binary.LittleEndian.AppendUint32(bytes.Clone(sum), adler32.Checksum(sum)))
+}
+
+func TestEWF2(t *testing.T) {
+	const pattern = 0x0807060504030201
+	chunks := newTestChunks()
+	copy(chunks[2], bytes.Repeat(binary.LittleEndian.AppendUint64(nil, pattern), testChunkSize/8))
+	want := bytes.Join(chunks, nil)
+	withChecksum := func(data []byte) []byte {
+		return binary.LittleEndian.AppendUint32(bytes.Clone(data), adler32.Checksum(data))
+	}
+
+	first := newTestSegmentV2(1, COMPRESSION_METHOD_DEFLATE)
+	first.header(SECTION_TYPE_DEVICE_INFORMATION, 0, "sn\tmd\tts\tbp", "SN123\tdisk\t9\t512")
+	caseData := first.header(SECTION_TYPE_CASE_DATA, SECTION_FLAG_MD5_HASHED, "cn\tex\tsb", "42\texaminer\t2")
+	chunkOffsets := first.sectors(0,
+		[][]byte{zlibCompress(chunks[0]), withChecksum(chunks[1]), nil},
+		[]uint32{CHUNK_FLAG_COMPRESSED, CHUNK_FLAG_CHECKSUM, CHUNK_FLAG_PATTERN_FILL},
+		[]uint64{0, 0, pattern})
+	first.section(SECTION_TYPE_NEXT, 0, nil)
+
+	second := newTestSegmentV2(2, COMPRESSION_METHOD_DEFLATE)
+	second.sectors(3, [][]byte{chunks[3], zlibCompress(chunks[4])}, []uint32{0, CHUNK_FLAG_COMPRESSED}, nil)
+	md5Sum, sha1Sum := md5.Sum(want), sha1.Sum(want)
+	second.hash(SECTION_TYPE_MD5_HASH, md5Sum[:])
+	second.hash(SECTION_TYPE_SHA1_HASH, sha1Sum[:])
+	second.section(SECTION_TYPE_DONE, 0, nil)
+
+	e, err := openTestImage(second.Bytes(), first.Bytes())
+	if err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	if v := e.Volume(); v.SectorCount != testSectorCount || v.SectorsPerChunk != testSectorsPerChunk || v.BytesPerSector != SECTOR_SIZE || v.ChunkCount != 5 {
+		t.Fatalf("Volume() = %+v", v)
+	}
+	if h := e.Header(); h["c"] != "42" || h["e"] != "examiner" || h["sn"] != "SN123" {
+		t.Fatalf("Header() = %v", h)
+	}
+	if !bytes.Equal(readTestImage(t, e), want) {
+		t.Fatal("ReadAt() data does not match")
+	}
+	if err := e.Verify(); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if !bytes.Equal(e.MD5(), md5Sum[:]) || !bytes.Equal(e.SHA1(), sha1Sum[:]) {
+		t.Fatalf("MD5() = %x, SHA1() = %x", e.MD5(), e.SHA1())
+	}
+
+	corrupt := bytes.Clone(first.Bytes())
+	corrupt[caseData] ^= 0xff
+	if _, err := openTestImage(corrupt, second.Bytes()); err == nil || !strings.Contains(err.Error(), "data hash mismatch") {
+		t.Fatalf("NewEWF() with corrupt case data error = %v, want a hash mismatch", err)
+	}
+
+	corrupt = bytes.Clone(first.Bytes())
+	corrupt[chunkOffsets[1]] ^= 0xff
+	if e, err = openTestImage(corrupt, second.Bytes()); err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	var checksumErr *ChecksumError
+	if _, err := e.ReadAt(make([]byte, 16), testChunkSize); !errors.As(err, &checksumErr) || checksumErr.What != "chunk 1" {
+		t.Fatalf("ReadAt() of a corrupt chunk error = %v, want a ChecksumError", err)
+	}
+}
+
+func TestEWF2Bzip2(t *testing.T) {
+	// bzip2 -9 of the chunk, the standard library only decompresses
+	compressed, _ := hex.DecodeString("425a6839314159265359df7a446000007f998040001000186942102000508069a680a551a0d3d4f249cc936a4d249dc93149f4932498a4c926293f177245385090df7a4460")
+	want := bytes.Repeat([]byte("bzip2 chunk "), 100)[:testChunkSize]
+
+	s := newTestSegmentV2(1, COMPRESSION_METHOD_BZIP2)
+	s.header(SECTION_TYPE_DEVICE_INFORMATION, 0, "ts", "2")
+	s.header(SECTION_TYPE_CASE_DATA, 0, "sb", "2")
+	s.sectors(0, [][]byte{compressed}, []uint32{CHUNK_FLAG_COMPRESSED}, nil)
+	s.section(SECTION_TYPE_DONE, 0, nil)
+
+	e, err := openTestImage(s.Bytes())
+	if err != nil {
+		t.Fatalf("NewEWF() error = %v", err)
+	}
+	if !bytes.Equal(readTestImage(t, e), want) {
+		t.Fatal("ReadAt() data does not match")
+	}
+	if err := e.Verify(); !errors.Is(err, ErrNoHash) {
+		t.Fatalf("Verify() error = %v, want ErrNoHash", err)
+	}
+}
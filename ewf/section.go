@@ -0,0 +1,201 @@
+package ewf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+type fileHeader struct {
+	Signature     [8]byte
+	FieldsStart   uint8
+	SegmentNumber uint16
+	FieldsEnd     uint16
+}
+
+type sectionDescriptor struct {
+	Type     [16]byte
+	Next     uint64
+	Size     uint64
+	Padding  [40]byte
+	Checksum uint32
+}
+
+func (d *sectionDescriptor) typeString() string {
+	return strings.TrimRight(string(d.Type[:]), "\x00")
+}
+
+// Volume is the volume (or disk) section describing the media.
+type Volume struct {
+	MediaType            uint8
+	_                    [3]byte
+	ChunkCount           uint32
+	SectorsPerChunk      uint32
+	BytesPerSector       uint32
+	SectorCount          uint64
+	Cylinders            uint32
+	Heads                uint32
+	Sectors              uint32
+	MediaFlags           uint8
+	_                    [3]byte
+	PalmStartSector      uint32
+	_                    uint32
+	SmartLogsStartSector uint32
+	CompressionLevel     uint8
+	_                    [3]byte
+	ErrorGranularity     uint32
+	_                    uint32
+	SetIdentifier        [16]byte
+	_                    [963]byte
+	Signature            [5]byte
+	Checksum             uint32
+}
+
+type tableHeader struct {
+	EntryCount uint32
+	_          [4]byte
+	BaseOffset uint64
+	_          [4]byte
+	Checksum   uint32
+}
+
+func readSectionDescriptor(fh io.ReadSeeker, offset int64) (*sectionDescriptor, error) {
+	if _, err := fh.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, SECTION_DESCRIPTOR_SIZE)
+	if _, err := io.ReadFull(fh, buf); err != nil {
+		return nil, err
+	}
+	d := &sectionDescriptor{}
+	if _, err := binary.Decode(buf, binary.LittleEndian, d); err != nil {
+		return nil, err
+	}
+	if checksum := adler32.Checksum(buf[:SECTION_DESCRIPTOR_SIZE-4]); checksum != d.Checksum {
+		return nil, &ChecksumError{What: fmt.Sprintf("section descriptor at 0x%x", offset), Stored: d.Checksum, Computed: checksum}
+	}
+	return d, nil
+}
+
+// readSectionData reads the data of a section following its descriptor.
+func readSectionData(fh io.ReadSeeker, offset int64, d *sectionDescriptor) ([]byte, error) {
+	if d.Size < SECTION_DESCRIPTOR_SIZE || d.Size > MAX_SECTION_DATA_SIZE {
+		return nil, fmt.Errorf("invalid ewf %s section size: %d", d.typeString(), d.Size)
+	}
+	if _, err := fh.Seek(offset+SECTION_DESCRIPTOR_SIZE, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, d.Size-SECTION_DESCRIPTOR_SIZE)
+	_, err := io.ReadFull(fh, data)
+	return data, err
+}
+
+// parseVolume reads the volume section of EnCase images or the shorter one
+// of SMART images, which stores a 32-bit sector count.
+func parseVolume(data []byte) (*Volume, error) {
+	volume := &Volume{}
+	switch {
+	case len(data) >= VOLUME_SIZE:
+		if _, err := binary.Decode(data, binary.LittleEndian, volume); err != nil {
+			return nil, err
+		}
+		if checksum := adler32.Checksum(data[:VOLUME_SIZE-4]); checksum != volume.Checksum {
+			return nil, &ChecksumError{What: "volume section", Stored: volume.Checksum, Computed: checksum}
+		}
+	case len(data) >= SMART_VOLUME_SIZE:
+		volume.MediaType = data[0]
+		volume.ChunkCount = binary.LittleEndian.Uint32(data[4:])
+		volume.SectorsPerChunk = binary.LittleEndian.Uint32(data[8:])
+		volume.BytesPerSector = binary.LittleEndian.Uint32(data[12:])
+		volume.SectorCount = uint64(binary.LittleEndian.Uint32(data[16:]))
+	default:
+		return nil, fmt.Errorf("ewf volume section is truncated: %d bytes", len(data))
+	}
+
+	if volume.SectorsPerChunk == 0 || volume.BytesPerSector == 0 {
+		return nil, fmt.Errorf("invalid ewf chunk geometry: %d sectors of %d bytes", volume.SectorsPerChunk, volume.BytesPerSector)
+	}
+	return volume, nil
+}
+
+// parseTable returns the absolute chunk offsets of a table section and
+// whether each chunk is compressed.
+func parseTable(data []byte) ([]int64, []bool, error) {
+	header := &tableHeader{}
+	if len(data) < TABLE_HEADER_SIZE {
+		return nil, nil, fmt.Errorf("ewf table section is truncated: %d bytes", len(data))
+	}
+	if _, err := binary.Decode(data, binary.LittleEndian, header); err != nil {
+		return nil, nil, err
+	}
+	if checksum := adler32.Checksum(data[:TABLE_HEADER_SIZE-4]); checksum != header.Checksum {
+		return nil, nil, &ChecksumError{What: "table header", Stored: header.Checksum, Computed: checksum}
+	}
+
+	entries := data[TABLE_HEADER_SIZE:]
+	if uint64(len(entries)) < uint64(header.EntryCount)*4 {
+		return nil, nil, fmt.Errorf("ewf table has %d entries but room for %d", header.EntryCount, len(entries)/4)
+	}
+	// EnCase 6 and later follow the entries with their checksum
+	if end := int(header.EntryCount) * 4; len(entries) >= end+4 {
+		stored := binary.LittleEndian.Uint32(entries[end:])
+		if checksum := adler32.Checksum(entries[:end]); checksum != stored {
+			return nil, nil, &ChecksumError{What: "table entries", Stored: stored, Computed: checksum}
+		}
+	}
+
+	offsets := make([]int64, header.EntryCount)
+	compressed := make([]bool, header.EntryCount)
+	for i := range offsets {
+		entry := binary.LittleEndian.Uint32(entries[i*4:])
+		offsets[i] = int64(header.BaseOffset) + int64(entry&TABLE_OFFSET_MASK)
+		compressed[i] = entry&TABLE_COMPRESSED != 0
+	}
+	return offsets, compressed, nil
+}
+
+// parseHeader decodes a header or header2 section: zlib compressed text,
+// UTF-16 in header2, with a line of tab separated keys followed by a line
+// of values.
+func parseHeader(data []byte, utf16le bool) (map[string]string, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	text := string(raw)
+	if utf16le {
+		raw = bytes.TrimPrefix(raw, []byte{0xff, 0xfe})
+		u16s := make([]uint16, len(raw)/2)
+		for i := range u16s {
+			u16s[i] = binary.LittleEndian.Uint16(raw[i*2:])
+		}
+		text = string(utf16.Decode(u16s))
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	header := map[string]string{}
+	for i := 0; i+1 < len(lines); i++ {
+		if lines[i] != "main" || i+2 >= len(lines) {
+			continue
+		}
+		keys := strings.Split(lines[i+1], "\t")
+		values := strings.Split(lines[i+2], "\t")
+		for j, key := range keys {
+			if j < len(values) {
+				header[key] = values[j]
+			}
+		}
+		break
+	}
+	return header, nil
+}
@@ -5,6 +5,8 @@ go 1.24.0
 require (
 	github.com/diskfs/go-diskfs v1.7.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.17.4
+	github.com/ulikunitz/xz v0.5.11
 	www.velocidex.com/golang/go-ntfs v0.2.0
 )
 
@@ -13,10 +15,8 @@ require (
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
 	github.com/djherbis/times v1.6.0 // indirect
 	github.com/elliotwutingfeng/asciiset v0.0.0-20230602022725-51bbb787efab // indirect
-	github.com/klauspost/compress v1.17.4 // indirect
 	github.com/pierrec/lz4/v4 v4.1.17 // indirect
 	github.com/pkg/xattr v0.4.9 // indirect
 	github.com/sirupsen/logrus v1.9.4-0.20230606125235-dd1b4c2e81af // indirect
-	github.com/ulikunitz/xz v0.5.11 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 )
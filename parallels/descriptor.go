@@ -0,0 +1,141 @@
+package parallels
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// DiskDescriptor is the DiskDescriptor.xml of an .hdd bundle. The disk is
+// split into storages covering sector ranges, each holding one image per
+// snapshot.
+type DiskDescriptor struct {
+	XMLName    xml.Name       `xml:"Parallels_disk_image"`
+	Version    string         `xml:"Version,attr"`
+	Parameters DiskParameters `xml:"Disk_Parameters"`
+	Storages   []Storage      `xml:"StorageData>Storage"`
+	TopGUID    string         `xml:"Snapshots>TopGUID"`
+	Snapshots  []Snapshot     `xml:"Snapshots>Shot"`
+}
+
+type DiskParameters struct {
+	// DiskSize is in sectors.
+	DiskSize           int64  `xml:"Disk_size"`
+	Cylinders          uint32 `xml:"Cylinders"`
+	Heads              uint32 `xml:"Heads"`
+	Sectors            uint32 `xml:"Sectors"`
+	PhysicalSectorSize uint32 `xml:"PhysicalSectorSize"`
+	Padding            uint32 `xml:"Padding"`
+	UID                string `xml:"UID"`
+	Name               string `xml:"Name"`
+}
+
+// Storage covers the sectors from Start up to End.
+type Storage struct {
+	Start     int64          `xml:"Start"`
+	End       int64          `xml:"End"`
+	Blocksize int64          `xml:"Blocksize"`
+	Images    []StorageImage `xml:"Image"`
+}
+
+type StorageImage struct {
+	GUID string `xml:"GUID"`
+	Type string `xml:"Type"`
+	File string `xml:"File"`
+}
+
+type Snapshot struct {
+	GUID       string `xml:"GUID"`
+	ParentGUID string `xml:"ParentGUID"`
+}
+
+func ParseDiskDescriptor(data []byte) (*DiskDescriptor, error) {
+	d := &DiskDescriptor{}
+	if err := xml.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	if len(d.Storages) == 0 {
+		return nil, fmt.Errorf("parallels disk descriptor has no storage")
+	}
+	for i, storage := range d.Storages {
+		if storage.End <= storage.Start {
+			return nil, fmt.Errorf("invalid parallels storage range: %d-%d", storage.Start, storage.End)
+		}
+		if i > 0 && storage.Start != d.Storages[i-1].End {
+			return nil, fmt.Errorf("parallels storage %d does not start where the previous ends", i)
+		}
+		if len(storage.Images) == 0 {
+			return nil, fmt.Errorf("parallels storage %d has no image", i)
+		}
+	}
+	return d, nil
+}
+
+// TopSnapshot returns the GUID of the current state: TopGUID when set,
+// otherwise the snapshot no other snapshot descends from.
+func (d *DiskDescriptor) TopSnapshot() string {
+	if d.TopGUID != "" {
+		return d.TopGUID
+	}
+	for _, snapshot := range d.Snapshots {
+		leaf := true
+		for _, child := range d.Snapshots {
+			if sameGUID(child.ParentGUID, snapshot.GUID) {
+				leaf = false
+				break
+			}
+		}
+		if leaf {
+			return snapshot.GUID
+		}
+	}
+	return d.Storages[0].Images[0].GUID
+}
+
+// SnapshotChain returns the GUIDs from guid down to the base snapshot.
+func (d *DiskDescriptor) SnapshotChain(guid string) ([]string, error) {
+	if len(d.Snapshots) == 0 {
+		return []string{guid}, nil
+	}
+
+	var chain []string
+	for !isZeroGUID(guid) {
+		if len(chain) > len(d.Snapshots) {
+			return nil, fmt.Errorf("parallels snapshot chain of %s is cyclic", chain[0])
+		}
+		snapshot, ok := d.snapshot(guid)
+		if !ok {
+			return nil, fmt.Errorf("parallels snapshot %s not found", guid)
+		}
+		chain = append(chain, snapshot.GUID)
+		guid = snapshot.ParentGUID
+	}
+	return chain, nil
+}
+
+func (d *DiskDescriptor) snapshot(guid string) (Snapshot, bool) {
+	for _, snapshot := range d.Snapshots {
+		if sameGUID(snapshot.GUID, guid) {
+			return snapshot, true
+		}
+	}
+	return Snapshot{}, false
+}
+
+// image returns the image of a storage belonging to the snapshot guid.
+func (s *Storage) image(guid string) (StorageImage, bool) {
+	for _, image := range s.Images {
+		if sameGUID(image.GUID, guid) {
+			return image, true
+		}
+	}
+	return StorageImage{}, false
+}
+
+func sameGUID(a, b string) bool {
+	return strings.EqualFold(strings.Trim(a, "{} "), strings.Trim(b, "{} "))
+}
+
+func isZeroGUID(guid string) bool {
+	return strings.Trim(guid, "{}-0 ") == ""
+}
@@ -0,0 +1,134 @@
+package parallels
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type HDSHeader struct {
+	Magic      [16]byte
+	Version    uint32
+	Heads      uint32
+	Cylinders  uint32
+	Tracks     uint32
+	BATEntries uint32
+	NbSectors  uint64
+	InUse      uint32
+	DataOff    uint32
+	Flags      uint32
+	ExtOff     uint64
+}
+
+// HDS is a sparse image, the "Compressed" image type of a bundle. Clusters
+// missing from the BAT read from the parent when there is one.
+type HDS struct {
+	fh     io.ReadSeeker
+	header HDSHeader
+	bat    []uint32
+	parent image
+
+	size        int64
+	clusterSize int64
+	// offsetUnit converts BAT entries to byte offsets, sectors for the old
+	// format and clusters for the extended one
+	offsetUnit int64
+}
+
+func NewHDS(fh io.ReadSeeker) (*HDS, error) {
+	return newHDS(fh, nil)
+}
+
+func newHDS(fh io.ReadSeeker, parent image) (*HDS, error) {
+	h := &HDS{fh: fh, parent: parent}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(fh, binary.LittleEndian, &h.header); err != nil {
+		return nil, err
+	}
+	header := &h.header
+
+	switch string(header.Magic[:]) {
+	case HDS_MAGIC:
+		h.offsetUnit = SECTOR_SIZE
+		header.NbSectors &= 0xffffffff
+	case HDS_MAGIC_EXT:
+		h.offsetUnit = int64(header.Tracks) * SECTOR_SIZE
+	default:
+		return nil, errors.New("invalid parallels image magic")
+	}
+	if header.Version != HDS_VERSION {
+		return nil, fmt.Errorf("unsupported parallels image version: %d", header.Version)
+	}
+	if header.Tracks == 0 {
+		return nil, errors.New("invalid parallels cluster size: 0")
+	}
+	h.clusterSize = int64(header.Tracks) * SECTOR_SIZE
+	h.size = int64(header.NbSectors) * SECTOR_SIZE
+	if int64(header.BATEntries)*h.clusterSize < h.size {
+		return nil, fmt.Errorf("parallels BAT has %d entries, too few for the disk size", header.BATEntries)
+	}
+
+	h.bat = make([]uint32, header.BATEntries)
+	if err := binary.Read(fh, binary.LittleEndian, h.bat); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *HDS) Header() HDSHeader {
+	return h.header
+}
+
+func (h *HDS) Size() int64 {
+	return h.size
+}
+
+func (h *HDS) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= h.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), h.size-offset)
+	for read := int64(0); read < length; {
+		pos := offset + read
+		count := min(length-read, h.clusterSize-pos%h.clusterSize)
+		if err := h.readCluster(p[read:read+count], pos); err != nil {
+			return int(read), err
+		}
+		read += count
+	}
+
+	if length < int64(len(p)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// readCluster fills buf, which lies within one cluster, with the data at pos.
+func (h *HDS) readCluster(buf []byte, pos int64) error {
+	entry := h.bat[pos/h.clusterSize]
+	if entry == 0 {
+		if h.parent == nil || pos >= h.parent.Size() {
+			clear(buf)
+			return nil
+		}
+		n, err := h.parent.ReadAt(buf, pos)
+		if err == io.EOF {
+			clear(buf[n:])
+			err = nil
+		}
+		return err
+	}
+
+	if _, err := h.fh.Seek(int64(entry)*h.offsetUnit+pos%h.clusterSize, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(h.fh, buf)
+	return err
+}
@@ -0,0 +1,186 @@
+package parallels
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	HDS_MAGIC     = "WithoutFreeSpace"
+	HDS_MAGIC_EXT = "WithouFreSpacExt"
+	HDS_VERSION   = 2
+
+	IMAGE_TYPE_COMPRESSED = "Compressed"
+	IMAGE_TYPE_PLAIN      = "Plain"
+
+	SECTOR_SIZE = 512
+)
+
+type FileAccessorFn func(string) (io.ReadSeeker, error)
+
+// FileAccessor opens the files of a bundle by their name in
+// DiskDescriptor.xml.
+var FileAccessor FileAccessorFn
+
+var ErrFileAccessorNotAvailable = errors.New("file accessor needed to access image files")
+
+type image interface {
+	ReadAt(p []byte, offset int64) (int, error)
+	Size() int64
+}
+
+// Parallels is an .hdd bundle opened at one snapshot.
+type Parallels struct {
+	Descriptor *DiskDescriptor
+	snapshot   string
+	// storages holds the top image of every storage, in sector order
+	storages []image
+	size     int64
+}
+
+// NewParallels opens the bundle described by the DiskDescriptor.xml in fh at
+// its current state.
+func NewParallels(fh io.ReadSeeker) (*Parallels, error) {
+	if FileAccessor == nil {
+		return nil, ErrFileAccessorNotAvailable
+	}
+
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := ParseDiskDescriptor(data)
+	if err != nil {
+		return nil, err
+	}
+	return openSnapshot(descriptor, descriptor.TopSnapshot())
+}
+
+// OpenSnapshot opens the same bundle at the snapshot guid.
+func (p *Parallels) OpenSnapshot(guid string) (*Parallels, error) {
+	return openSnapshot(p.Descriptor, guid)
+}
+
+func openSnapshot(descriptor *DiskDescriptor, guid string) (*Parallels, error) {
+	chain, err := descriptor.SnapshotChain(guid)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Parallels{Descriptor: descriptor, snapshot: guid}
+	for i := range descriptor.Storages {
+		storage := &descriptor.Storages[i]
+		// open from the base up so every image gets its parent
+		var top image
+		for j := len(chain) - 1; j >= 0; j-- {
+			storageImage, ok := storage.image(chain[j])
+			if !ok {
+				return nil, fmt.Errorf("parallels storage %d has no image for snapshot %s", i, chain[j])
+			}
+			top, err = openImage(storageImage, top)
+			if err != nil {
+				return nil, fmt.Errorf("opening %s: %w", storageImage.File, err)
+			}
+		}
+		p.storages = append(p.storages, top)
+	}
+
+	p.size = descriptor.Storages[len(descriptor.Storages)-1].End * SECTOR_SIZE
+	if descriptor.Parameters.DiskSize > 0 {
+		p.size = min(p.size, descriptor.Parameters.DiskSize*SECTOR_SIZE)
+	}
+	return p, nil
+}
+
+func openImage(storageImage StorageImage, parent image) (image, error) {
+	fh, err := FileAccessor(strings.ReplaceAll(storageImage.File, "\\", "/"))
+	if err != nil {
+		return nil, err
+	}
+	switch storageImage.Type {
+	case IMAGE_TYPE_COMPRESSED:
+		return newHDS(fh, parent)
+	case IMAGE_TYPE_PLAIN:
+		return newRawImage(fh)
+	default:
+		return nil, fmt.Errorf("unsupported parallels image type: %s", storageImage.Type)
+	}
+}
+
+// Snapshot returns the GUID of the opened snapshot.
+func (p *Parallels) Snapshot() string {
+	return p.snapshot
+}
+
+func (p *Parallels) Size() int64 {
+	return p.size
+}
+
+func (p *Parallels) ReadAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= p.size {
+		return 0, io.EOF
+	}
+
+	storages := p.Descriptor.Storages
+	length := min(int64(len(b)), p.size-offset)
+	for read := int64(0); read < length; {
+		pos := offset + read
+		index := sort.Search(len(storages), func(i int) bool {
+			return storages[i].End*SECTOR_SIZE > pos
+		})
+		start := storages[index].Start * SECTOR_SIZE
+		count := min(length-read, storages[index].End*SECTOR_SIZE-pos)
+
+		buf := b[read : read+count]
+		n, err := p.storages[index].ReadAt(buf, pos-start)
+		if err == io.EOF {
+			clear(buf[n:])
+		} else if err != nil {
+			return int(read), err
+		}
+		read += count
+	}
+
+	if length < int64(len(b)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// rawImage is a "Plain" image, stored as is.
+type rawImage struct {
+	fh   io.ReadSeeker
+	size int64
+}
+
+func newRawImage(fh io.ReadSeeker) (*rawImage, error) {
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &rawImage{fh: fh, size: size}, nil
+}
+
+func (r *rawImage) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= r.size {
+		return 0, io.EOF
+	}
+	if _, err := r.fh.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.fh, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *rawImage) Size() int64 {
+	return r.size
+}
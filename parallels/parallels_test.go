@@ -0,0 +1,264 @@
+package parallels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testTracks      = 8
+	testClusterSize = testTracks * SECTOR_SIZE
+)
+
+// testDescriptor describes two storages with a base snapshot A, its child B
+// (the current state) and a second child C. The base image of the second
+// storage is plain.
+const testDescriptor = `<?xml version='1.0' encoding='UTF-8'?>
+<Parallels_disk_image Version="1.0">
+    <Disk_Parameters>
+        <Disk_size>96</Disk_size>
+        <Cylinders>1</Cylinders>
+        <Heads>16</Heads>
+        <Sectors>32</Sectors>
+        <PhysicalSectorSize>512</PhysicalSectorSize>
+        <Padding>0</Padding>
+        <UID>{9a8d7b5e-0000-4000-8000-000000000001}</UID>
+        <Name>test</Name>
+    </Disk_Parameters>
+    <StorageData>
+        <Storage>
+            <Start>0</Start>
+            <End>64</End>
+            <Blocksize>8</Blocksize>
+            <Image>
+                <GUID>{5FBAABE3-6958-40FF-92A7-860E329AAB41}</GUID>
+                <Type>Compressed</Type>
+                <File>test.hdd.0.{5fbaabe3-6958-40ff-92a7-860e329aab41}.hds</File>
+            </Image>
+            <Image>
+                <GUID>{b0000000-0000-4000-8000-00000000000b}</GUID>
+                <Type>Compressed</Type>
+                <File>test.hdd.0.{b0000000-0000-4000-8000-00000000000b}.hds</File>
+            </Image>
+            <Image>
+                <GUID>{c0000000-0000-4000-8000-00000000000c}</GUID>
+                <Type>Compressed</Type>
+                <File>test.hdd.0.{c0000000-0000-4000-8000-00000000000c}.hds</File>
+            </Image>
+        </Storage>
+        <Storage>
+            <Start>64</Start>
+            <End>96</End>
+            <Blocksize>8</Blocksize>
+            <Image>
+                <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+                <Type>Plain</Type>
+                <File>test.hdd.1.{5fbaabe3-6958-40ff-92a7-860e329aab41}.hdd</File>
+            </Image>
+            <Image>
+                <GUID>{b0000000-0000-4000-8000-00000000000b}</GUID>
+                <Type>Compressed</Type>
+                <File>test.hdd.1.{b0000000-0000-4000-8000-00000000000b}.hds</File>
+            </Image>
+            <Image>
+                <GUID>{c0000000-0000-4000-8000-00000000000c}</GUID>
+                <Type>Compressed</Type>
+                <File>test.hdd.1.{c0000000-0000-4000-8000-00000000000c}.hds</File>
+            </Image>
+        </Storage>
+    </StorageData>
+    <Snapshots>
+        <TopGUID>{b0000000-0000-4000-8000-00000000000b}</TopGUID>
+        <Shot>
+            <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+            <ParentGUID>{00000000-0000-0000-0000-000000000000}</ParentGUID>
+        </Shot>
+        <Shot>
+            <GUID>{b0000000-0000-4000-8000-00000000000b}</GUID>
+            <ParentGUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</ParentGUID>
+        </Shot>
+        <Shot>
+            <GUID>{c0000000-0000-4000-8000-00000000000c}</GUID>
+            <ParentGUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</ParentGUID>
+        </Shot>
+    </Snapshots>
+</Parallels_disk_image>
+`
+
+const (
+	testGUIDA = "{5fbaabe3-6958-40ff-92a7-860e329aab41}"
+	testGUIDB = "{b0000000-0000-4000-8000-00000000000b}"
+	testGUIDC = "{c0000000-0000-4000-8000-00000000000c}"
+)
+
+// newTestHDS builds a sparse image of the given clusters, storing the
+// allocated ones in reverse order after the BAT. BAT entries are sectors for
+// the old magic and clusters for the extended one.
+func newTestHDS(magic string, clusters int, allocated map[int]byte) []byte {
+	header := HDSHeader{
+		Version:    HDS_VERSION,
+		Heads:      16,
+		Cylinders:  1,
+		Tracks:     testTracks,
+		BATEntries: uint32(clusters),
+		NbSectors:  uint64(clusters) * testTracks,
+		DataOff:    testTracks,
+	}
+	copy(header.Magic[:], magic)
+	unit := int64(SECTOR_SIZE)
+	if magic == HDS_MAGIC_EXT {
+		unit = testClusterSize
+	}
+
+	bat := make([]uint32, clusters)
+	var data bytes.Buffer
+	for cluster := clusters - 1; cluster >= 0; cluster-- {
+		if b, ok := allocated[cluster]; ok {
+			bat[cluster] = uint32((testClusterSize + int64(data.Len())) / unit)
+			data.Write(bytes.Repeat([]byte{b}, testClusterSize))
+		}
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &header)
+	binary.Write(&buf, binary.LittleEndian, bat)
+	buf.Write(make([]byte, testClusterSize-buf.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+// testClusters returns the contents of clusters filled with the given bytes.
+func testClusters(fill ...byte) []byte {
+	var data []byte
+	for _, b := range fill {
+		data = append(data, bytes.Repeat([]byte{b}, testClusterSize)...)
+	}
+	return data
+}
+
+func TestParseDiskDescriptor(t *testing.T) {
+	d, err := ParseDiskDescriptor([]byte(testDescriptor))
+	if err != nil {
+		t.Fatalf("ParseDiskDescriptor() error = %v", err)
+	}
+	if d.Version != "1.0" || d.Parameters.DiskSize != 96 || d.Parameters.Heads != 16 || d.Parameters.Name != "test" {
+		t.Fatalf("ParseDiskDescriptor() = %+v", d)
+	}
+	if len(d.Storages) != 2 || d.Storages[1].Start != 64 || d.Storages[1].End != 96 || d.Storages[1].Blocksize != 8 {
+		t.Fatalf("Storages = %+v", d.Storages)
+	}
+	if image := d.Storages[1].Images[0]; image.Type != IMAGE_TYPE_PLAIN || image.File != "test.hdd.1."+testGUIDA+".hdd" {
+		t.Fatalf("Storages[1].Images[0] = %+v", image)
+	}
+	if len(d.Snapshots) != 3 || d.Snapshots[2].ParentGUID != testGUIDA {
+		t.Fatalf("Snapshots = %+v", d.Snapshots)
+	}
+
+	if got := d.TopSnapshot(); got != testGUIDB {
+		t.Fatalf("TopSnapshot() = %s, want %s", got, testGUIDB)
+	}
+	chain, err := d.SnapshotChain(testGUIDC)
+	if err != nil {
+		t.Fatalf("SnapshotChain() error = %v", err)
+	}
+	if want := []string{testGUIDC, testGUIDA}; !reflect.DeepEqual(chain, want) {
+		t.Fatalf("SnapshotChain() = %v, want %v", chain, want)
+	}
+	if _, err := d.SnapshotChain("{d0000000-0000-4000-8000-00000000000d}"); err == nil {
+		t.Fatal("SnapshotChain() resolved an unknown snapshot")
+	}
+
+	gap := strings.Replace(testDescriptor, "<Start>64</Start>", "<Start>72</Start>", 1)
+	if _, err := ParseDiskDescriptor([]byte(gap)); err == nil {
+		t.Fatal("ParseDiskDescriptor() accepted storages with a gap")
+	}
+}
+
+func TestHDS(t *testing.T) {
+	for _, magic := range []string{HDS_MAGIC, HDS_MAGIC_EXT} {
+		t.Run(magic, func(t *testing.T) {
+			h, err := NewHDS(bytes.NewReader(newTestHDS(magic, 4, map[int]byte{0: 0x10, 2: 0x12})))
+			if err != nil {
+				t.Fatalf("NewHDS() error = %v", err)
+			}
+			if h.Size() != 4*testClusterSize || h.Header().BATEntries != 4 {
+				t.Fatalf("Size() = %d, BATEntries = %d", h.Size(), h.Header().BATEntries)
+			}
+			got := make([]byte, h.Size())
+			if _, err := h.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() error = %v", err)
+			}
+			if !bytes.Equal(got, testClusters(0x10, 0x00, 0x12, 0x00)) {
+				t.Fatal("ReadAt() data does not match")
+			}
+		})
+	}
+
+	if _, err := NewHDS(bytes.NewReader(make([]byte, testClusterSize))); err == nil {
+		t.Fatal("NewHDS() accepted an image without magic")
+	}
+}
+
+func TestParallelsSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(dir, s))
+	}
+	t.Cleanup(func() { FileAccessor = nil })
+
+	files := map[string][]byte{
+		"test.hdd.0." + testGUIDA + ".hds": newTestHDS(HDS_MAGIC, 8, map[int]byte{0: 0x10, 1: 0x11, 2: 0x12}),
+		"test.hdd.0." + testGUIDB + ".hds": newTestHDS(HDS_MAGIC_EXT, 8, map[int]byte{1: 0xb1}),
+		"test.hdd.0." + testGUIDC + ".hds": newTestHDS(HDS_MAGIC_EXT, 8, map[int]byte{2: 0xc2}),
+		// the plain base image ends before its storage
+		"test.hdd.1." + testGUIDA + ".hdd": testClusters(0x20, 0x20, 0x20),
+		"test.hdd.1." + testGUIDB + ".hds": newTestHDS(HDS_MAGIC_EXT, 4, map[int]byte{3: 0xb3}),
+		"test.hdd.1." + testGUIDC + ".hds": newTestHDS(HDS_MAGIC_EXT, 4, nil),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := NewParallels(strings.NewReader(testDescriptor))
+	if err != nil {
+		t.Fatalf("NewParallels() error = %v", err)
+	}
+	tests := []struct {
+		guid string
+		want []byte
+	}{
+		{testGUIDB, testClusters(0x10, 0xb1, 0x12, 0, 0, 0, 0, 0, 0x20, 0x20, 0x20, 0xb3)},
+		{testGUIDA, testClusters(0x10, 0x11, 0x12, 0, 0, 0, 0, 0, 0x20, 0x20, 0x20, 0)},
+		{testGUIDC, testClusters(0x10, 0x11, 0xc2, 0, 0, 0, 0, 0, 0x20, 0x20, 0x20, 0)},
+	}
+	for _, tt := range tests {
+		snapshot := p
+		if tt.guid != p.Snapshot() {
+			if snapshot, err = p.OpenSnapshot(tt.guid); err != nil {
+				t.Fatalf("OpenSnapshot(%s) error = %v", tt.guid, err)
+			}
+		}
+		if snapshot.Size() != 96*SECTOR_SIZE {
+			t.Fatalf("Size() = %d", snapshot.Size())
+		}
+		got := make([]byte, snapshot.Size())
+		if _, err := snapshot.ReadAt(got, 0); err != nil {
+			t.Fatalf("ReadAt() error = %v", err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Fatalf("snapshot %s data does not match", tt.guid)
+		}
+	}
+
+	if _, err := p.OpenSnapshot("{d0000000-0000-4000-8000-00000000000d}"); err == nil {
+		t.Fatal("OpenSnapshot() opened an unknown snapshot")
+	}
+}
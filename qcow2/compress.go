@@ -0,0 +1,68 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedDescriptor splits the L2 entry of a compressed cluster into the
+// host offset and the length of the compressed data.
+func (q *QCOW2) compressedDescriptor(l2Entry uint64) (int64, int64) {
+	x := 62 - (q.header.ClusterBits - 8)
+	offset := int64(l2Entry & (1<<x - 1))
+	sectors := int64((l2Entry&(1<<62-1))>>x) + 1
+	return offset, sectors*512 - offset%512
+}
+
+func (q *QCOW2) readCompressedCluster(l2Entry uint64) ([]byte, error) {
+	if q.clusterCache != nil && q.clusterCacheEntry == l2Entry {
+		return q.clusterCache, nil
+	}
+
+	offset, length := q.compressedDescriptor(l2Entry)
+	if _, err := q.fh.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// the last compressed cluster may end before the sector count says
+	compressed := make([]byte, length)
+	n, err := io.ReadFull(q.fh, compressed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	cluster, err := decompressCluster(q.header.CompressionType, compressed[:n], q.clusterSize)
+	if err != nil {
+		return nil, fmt.Errorf("compressed cluster at 0x%x: %w", offset, err)
+	}
+	q.clusterCache, q.clusterCacheEntry = cluster, l2Entry
+	return cluster, nil
+}
+
+func decompressCluster(compressionType uint8, compressed []byte, clusterSize int64) ([]byte, error) {
+	cluster := make([]byte, clusterSize)
+	switch compressionType {
+	case COMPRESSION_TYPE_ZLIB:
+		// qcow2 stores raw deflate streams without zlib header
+		r := flate.NewReader(bytes.NewReader(compressed))
+		defer r.Close()
+		if _, err := io.ReadFull(r, cluster); err != nil {
+			return nil, err
+		}
+	case COMPRESSION_TYPE_ZSTD:
+		d, err := zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		if _, err := io.ReadFull(d, cluster); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 compression type: %d", compressionType)
+	}
+	return cluster, nil
+}
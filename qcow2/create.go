@@ -0,0 +1,373 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	DEFAULT_CLUSTER_SIZE   = 65536
+	DEFAULT_REFCOUNT_ORDER = 4
+	DEFLATE_WINDOW_SIZE    = 4096
+)
+
+type CreateOptions struct {
+	// ClusterSize is a power of two between 512 bytes and 2 MiB, defaults to
+	// 64 KiB.
+	ClusterSize int64
+	// Compress stores clusters compressed with CompressionType when that
+	// saves space. zlib matches reach back at most 4 KiB, the window qemu
+	// inflates with.
+	Compress        bool
+	CompressionType uint8
+	// BackingFile makes the image an overlay; clusters that are all zeros in
+	// src are then stored as zero clusters so they hide the backing data.
+	BackingFile   string
+	BackingFormat string
+}
+
+// imageWriter appends clusters to a new image and keeps the reference
+// counts of the host clusters it wrote.
+type imageWriter struct {
+	w           io.WriteSeeker
+	clusterSize int64
+	next        int64
+	refcounts   []uint64
+}
+
+// Create writes a version 3 qcow2 image of size bytes holding the contents
+// of src. Clusters that are all zeros are not allocated. src may be nil to
+// create an empty image, typically an overlay on BackingFile.
+func Create(w io.WriteSeeker, src io.ReaderAt, size int64, opts *CreateOptions) error {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	clusterSize := opts.ClusterSize
+	if clusterSize == 0 {
+		clusterSize = DEFAULT_CLUSTER_SIZE
+	}
+	clusterBits := uint32(0)
+	for int64(1)<<clusterBits < clusterSize {
+		clusterBits++
+	}
+	if int64(1)<<clusterBits != clusterSize || clusterBits < MIN_CLUSTER_BITS || clusterBits > MAX_CLUSTER_BITS {
+		return fmt.Errorf("invalid qcow2 cluster size: %d", clusterSize)
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid qcow2 size: %d", size)
+	}
+	switch opts.CompressionType {
+	case COMPRESSION_TYPE_ZLIB, COMPRESSION_TYPE_ZSTD:
+	default:
+		return fmt.Errorf("unsupported qcow2 compression type: %d", opts.CompressionType)
+	}
+
+	iw := &imageWriter{w: w, clusterSize: clusterSize}
+	l2Entries := clusterSize / 8
+	l1Size := (size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries)
+	l1Clusters := max((l1Size*8+clusterSize-1)/clusterSize, 1)
+
+	// cluster 0 holds the header, the L1 table follows
+	iw.reserve(1 + l1Clusters)
+	l1Table := make([]uint64, l1Size)
+
+	var encoder *zstd.Encoder
+	if opts.Compress && opts.CompressionType == COMPRESSION_TYPE_ZSTD {
+		var err error
+		encoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer encoder.Close()
+	}
+
+	clusterCount := (size + clusterSize - 1) / clusterSize
+	buf := make([]byte, clusterSize)
+	zero := make([]byte, clusterSize)
+	l2Table := make([]uint64, l2Entries)
+	l2Used := false
+
+	for cluster := int64(0); cluster < clusterCount && src != nil; cluster++ {
+		// the last cluster is read up to size and zero filled
+		offset := cluster * clusterSize
+		length := min(clusterSize, size-offset)
+		clear(buf[length:])
+		if n, err := src.ReadAt(buf[:length], offset); int64(n) < length {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("reading qcow2 source at %d: %w", offset+int64(n), err)
+		}
+
+		l2Index := cluster % l2Entries
+		switch {
+		case bytes.Equal(buf, zero):
+			if opts.BackingFile != "" {
+				l2Table[l2Index] = OFLAG_ZERO
+				l2Used = true
+			}
+		default:
+			entry, err := iw.writeCluster(buf, opts, clusterBits, encoder)
+			if err != nil {
+				return err
+			}
+			l2Table[l2Index] = entry
+			l2Used = true
+		}
+
+		if l2Index == l2Entries-1 || cluster == clusterCount-1 {
+			if l2Used {
+				offset, err := iw.writeClusters(uint64Bytes(l2Table))
+				if err != nil {
+					return err
+				}
+				l1Table[cluster/l2Entries] = uint64(offset) | OFLAG_COPIED
+			}
+			clear(l2Table)
+			l2Used = false
+		}
+	}
+
+	refcountTableOffset, refcountTableClusters, err := iw.writeRefcounts()
+	if err != nil {
+		return err
+	}
+	if err := iw.writeAt(clusterSize, uint64Bytes(l1Table)); err != nil {
+		return err
+	}
+
+	header := Header{
+		Version:               3,
+		ClusterBits:           clusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         uint64(clusterSize),
+		RefcountTableOffset:   uint64(refcountTableOffset),
+		RefcountTableClusters: uint32(refcountTableClusters),
+		RefcountOrder:         DEFAULT_REFCOUNT_ORDER,
+		HeaderLength:          uint32(binary.Size(Header{})),
+		CompressionType:       opts.CompressionType,
+	}
+	copy(header.Magic[:], QCOW2_MAGIC)
+	if opts.CompressionType != COMPRESSION_TYPE_ZLIB {
+		header.IncompatibleFeatures |= INCOMPAT_COMPRESSION
+	}
+	return iw.writeHeader(&header, opts)
+}
+
+// writeCluster stores one cluster of guest data, compressed when enabled and
+// smaller, and returns its L2 entry.
+func (iw *imageWriter) writeCluster(data []byte, opts *CreateOptions, clusterBits uint32, encoder *zstd.Encoder) (uint64, error) {
+	if opts.Compress {
+		compressed, err := compressCluster(data, opts.CompressionType, encoder)
+		if err != nil {
+			return 0, err
+		}
+		// the sector count field limits compressed data to the cluster size
+		if int64(len(compressed)) < iw.clusterSize-512 {
+			offset, err := iw.writeCompressed(compressed)
+			if err != nil {
+				return 0, err
+			}
+			x := 62 - (clusterBits - 8)
+			sectors := uint64((offset+int64(len(compressed))-1)/512 - offset/512)
+			return OFLAG_COMPRESSED | sectors<<x | uint64(offset), nil
+		}
+	}
+
+	offset, err := iw.writeClusters(data)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(offset) | OFLAG_COPIED, nil
+}
+
+func compressCluster(data []byte, compressionType uint8, encoder *zstd.Encoder) ([]byte, error) {
+	if compressionType == COMPRESSION_TYPE_ZSTD {
+		return encoder.EncodeAll(data, nil), nil
+	}
+
+	// qemu inflates with a 4 KiB window while Go's deflate may reference
+	// 32 KiB back. Every 4 KiB piece starts a fresh compressor after a flush
+	// to a byte boundary, so no match reaches into an earlier piece.
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(data); start += DEFLATE_WINDOW_SIZE {
+		end := min(start+DEFLATE_WINDOW_SIZE, len(data))
+		if _, err := fw.Write(data[start:end]); err != nil {
+			return nil, err
+		}
+		if end == len(data) {
+			break
+		}
+		if err := fw.Flush(); err != nil {
+			return nil, err
+		}
+		fw.Reset(&buf)
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reserve allocates clusters at the current position without writing them.
+func (iw *imageWriter) reserve(clusters int64) int64 {
+	iw.align()
+	offset := iw.next
+	iw.next += clusters * iw.clusterSize
+	iw.addRefs(offset, iw.next)
+	return offset
+}
+
+// writeClusters appends data, padded to whole clusters, at a cluster
+// boundary.
+func (iw *imageWriter) writeClusters(data []byte) (int64, error) {
+	iw.align()
+	offset := iw.next
+	clusters := (int64(len(data)) + iw.clusterSize - 1) / iw.clusterSize
+	padded := make([]byte, clusters*iw.clusterSize)
+	copy(padded, data)
+	if err := iw.writeAt(offset, padded); err != nil {
+		return 0, err
+	}
+	iw.next += int64(len(padded))
+	iw.addRefs(offset, iw.next)
+	return offset, nil
+}
+
+// writeCompressed appends compressed data at the next sector; several
+// compressed clusters can share a host cluster.
+func (iw *imageWriter) writeCompressed(data []byte) (int64, error) {
+	offset := (iw.next + 511) &^ 511
+	if err := iw.writeAt(offset, data); err != nil {
+		return 0, err
+	}
+	iw.next = offset + int64(len(data))
+	iw.addRefs(offset, iw.next)
+	return offset, nil
+}
+
+func (iw *imageWriter) writeAt(offset int64, data []byte) error {
+	if _, err := iw.w.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := iw.w.Write(data)
+	return err
+}
+
+// align moves to the next cluster boundary, filling the gap left by
+// compressed data so the file has no hole before the following cluster.
+func (iw *imageWriter) align() {
+	iw.next = (iw.next + iw.clusterSize - 1) / iw.clusterSize * iw.clusterSize
+}
+
+// addRefs counts one reference for every host cluster in [start, end).
+func (iw *imageWriter) addRefs(start, end int64) {
+	for cluster := start / iw.clusterSize; cluster*iw.clusterSize < end; cluster++ {
+		for int64(len(iw.refcounts)) <= cluster {
+			iw.refcounts = append(iw.refcounts, 0)
+		}
+		iw.refcounts[cluster]++
+	}
+}
+
+// writeRefcounts appends the refcount table and blocks, which also count
+// themselves, and returns the table offset and size in clusters.
+func (iw *imageWriter) writeRefcounts() (int64, int64, error) {
+	iw.align()
+	entriesPerBlock := iw.clusterSize * 8 / (1 << DEFAULT_REFCOUNT_ORDER)
+	used := iw.next / iw.clusterSize
+
+	var blocks, tableClusters int64
+	for {
+		total := used + blocks + tableClusters
+		newBlocks := (total + entriesPerBlock - 1) / entriesPerBlock
+		newTableClusters := (newBlocks*8 + iw.clusterSize - 1) / iw.clusterSize
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+
+	tableOffset := iw.reserve(tableClusters)
+	blocksOffset := iw.reserve(blocks)
+
+	table := make([]uint64, tableClusters*iw.clusterSize/8)
+	for i := int64(0); i < blocks; i++ {
+		table[i] = uint64(blocksOffset + i*iw.clusterSize)
+	}
+	refcounts := make([]byte, blocks*iw.clusterSize)
+	for cluster, refcount := range iw.refcounts {
+		if refcount > 0xffff {
+			return 0, 0, errors.New("qcow2 refcount overflow")
+		}
+		binary.BigEndian.PutUint16(refcounts[cluster*2:], uint16(refcount))
+	}
+
+	if err := iw.writeAt(tableOffset, uint64Bytes(table)); err != nil {
+		return 0, 0, err
+	}
+	if err := iw.writeAt(blocksOffset, refcounts); err != nil {
+		return 0, 0, err
+	}
+	return tableOffset, tableClusters, nil
+}
+
+// writeHeader writes the header, its extensions and the backing file name
+// into the first cluster.
+func (iw *imageWriter) writeHeader(header *Header, opts *CreateOptions) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if opts.BackingFormat != "" {
+		writeHeaderExtension(&buf, HEADER_EXT_BACKING_FORMAT, []byte(opts.BackingFormat))
+	}
+	writeHeaderExtension(&buf, HEADER_EXT_END, nil)
+
+	if opts.BackingFile != "" {
+		if len(opts.BackingFile) > 1023 {
+			return fmt.Errorf("qcow2 backing file name too long: %d", len(opts.BackingFile))
+		}
+		header.BackingFileOffset = uint64(buf.Len())
+		header.BackingFileSize = uint32(len(opts.BackingFile))
+		buf.WriteString(opts.BackingFile)
+
+		// rewrite the header with the backing file location
+		fixed := new(bytes.Buffer)
+		if err := binary.Write(fixed, binary.BigEndian, header); err != nil {
+			return err
+		}
+		copy(buf.Bytes(), fixed.Bytes())
+	}
+	if int64(buf.Len()) > iw.clusterSize {
+		return errors.New("qcow2 header does not fit into the first cluster")
+	}
+
+	return iw.writeAt(0, buf.Bytes())
+}
+
+func writeHeaderExtension(buf *bytes.Buffer, extType uint32, data []byte) {
+	binary.Write(buf, binary.BigEndian, extType)
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	buf.Write(make([]byte, (8-len(data)%8)%8))
+}
+
+func uint64Bytes(values []uint64) []byte {
+	buf := make([]byte, len(values)*8)
+	for i, v := range values {
+		binary.BigEndian.PutUint64(buf[i*8:], v)
+	}
+	return buf
+}
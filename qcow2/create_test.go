@@ -0,0 +1,175 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useBackingDir returns a directory for the images of a test, against which
+// backing files are resolved.
+func useBackingDir(t *testing.T) string {
+	dir := t.TempDir()
+	FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(dir, s))
+	}
+	t.Cleanup(func() {
+		FileAccessor = nil
+	})
+	return dir
+}
+
+// newTestClusters returns size bytes of guest data in which every other
+// cluster is zero and so left unallocated.
+func newTestClusters(size, clusterSize int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		if (i/clusterSize)%2 == 0 {
+			data[i] = byte(i*7 + i/512)
+		}
+	}
+	return data
+}
+
+func createTestImage(t *testing.T, name string, src io.ReaderAt, size int64, opts *CreateOptions) *QCOW2 {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Create(f, src, size, opts); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	fh, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fh.Close() })
+	q, err := NewQCOW2(fh)
+	if err != nil {
+		t.Fatalf("NewQCOW2() error = %v", err)
+	}
+	return q
+}
+
+func TestCreateRoundTrip(t *testing.T) {
+	dir := useBackingDir(t)
+	data := newTestClusters(20*65536+3*512, 65536)
+
+	tests := []struct {
+		name string
+		opts *CreateOptions
+	}{
+		{"default", nil},
+		{"small clusters", &CreateOptions{ClusterSize: 4096}},
+		{"zlib", &CreateOptions{Compress: true}},
+		{"zstd", &CreateOptions{ClusterSize: 4096, Compress: true, CompressionType: COMPRESSION_TYPE_ZSTD}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := createTestImage(t, filepath.Join(dir, tt.name+".qcow2"), bytes.NewReader(data), int64(len(data)), tt.opts)
+			if got, want := q.Size(), uint64(len(data)); got != want {
+				t.Fatalf("Size() = %d, want %d", got, want)
+			}
+
+			got := make([]byte, len(data))
+			if _, err := q.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() error = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("read data does not match source")
+			}
+
+			// zero clusters are left unallocated
+			if entry, _, err := q.lookupL2(65536); err != nil || entry != 0 {
+				t.Fatalf("lookupL2(65536) = 0x%x, %v, want unallocated", entry, err)
+			}
+			refcount, err := q.Refcount(0)
+			if err != nil || refcount != 1 {
+				t.Fatalf("Refcount(0) = %d, %v, want 1", refcount, err)
+			}
+		})
+	}
+}
+
+func TestCreateOverlay(t *testing.T) {
+	dir := useBackingDir(t)
+	base := bytes.Repeat([]byte{0xaa}, 4*65536)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty overlay reads through to the backing file
+	q := createTestImage(t, filepath.Join(dir, "empty.qcow2"), nil, int64(len(base)), &CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+	got := make([]byte, len(base))
+	if _, err := q.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, base) {
+		t.Fatal("empty overlay does not match backing file")
+	}
+
+	// zero clusters of the source hide the backing data
+	data := newTestClusters(len(base), 65536)
+	q = createTestImage(t, filepath.Join(dir, "overlay.qcow2"), bytes.NewReader(data), int64(len(data)), &CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+	if q.BackingFile() != "base.raw" {
+		t.Fatalf("BackingFile() = %q", q.BackingFile())
+	}
+	if _, err := q.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("overlay data does not match source")
+	}
+}
+
+func TestCompressCluster(t *testing.T) {
+	cluster := bytes.Repeat([]byte("compressible guest data "), DEFAULT_CLUSTER_SIZE/24+1)[:DEFAULT_CLUSTER_SIZE]
+	compressed, err := compressCluster(cluster, COMPRESSION_TYPE_ZLIB, nil)
+	if err != nil {
+		t.Fatalf("compressCluster() error = %v", err)
+	}
+	if len(compressed) > len(cluster)/16 {
+		t.Fatalf("compressCluster() = %d bytes, want at most %d", len(compressed), len(cluster)/16)
+	}
+	got, err := decompressCluster(COMPRESSION_TYPE_ZLIB, compressed, DEFAULT_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatalf("decompressCluster() error = %v", err)
+	}
+	if !bytes.Equal(got, cluster) {
+		t.Fatal("decompressed cluster does not match")
+	}
+}
+
+func TestCreateSourceSize(t *testing.T) {
+	dir := useBackingDir(t)
+	// only the first sector of cluster 1 is part of the image, and it is zero
+	data := bytes.Repeat([]byte{0x55}, 2*65536)
+	clear(data[65536 : 65536+512])
+	size := int64(65536 + 512)
+
+	q := createTestImage(t, filepath.Join(dir, "long.qcow2"), bytes.NewReader(data), size, nil)
+	if entry, _, err := q.lookupL2(65536); err != nil || entry != 0 {
+		t.Fatalf("lookupL2(65536) = 0x%x, %v, want unallocated", entry, err)
+	}
+	got := make([]byte, size)
+	if _, err := q.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, data[:size]) {
+		t.Fatal("read data does not match source")
+	}
+
+	f, err := os.Create(filepath.Join(dir, "short.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Create(f, bytes.NewReader(data), int64(len(data))+512, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Create() from a short source error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
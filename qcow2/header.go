@@ -0,0 +1,141 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// version 3 fields, set to their version 2 defaults for older images
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+
+	// only present when HeaderLength is larger than 104
+	CompressionType uint8
+	Padding         [7]byte
+}
+
+type HeaderExtension struct {
+	Type uint32
+	Data []byte
+}
+
+// FeatureName is an entry of the feature name table extension.
+type FeatureName struct {
+	Type uint8
+	Bit  uint8
+	Name string
+}
+
+func readHeader(fh io.ReadSeeker, header *Header) error {
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, binary.Size(header))
+	n, err := io.ReadFull(fh, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < HEADER_V2_LENGTH {
+		return errors.New("qcow2 header is truncated")
+	}
+	if _, err := binary.Decode(buf, binary.BigEndian, header); err != nil {
+		return err
+	}
+
+	if string(header.Magic[:]) != QCOW2_MAGIC {
+		return errors.New("invalid qcow2 magic")
+	}
+
+	switch header.Version {
+	case 2:
+		header.IncompatibleFeatures = 0
+		header.CompatibleFeatures = 0
+		header.AutoclearFeatures = 0
+		header.RefcountOrder = 4
+		header.HeaderLength = HEADER_V2_LENGTH
+	case 3:
+		if header.HeaderLength < HEADER_V3_LENGTH {
+			return fmt.Errorf("invalid qcow2 header length: %d", header.HeaderLength)
+		}
+	default:
+		return fmt.Errorf("unsupported qcow2 version: %d", header.Version)
+	}
+	if header.HeaderLength <= HEADER_V3_LENGTH {
+		header.CompressionType = COMPRESSION_TYPE_ZLIB
+	}
+
+	if header.ClusterBits < MIN_CLUSTER_BITS || header.ClusterBits > MAX_CLUSTER_BITS {
+		return fmt.Errorf("invalid qcow2 cluster bits: %d", header.ClusterBits)
+	}
+	if header.RefcountOrder > 6 {
+		return fmt.Errorf("invalid qcow2 refcount order: %d", header.RefcountOrder)
+	}
+	return nil
+}
+
+// readHeaderExtensions reads the extensions following the header up to the
+// end marker.
+func readHeaderExtensions(fh io.ReadSeeker, header *Header) ([]HeaderExtension, error) {
+	clusterSize := int64(1) << header.ClusterBits
+	offset := int64(header.HeaderLength)
+	if _, err := fh.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var extensions []HeaderExtension
+	for offset < clusterSize {
+		var ext struct {
+			Type   uint32
+			Length uint32
+		}
+		if err := binary.Read(fh, binary.BigEndian, &ext); err != nil {
+			return nil, err
+		}
+		if ext.Type == HEADER_EXT_END {
+			break
+		}
+		if offset+8+int64(ext.Length) > clusterSize {
+			return nil, fmt.Errorf("qcow2 header extension 0x%08x exceeds the first cluster", ext.Type)
+		}
+		data := make([]byte, (ext.Length+7)&^7)
+		if _, err := io.ReadFull(fh, data); err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, HeaderExtension{Type: ext.Type, Data: data[:ext.Length]})
+		offset += 8 + int64(len(data))
+	}
+	return extensions, nil
+}
+
+func parseFeatureNames(data []byte) []FeatureName {
+	var names []FeatureName
+	for i := 0; i+48 <= len(data); i += 48 {
+		names = append(names, FeatureName{
+			Type: data[i],
+			Bit:  data[i+1],
+			Name: strings.TrimRight(string(data[i+2:i+48]), "\x00"),
+		})
+	}
+	return names
+}
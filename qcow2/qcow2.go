@@ -0,0 +1,420 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const QCOW2_MAGIC = "QFI\xfb"
+
+const (
+	HEADER_V2_LENGTH = 72
+	HEADER_V3_LENGTH = 104
+
+	MIN_CLUSTER_BITS = 9
+	MAX_CLUSTER_BITS = 21
+
+	HEADER_EXT_END            = 0x00000000
+	HEADER_EXT_BACKING_FORMAT = 0xe2792aca
+	HEADER_EXT_FEATURE_TABLE  = 0x6803f857
+	HEADER_EXT_BITMAPS        = 0x23852875
+	HEADER_EXT_ENCRYPTION     = 0x0537be77
+	HEADER_EXT_DATA_FILE      = 0x44415441
+
+	INCOMPAT_DIRTY       = 1 << 0
+	INCOMPAT_CORRUPT     = 1 << 1
+	INCOMPAT_DATA_FILE   = 1 << 2
+	INCOMPAT_COMPRESSION = 1 << 3
+	INCOMPAT_EXTL2       = 1 << 4
+	INCOMPAT_SUPPORTED   = INCOMPAT_DIRTY | INCOMPAT_CORRUPT | INCOMPAT_DATA_FILE | INCOMPAT_COMPRESSION | INCOMPAT_EXTL2
+
+	COMPAT_LAZY_REFCOUNTS = 1 << 0
+
+	AUTOCLEAR_BITMAPS       = 1 << 0
+	AUTOCLEAR_DATA_FILE_RAW = 1 << 1
+
+	COMPRESSION_TYPE_ZLIB = 0
+	COMPRESSION_TYPE_ZSTD = 1
+
+	L1E_OFFSET_MASK  = 0x00fffffffffffe00
+	L2E_OFFSET_MASK  = 0x00fffffffffffe00
+	OFLAG_COPIED     = 1 << 63
+	OFLAG_COMPRESSED = 1 << 62
+	OFLAG_ZERO       = 1 << 0
+
+	SUBCLUSTERS_PER_CLUSTER = 32
+)
+
+type FileAccessorFn func(string) (io.ReadSeeker, error)
+
+var FileAccessor FileAccessorFn
+
+var ErrFileAccessorNotAvailable = errors.New("file accessor needed to access backing and data files")
+
+// ErrCorrupt is returned for images flagged corrupt by the writer; their
+// metadata cannot be trusted.
+var ErrCorrupt = errors.New("qcow2 image is marked corrupt")
+
+// image is what a qcow2 image reads unallocated clusters from.
+type image interface {
+	ReadAt(p []byte, offset int64) (int, error)
+	Size() uint64
+}
+
+type QCOW2 struct {
+	fh io.ReadSeeker
+	// dataFh holds the guest data, fh itself unless the image has an
+	// external data file
+	dataFh io.ReadSeeker
+
+	header        Header
+	extensions    []HeaderExtension
+	featureNames  []FeatureName
+	backingFile   string
+	backingFormat string
+	dataFile      string
+	backing       image
+
+	size           uint64
+	clusterSize    int64
+	l1Table        []uint64
+	l2Entries      int64
+	extendedL2     bool
+	subclusterSize int64
+	refcountTable  []uint64
+	snapshots      []Snapshot
+
+	// the last used L2 table and decompressed cluster
+	l2Cache           []uint64
+	l2CacheOffset     uint64
+	clusterCache      []byte
+	clusterCacheEntry uint64
+}
+
+func NewQCOW2(fh io.ReadSeeker) (*QCOW2, error) {
+	if FileAccessor == nil {
+		return nil, ErrFileAccessorNotAvailable
+	}
+
+	q, err := readQCOW2(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.backingFile != "" {
+		q.backing, err = openBacking(q.backingFile, q.backingFormat)
+		if err != nil {
+			return nil, fmt.Errorf("opening backing file %s: %w", q.backingFile, err)
+		}
+	}
+	if q.dataFile != "" {
+		q.dataFh, err = FileAccessor(strings.ReplaceAll(q.dataFile, "\\", "/"))
+		if err != nil {
+			return nil, fmt.Errorf("opening data file %s: %w", q.dataFile, err)
+		}
+	}
+
+	return q, nil
+}
+
+// readQCOW2 parses the header, its extensions and the L1 and refcount
+// tables without opening backing or data files.
+func readQCOW2(fh io.ReadSeeker) (*QCOW2, error) {
+	q := &QCOW2{fh: fh, dataFh: fh}
+	if err := readHeader(fh, &q.header); err != nil {
+		return nil, err
+	}
+	h := &q.header
+
+	var err error
+	q.extensions, err = readHeaderExtensions(fh, h)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range q.extensions {
+		switch ext.Type {
+		case HEADER_EXT_BACKING_FORMAT:
+			q.backingFormat = string(ext.Data)
+		case HEADER_EXT_FEATURE_TABLE:
+			q.featureNames = parseFeatureNames(ext.Data)
+		case HEADER_EXT_DATA_FILE:
+			q.dataFile = string(ext.Data)
+		}
+	}
+
+	if unknown := h.IncompatibleFeatures &^ INCOMPAT_SUPPORTED; unknown != 0 {
+		return nil, fmt.Errorf("unsupported qcow2 incompatible features: %s", q.featureList(0, unknown))
+	}
+	if h.IncompatibleFeatures&INCOMPAT_CORRUPT != 0 {
+		return nil, ErrCorrupt
+	}
+	if h.CryptMethod != 0 {
+		return nil, errors.New("encrypted qcow2 images are not supported")
+	}
+	if h.IncompatibleFeatures&INCOMPAT_DATA_FILE != 0 && q.dataFile == "" {
+		return nil, errors.New("qcow2 image needs an external data file but names none")
+	}
+	switch h.CompressionType {
+	case COMPRESSION_TYPE_ZLIB, COMPRESSION_TYPE_ZSTD:
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 compression type: %d", h.CompressionType)
+	}
+
+	if h.BackingFileOffset != 0 {
+		if h.BackingFileSize > 1023 {
+			return nil, fmt.Errorf("invalid qcow2 backing file name length: %d", h.BackingFileSize)
+		}
+		name := make([]byte, h.BackingFileSize)
+		if _, err := fh.Seek(int64(h.BackingFileOffset), io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(fh, name); err != nil {
+			return nil, err
+		}
+		q.backingFile = string(name)
+	}
+
+	q.size = h.Size
+	q.clusterSize = int64(1) << h.ClusterBits
+	q.extendedL2 = h.IncompatibleFeatures&INCOMPAT_EXTL2 != 0
+	if q.extendedL2 {
+		q.l2Entries = q.clusterSize / 16
+		q.subclusterSize = q.clusterSize / SUBCLUSTERS_PER_CLUSTER
+	} else {
+		q.l2Entries = q.clusterSize / 8
+		q.subclusterSize = q.clusterSize
+	}
+
+	q.l1Table, err = q.readTable(int64(h.L1TableOffset), int64(h.L1Size))
+	if err != nil {
+		return nil, err
+	}
+	if required := (int64(q.size) + q.clusterSize*q.l2Entries - 1) / (q.clusterSize * q.l2Entries); int64(len(q.l1Table)) < required {
+		return nil, fmt.Errorf("qcow2 L1 table has %d entries, %d needed for the virtual size", len(q.l1Table), required)
+	}
+	q.refcountTable, err = q.readTable(int64(h.RefcountTableOffset), int64(h.RefcountTableClusters)*q.clusterSize/8)
+	if err != nil {
+		return nil, err
+	}
+	q.snapshots, err = q.readSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// openBacking opens a backing file through FileAccessor as a qcow2 image, or
+// as a raw image when its format says so or it has no qcow2 magic.
+func openBacking(name, format string) (image, error) {
+	fh, err := FileAccessor(strings.ReplaceAll(name, "\\", "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(QCOW2_MAGIC))
+	if _, err := io.ReadFull(fh, magic); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if format != "raw" && string(magic) == QCOW2_MAGIC {
+		return NewQCOW2(fh)
+	}
+	if format != "" && format != "raw" {
+		return nil, fmt.Errorf("unsupported backing file format: %s", format)
+	}
+	return newRawImage(fh)
+}
+
+func (q *QCOW2) readTable(offset, entries int64) ([]uint64, error) {
+	if entries == 0 {
+		return nil, nil
+	}
+	if offset == 0 || offset%q.clusterSize != 0 {
+		return nil, fmt.Errorf("invalid qcow2 table offset: 0x%x", offset)
+	}
+	if _, err := q.fh.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, entries)
+	if err := binary.Read(q.fh, binary.BigEndian, table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// featureList names the set bits of a feature bitmap, using the feature name
+// table when the image has one.
+func (q *QCOW2) featureList(featureType uint8, bits uint64) string {
+	var names []string
+	for bit := uint8(0); bit < 64; bit++ {
+		if bits&(1<<bit) == 0 {
+			continue
+		}
+		name := fmt.Sprintf("bit %d", bit)
+		for _, feature := range q.featureNames {
+			if feature.Type == featureType && feature.Bit == bit {
+				name = feature.Name
+			}
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (q *QCOW2) Header() Header {
+	return q.header
+}
+
+// BackingFile returns the name of the backing file, empty for images
+// without one.
+func (q *QCOW2) BackingFile() string {
+	return q.backingFile
+}
+
+func (q *QCOW2) Size() uint64 {
+	return q.size
+}
+
+func (q *QCOW2) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= int64(q.size) {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), int64(q.size)-offset)
+	for read := int64(0); read < length; {
+		pos := offset + read
+		count := min(length-read, q.subclusterSize-pos%q.subclusterSize)
+		if err := q.readSubcluster(p[read:read+count], pos); err != nil {
+			return int(read), err
+		}
+		read += count
+	}
+
+	if length < int64(len(p)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// readSubcluster fills buf, which lies within one subcluster (or cluster
+// without extended L2 entries), with the guest data at pos.
+func (q *QCOW2) readSubcluster(buf []byte, pos int64) error {
+	l2Entry, bitmap, err := q.lookupL2(pos)
+	if err != nil {
+		return err
+	}
+	inCluster := pos % q.clusterSize
+
+	if l2Entry&OFLAG_COMPRESSED != 0 {
+		data, err := q.readCompressedCluster(l2Entry)
+		if err != nil {
+			return err
+		}
+		copy(buf, data[inCluster:])
+		return nil
+	}
+
+	hostOffset := int64(l2Entry & L2E_OFFSET_MASK)
+	var allocated, zero bool
+	if q.extendedL2 {
+		subcluster := uint(inCluster / q.subclusterSize)
+		allocated = bitmap&(1<<subcluster) != 0
+		zero = bitmap&(1<<(subcluster+32)) != 0
+	} else {
+		zero = q.header.Version >= 3 && l2Entry&OFLAG_ZERO != 0
+		// a zero host offset is valid in external data files, marked by the
+		// copied flag
+		allocated = hostOffset != 0 || (q.dataFile != "" && l2Entry&OFLAG_COPIED != 0)
+	}
+
+	switch {
+	case zero:
+		clear(buf)
+		return nil
+	case allocated:
+		if _, err := q.dataFh.Seek(hostOffset+inCluster, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(q.dataFh, buf)
+		return err
+	default:
+		return q.readBacking(buf, pos)
+	}
+}
+
+// readBacking reads unallocated guest data from the backing image; the part
+// beyond the end of a smaller backing image reads as zeros.
+func (q *QCOW2) readBacking(buf []byte, pos int64) error {
+	clear(buf)
+	if q.backing == nil || pos >= int64(q.backing.Size()) {
+		return nil
+	}
+	n := min(int64(len(buf)), int64(q.backing.Size())-pos)
+	_, err := q.backing.ReadAt(buf[:n], pos)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// lookupL2 returns the L2 entry covering the guest offset pos and, for
+// extended L2 entries, the subcluster bitmap. Unallocated L2 tables yield a
+// zero entry.
+func (q *QCOW2) lookupL2(pos int64) (uint64, uint64, error) {
+	cluster := pos / q.clusterSize
+	l1Index, l2Index := cluster/q.l2Entries, cluster%q.l2Entries
+	if l1Index >= int64(len(q.l1Table)) {
+		return 0, 0, fmt.Errorf("offset 0x%x outside of the L1 table", pos)
+	}
+
+	l2Offset := q.l1Table[l1Index] & L1E_OFFSET_MASK
+	if l2Offset == 0 {
+		return 0, 0, nil
+	}
+	if q.l2Cache == nil || q.l2CacheOffset != l2Offset {
+		if int64(l2Offset)%q.clusterSize != 0 {
+			return 0, 0, fmt.Errorf("unaligned qcow2 L2 table offset: 0x%x", l2Offset)
+		}
+		table, err := q.readTable(int64(l2Offset), q.clusterSize/8)
+		if err != nil {
+			return 0, 0, err
+		}
+		q.l2Cache, q.l2CacheOffset = table, l2Offset
+	}
+
+	if q.extendedL2 {
+		return q.l2Cache[l2Index*2], q.l2Cache[l2Index*2+1], nil
+	}
+	return q.l2Cache[l2Index], 0, nil
+}
+
+// rawImage is a backing file without format, read as is.
+type rawImage struct {
+	fh   io.ReadSeeker
+	size uint64
+}
+
+func newRawImage(fh io.ReadSeeker) (*rawImage, error) {
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &rawImage{fh: fh, size: uint64(size)}, nil
+}
+
+func (r *rawImage) ReadAt(p []byte, offset int64) (int, error) {
+	if _, err := r.fh.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.fh, p)
+}
+
+func (r *rawImage) Size() uint64 {
+	return r.size
+}
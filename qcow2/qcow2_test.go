@@ -0,0 +1,193 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testClusterBits = 12
+	testClusterSize = 1 << testClusterBits
+	// host clusters: header, L1, refcount table, refcount block, L2, data
+	testDataOffset = 5 * testClusterSize
+)
+
+// testImage describes a hand-built image of 8 guest clusters with a single
+// L2 table; host holds the data clusters stored from testDataOffset on.
+type testImage struct {
+	version      uint32
+	incompatible uint64
+	backingFile  string
+	l2           []uint64
+	host         []byte
+}
+
+func (ti testImage) bytes(t *testing.T) []byte {
+	image := make([]byte, testDataOffset+len(ti.host))
+	header := Header{
+		Version:               ti.version,
+		ClusterBits:           testClusterBits,
+		Size:                  8 * testClusterSize,
+		L1Size:                1,
+		L1TableOffset:         testClusterSize,
+		RefcountTableOffset:   2 * testClusterSize,
+		RefcountTableClusters: 1,
+		IncompatibleFeatures:  ti.incompatible,
+		RefcountOrder:         4,
+		HeaderLength:          HEADER_V3_LENGTH,
+	}
+	copy(header.Magic[:], QCOW2_MAGIC)
+	if ti.version == 2 {
+		header.RefcountOrder, header.HeaderLength = 0, 0
+	}
+	if ti.backingFile != "" {
+		header.BackingFileOffset, header.BackingFileSize = 2048, uint32(len(ti.backingFile))
+		copy(image[2048:], ti.backingFile)
+	}
+	if _, err := binary.Encode(image, binary.BigEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	extensions := image[HEADER_V2_LENGTH:]
+	if ti.version == 3 {
+		extensions = image[HEADER_V3_LENGTH:]
+		if ti.backingFile != "" {
+			binary.BigEndian.PutUint32(extensions, HEADER_EXT_BACKING_FORMAT)
+			binary.BigEndian.PutUint32(extensions[4:], 3)
+			copy(extensions[8:], "raw")
+			extensions = extensions[16:]
+		}
+	}
+	clear(extensions[:8])
+
+	binary.BigEndian.PutUint64(image[testClusterSize:], 4*testClusterSize|OFLAG_COPIED)
+	binary.BigEndian.PutUint64(image[2*testClusterSize:], 3*testClusterSize)
+	for cluster := 0; cluster*testClusterSize < len(image); cluster++ {
+		binary.BigEndian.PutUint16(image[3*testClusterSize+cluster*2:], 1)
+	}
+	for i, entry := range ti.l2 {
+		binary.BigEndian.PutUint64(image[4*testClusterSize+i*8:], entry)
+	}
+	copy(image[testDataOffset:], ti.host)
+	return image
+}
+
+func writeTestImage(t *testing.T, dir, name string, ti testImage) *QCOW2 {
+	if err := os.WriteFile(filepath.Join(dir, name), ti.bytes(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := FileAccessor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQCOW2(fh)
+	if err != nil {
+		t.Fatalf("NewQCOW2() error = %v", err)
+	}
+	return q
+}
+
+func TestReadImage(t *testing.T) {
+	dir := useBackingDir(t)
+	backing := bytes.Repeat([]byte{0xaa}, 4*testClusterSize+2048)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), backing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// guest cluster 0 is stored as is, cluster 1 compressed at an unaligned
+	// offset behind it
+	plain := newTestClusters(testClusterSize, testClusterSize)
+	compressed := bytes.Repeat([]byte("qcow2 compressed cluster "), testClusterSize/25+1)[:testClusterSize]
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	w.Write(compressed)
+	w.Close()
+	host := append(bytes.Clone(plain), make([]byte, 100)...)
+	compressedOffset := uint64(testDataOffset + len(host))
+	host = append(host, deflated.Bytes()...)
+	sectors := (compressedOffset%512 + uint64(deflated.Len()) + 511) / 512
+	compressedEntry := OFLAG_COMPRESSED | (sectors-1)<<(62-(testClusterBits-8)) | compressedOffset
+
+	// the backing file covers the first four and a half clusters
+	want := make([]byte, 8*testClusterSize)
+	copy(want, backing)
+	copy(want, plain)
+	copy(want[testClusterSize:], compressed)
+	zeroed := bytes.Clone(want)
+	clear(zeroed[2*testClusterSize : 3*testClusterSize])
+
+	tests := []struct {
+		name  string
+		image testImage
+		want  []byte
+	}{
+		{"v2", testImage{
+			version: 2,
+			// the zero flag is reserved in version 2 images
+			l2: []uint64{testDataOffset | OFLAG_COPIED, compressedEntry, OFLAG_ZERO},
+		}, want},
+		{"v3", testImage{
+			version: 3,
+			l2:      []uint64{testDataOffset | OFLAG_COPIED, compressedEntry, OFLAG_ZERO},
+		}, zeroed},
+		{"extended L2", testImage{
+			version:      3,
+			incompatible: INCOMPAT_EXTL2,
+			// subclusters 0-15 allocated, 16-23 zero and the rest unallocated
+			l2: []uint64{testDataOffset | OFLAG_COPIED, 0x00ff0000<<32 | 0x0000ffff, compressedEntry, 0, 0, 0xffffffff << 32},
+		}, func() []byte {
+			want := bytes.Clone(zeroed)
+			subcluster := testClusterSize / SUBCLUSTERS_PER_CLUSTER
+			clear(want[16*subcluster : 24*subcluster])
+			copy(want[24*subcluster:testClusterSize], backing)
+			return want
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.image.backingFile = "base.raw"
+			tt.image.host = host
+			q := writeTestImage(t, dir, tt.name+".qcow2", tt.image)
+			if h := q.Header(); h.Version != tt.image.version || h.RefcountOrder != 4 || h.CompressionType != COMPRESSION_TYPE_ZLIB {
+				t.Fatalf("Header() = %+v", h)
+			}
+			if q.BackingFile() != "base.raw" {
+				t.Fatalf("BackingFile() = %q", q.BackingFile())
+			}
+			if refcount, err := q.Refcount(testDataOffset); err != nil || refcount != 1 {
+				t.Fatalf("Refcount() = %d, %v, want 1", refcount, err)
+			}
+
+			got := make([]byte, q.Size())
+			if _, err := q.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() error = %v", err)
+			}
+			for i := 0; i < len(got); i += testClusterSize {
+				if !bytes.Equal(got[i:i+testClusterSize], tt.want[i:i+testClusterSize]) {
+					t.Fatalf("guest cluster %d does not match", i/testClusterSize)
+				}
+			}
+		})
+	}
+}
+
+func TestReadCorruptImage(t *testing.T) {
+	dir := useBackingDir(t)
+	name := filepath.Join(dir, "corrupt.qcow2")
+	if err := os.WriteFile(name, testImage{version: 3, incompatible: INCOMPAT_CORRUPT}.bytes(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err := NewQCOW2(fh); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("NewQCOW2() error = %v, want ErrCorrupt", err)
+	}
+}
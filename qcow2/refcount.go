@@ -0,0 +1,49 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const REFCOUNT_TABLE_OFFSET_MASK = 0xfffffffffffffe00
+
+// Refcount returns the reference count of the host cluster containing the
+// offset, 0 for clusters not covered by a refcount block.
+func (q *QCOW2) Refcount(offset int64) (uint64, error) {
+	refcountBits := int64(1) << q.header.RefcountOrder
+	entriesPerBlock := q.clusterSize * 8 / refcountBits
+	cluster := offset / q.clusterSize
+	tableIndex, blockIndex := cluster/entriesPerBlock, cluster%entriesPerBlock
+
+	if tableIndex >= int64(len(q.refcountTable)) {
+		return 0, nil
+	}
+	blockOffset := int64(q.refcountTable[tableIndex] & REFCOUNT_TABLE_OFFSET_MASK)
+	if blockOffset == 0 {
+		return 0, nil
+	}
+
+	bitOffset := blockIndex * refcountBits
+	buf := make([]byte, max(refcountBits/8, 1))
+	if _, err := q.fh.Seek(blockOffset+bitOffset/8, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(q.fh, buf); err != nil {
+		return 0, err
+	}
+
+	switch refcountBits {
+	case 1, 2, 4:
+		return uint64(buf[0]>>(bitOffset%8)) & (1<<refcountBits - 1), nil
+	case 8:
+		return uint64(buf[0]), nil
+	case 16:
+		return uint64(binary.BigEndian.Uint16(buf)), nil
+	case 32:
+		return uint64(binary.BigEndian.Uint32(buf)), nil
+	case 64:
+		return binary.BigEndian.Uint64(buf), nil
+	}
+	return 0, fmt.Errorf("invalid refcount width: %d", refcountBits)
+}
@@ -0,0 +1,128 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// snapshotHeader is the fixed part of a snapshot table entry, followed by
+// extra data, the id and name strings and padding to 8 bytes.
+type snapshotHeader struct {
+	L1TableOffset uint64
+	L1Size        uint32
+	IDStrSize     uint16
+	NameSize      uint16
+	DateSec       uint32
+	DateNsec      uint32
+	VMClockNsec   uint64
+	VMStateSize   uint32
+	ExtraDataSize uint32
+}
+
+type Snapshot struct {
+	ID   string
+	Name string
+	Date time.Time
+	// VMClock is the guest clock when the snapshot was taken.
+	VMClock     time.Duration
+	VMStateSize uint64
+	// DiskSize is the virtual disk size at the time of the snapshot.
+	DiskSize uint64
+
+	l1TableOffset uint64
+	l1Size        uint32
+}
+
+func (q *QCOW2) readSnapshots() ([]Snapshot, error) {
+	if q.header.NbSnapshots == 0 {
+		return nil, nil
+	}
+	if _, err := q.fh.Seek(int64(q.header.SnapshotsOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, q.header.NbSnapshots)
+	for i := uint32(0); i < q.header.NbSnapshots; i++ {
+		var sh snapshotHeader
+		if err := binary.Read(q.fh, binary.BigEndian, &sh); err != nil {
+			return nil, err
+		}
+		extra := make([]byte, sh.ExtraDataSize)
+		strs := make([]byte, int(sh.IDStrSize)+int(sh.NameSize))
+		if _, err := io.ReadFull(q.fh, extra); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(q.fh, strs); err != nil {
+			return nil, err
+		}
+		entrySize := binary.Size(sh) + len(extra) + len(strs)
+		if _, err := q.fh.Seek(int64((8-entrySize%8)%8), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+
+		snapshot := Snapshot{
+			ID:            string(strs[:sh.IDStrSize]),
+			Name:          string(strs[sh.IDStrSize:]),
+			Date:          time.Unix(int64(sh.DateSec), int64(sh.DateNsec)),
+			VMClock:       time.Duration(sh.VMClockNsec),
+			VMStateSize:   uint64(sh.VMStateSize),
+			DiskSize:      q.header.Size,
+			l1TableOffset: sh.L1TableOffset,
+			l1Size:        sh.L1Size,
+		}
+		if len(extra) >= 8 {
+			snapshot.VMStateSize = binary.BigEndian.Uint64(extra[0:8])
+		}
+		if len(extra) >= 16 {
+			snapshot.DiskSize = binary.BigEndian.Uint64(extra[8:16])
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// Snapshots lists the internal snapshots of the image.
+func (q *QCOW2) Snapshots() []Snapshot {
+	return q.snapshots
+}
+
+// OpenSnapshot opens the internal snapshot with the given id or name as a
+// read-only image sharing the file and backing image of q.
+func (q *QCOW2) OpenSnapshot(idOrName string) (*QCOW2, error) {
+	for _, snapshot := range q.snapshots {
+		if snapshot.ID != idOrName && snapshot.Name != idOrName {
+			continue
+		}
+
+		l1Table, err := q.readTable(int64(snapshot.l1TableOffset), int64(snapshot.l1Size))
+		if err != nil {
+			return nil, err
+		}
+		s := &QCOW2{
+			fh:             q.fh,
+			dataFh:         q.dataFh,
+			header:         q.header,
+			extensions:     q.extensions,
+			featureNames:   q.featureNames,
+			backingFile:    q.backingFile,
+			backingFormat:  q.backingFormat,
+			dataFile:       q.dataFile,
+			backing:        q.backing,
+			size:           snapshot.DiskSize,
+			clusterSize:    q.clusterSize,
+			l1Table:        l1Table,
+			l2Entries:      q.l2Entries,
+			extendedL2:     q.extendedL2,
+			subclusterSize: q.subclusterSize,
+			refcountTable:  q.refcountTable,
+			snapshots:      q.snapshots,
+		}
+		if required := (int64(s.size) + s.clusterSize*s.l2Entries - 1) / (s.clusterSize * s.l2Entries); int64(len(l1Table)) < required {
+			return nil, fmt.Errorf("snapshot %s L1 table has %d entries, %d needed", idOrName, len(l1Table), required)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("no snapshot with id or name %q", idOrName)
+}
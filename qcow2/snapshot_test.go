@@ -0,0 +1,114 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// appendTestSnapshot adds a snapshot of size bytes to the image whose first
+// cluster holds data and whose other clusters are unallocated.
+func appendTestSnapshot(t *testing.T, name, id, snapshotName string, size uint64, data []byte) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var header Header
+	if err := readHeader(f, &header); err != nil {
+		t.Fatal(err)
+	}
+	clusterSize := uint64(1) << header.ClusterBits
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l1 := (uint64(end) + clusterSize - 1) / clusterSize * clusterSize
+	l2, cluster, table := l1+clusterSize, l1+2*clusterSize, l1+3*clusterSize
+
+	write := func(offset uint64, v any) {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(buf.Bytes(), int64(offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(l1, l2|OFLAG_COPIED)
+	write(l2, cluster|OFLAG_COPIED)
+	write(l2+clusterSize-8, uint64(0))
+	write(cluster, data)
+	write(table, &snapshotHeader{
+		L1TableOffset: l1,
+		L1Size:        1,
+		IDStrSize:     uint16(len(id)),
+		NameSize:      uint16(len(snapshotName)),
+		DateSec:       1700000000,
+		VMClockNsec:   uint64(5 * time.Second),
+		ExtraDataSize: 16,
+	})
+	write(table+40, []uint64{0, size})
+	write(table+56, []byte(id+snapshotName+"\x00\x00\x00\x00\x00\x00\x00\x00"))
+
+	write(60, uint32(1))
+	write(64, table)
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	dir := useBackingDir(t)
+	data := newTestClusters(4*4096, 4096)
+	name := filepath.Join(dir, "snapshot.qcow2")
+	createTestImage(t, name, bytes.NewReader(data), int64(len(data)), &CreateOptions{ClusterSize: 4096})
+	snapshotData := bytes.Repeat([]byte{0x5a}, 4096)
+	appendTestSnapshot(t, name, "1", "before update", 2*4096, snapshotData)
+
+	fh, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	q, err := NewQCOW2(fh)
+	if err != nil {
+		t.Fatalf("NewQCOW2() error = %v", err)
+	}
+	snapshots := q.Snapshots()
+	if len(snapshots) != 1 {
+		t.Fatalf("Snapshots() = %+v, want one snapshot", snapshots)
+	}
+	if s := snapshots[0]; s.ID != "1" || s.Name != "before update" || s.DiskSize != 2*4096 ||
+		!s.Date.Equal(time.Unix(1700000000, 0)) || s.VMClock != 5*time.Second {
+		t.Fatalf("Snapshots()[0] = %+v", s)
+	}
+
+	for _, idOrName := range []string{"1", "before update"} {
+		s, err := q.OpenSnapshot(idOrName)
+		if err != nil {
+			t.Fatalf("OpenSnapshot(%q) error = %v", idOrName, err)
+		}
+		got := make([]byte, s.Size())
+		if _, err := s.ReadAt(got, 0); err != nil {
+			t.Fatalf("ReadAt() error = %v", err)
+		}
+		if want := append(bytes.Clone(snapshotData), make([]byte, 4096)...); !bytes.Equal(got, want) {
+			t.Fatal("snapshot data does not match")
+		}
+	}
+
+	// the active image is not affected by the snapshot
+	got := make([]byte, q.Size())
+	if _, err := q.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("image data does not match")
+	}
+
+	if _, err := q.OpenSnapshot("2"); err == nil {
+		t.Fatal("OpenSnapshot() opened a missing snapshot")
+	}
+}
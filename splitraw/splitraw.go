@@ -0,0 +1,139 @@
+package splitraw
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+type FileAccessorFn func(string) (io.ReadSeeker, error)
+
+// FileAccessor opens the segment files by name.
+var FileAccessor FileAccessorFn
+
+var ErrFileAccessorNotAvailable = errors.New("file accessor needed to access segment files")
+
+type segment struct {
+	fh     io.ReadSeeker
+	offset int64
+	size   int64
+}
+
+// SplitRaw is a raw image split into sequentially named segment files, read
+// as one disk.
+type SplitRaw struct {
+	segments []segment
+	size     int64
+}
+
+// NewSplitRaw opens a raw image split into sequentially named segments,
+// e.g. image.001, image.002 or image.aa, image.ab. first is the name of the
+// first segment; the following ones are opened through FileAccessor until
+// the next name does not exist. Segments may be of any size.
+func NewSplitRaw(first string) (*SplitRaw, error) {
+	if FileAccessor == nil {
+		return nil, ErrFileAccessorNotAvailable
+	}
+
+	s := &SplitRaw{}
+	for name, ok := first, true; ok; name, ok = nextSplitName(name) {
+		fh, err := FileAccessor(strings.ReplaceAll(name, "\\", "/"))
+		if err != nil {
+			if name != first && errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			return nil, err
+		}
+		size, err := fh.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("split raw segment %s is empty", name)
+		}
+		s.segments = append(s.segments, segment{fh: fh, offset: s.size, size: size})
+		s.size += size
+	}
+	return s, nil
+}
+
+// Segments returns the number of segment files.
+func (s *SplitRaw) Segments() int {
+	return len(s.segments)
+}
+
+func (s *SplitRaw) Size() int64 {
+	return s.size
+}
+
+func (s *SplitRaw) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= s.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), s.size-offset)
+	index := sort.Search(len(s.segments), func(i int) bool {
+		return s.segments[i].offset+s.segments[i].size > offset
+	})
+	for read := int64(0); read < length; index++ {
+		seg := s.segments[index]
+		start := offset + read - seg.offset
+		count := min(length-read, seg.size-start)
+		if _, err := seg.fh.Seek(start, io.SeekStart); err != nil {
+			return int(read), err
+		}
+		if _, err := io.ReadFull(seg.fh, p[read:read+count]); err != nil {
+			return int(read), err
+		}
+		read += count
+	}
+
+	if length < int64(len(p)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// nextSplitName increments the numeric or alphabetic extension of a segment
+// name, keeping its width: .001 to .002, .az to .ba. It reports false when
+// the name has no such extension or the extension would overflow.
+func nextSplitName(name string) (string, bool) {
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 || dot == len(name)-1 {
+		return "", false
+	}
+	suffix := []byte(name[dot+1:])
+
+	var lowest, highest byte
+	switch c := suffix[0]; {
+	case c >= '0' && c <= '9':
+		lowest, highest = '0', '9'
+	case c >= 'a' && c <= 'z':
+		lowest, highest = 'a', 'z'
+	case c >= 'A' && c <= 'Z':
+		lowest, highest = 'A', 'Z'
+	}
+	for _, c := range suffix {
+		if lowest == 0 || c < lowest || c > highest {
+			return "", false
+		}
+	}
+	if lowest != '0' && len(suffix) < 2 {
+		return "", false
+	}
+
+	for i := len(suffix) - 1; i >= 0; i-- {
+		if suffix[i] < highest {
+			suffix[i]++
+			return name[:dot+1] + string(suffix), true
+		}
+		suffix[i] = lowest
+	}
+	return "", false
+}
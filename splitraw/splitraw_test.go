@@ -0,0 +1,92 @@
+package splitraw
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewSplitRaw(t *testing.T) {
+	dir := t.TempDir()
+	FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(dir, s))
+	}
+	t.Cleanup(func() { FileAccessor = nil })
+
+	tests := []struct {
+		names []string
+		sizes []int
+	}{
+		{[]string{"image.001", "image.002", "image.003"}, []int{131072, 131072, 65536}},
+		{[]string{"image.aa", "image.ab"}, []int{131072, 4096}},
+		// the last segment ends in a partial sector
+		{[]string{"short.001", "short.002"}, []int{1024, 700}},
+	}
+	for _, tt := range tests {
+		var data []byte
+		for i, name := range tt.names {
+			segment := make([]byte, tt.sizes[i])
+			for j := range segment {
+				segment[j] = byte(len(data) + j + (len(data)+j)/512)
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), segment, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, segment...)
+		}
+
+		s, err := NewSplitRaw(tt.names[0])
+		if err != nil {
+			t.Fatalf("NewSplitRaw(%s) error = %v", tt.names[0], err)
+		}
+		if s.Segments() != len(tt.names) || s.Size() != int64(len(data)) {
+			t.Fatalf("NewSplitRaw(%s) = %d segments of %d bytes, want %d of %d", tt.names[0], s.Segments(), s.Size(), len(tt.names), len(data))
+		}
+
+		got := make([]byte, len(data))
+		if _, err := s.ReadAt(got, 0); err != nil {
+			t.Fatalf("ReadAt() error = %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: read data does not match segments", tt.names[0])
+		}
+
+		// read across the segment boundary past the end of the image
+		got = make([]byte, 1000)
+		n, err := s.ReadAt(got, int64(len(data)-600))
+		if n != 600 || err != io.EOF || !bytes.Equal(got[:n], data[len(data)-600:]) {
+			t.Fatalf("%s: ReadAt() at the end = %d, %v", tt.names[0], n, err)
+		}
+	}
+
+	if _, err := NewSplitRaw("missing.001"); err == nil {
+		t.Fatal("NewSplitRaw() opened a missing first segment")
+	}
+}
+
+func TestNextSplitName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"image.001", "image.002", true},
+		{"image.009", "image.010", true},
+		{"image.raw.099", "image.raw.100", true},
+		{"image.999", "", false},
+		{"image.aa", "image.ab", true},
+		{"image.az", "image.ba", true},
+		{"image.AZ", "image.BA", true},
+		{"image.zz", "", false},
+		{"image", "", false},
+		{"image.a1", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := nextSplitName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("nextSplitName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
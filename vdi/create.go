@@ -0,0 +1,131 @@
+package vdi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DEFAULT_BLOCK_SIZE = 1 << 20
+
+	// VirtualBox places the block map at the first sector and aligns the
+	// block data to 1 MiB
+	BLOCKS_OFFSET = 512
+	DATA_ALIGN    = 1 << 20
+)
+
+type CreateOptions struct {
+	// Fixed allocates every block up front, zero blocks included.
+	Fixed bool
+	// BlockSize defaults to 1 MiB, the only size VirtualBox creates.
+	BlockSize int64
+	Comment   string
+}
+
+// Create writes a VDI image of size bytes holding the contents of src. In
+// dynamic images blocks that are all zeros are left free. src may be nil to
+// create an empty image.
+func Create(w io.WriteSeeker, src io.ReaderAt, size int64, opts *CreateOptions) error {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DEFAULT_BLOCK_SIZE
+	}
+	if blockSize < SECTOR_SIZE || blockSize&(blockSize-1) != 0 || blockSize > 1<<31 {
+		return fmt.Errorf("invalid vdi block size: %d", blockSize)
+	}
+	if size < 0 || size%SECTOR_SIZE != 0 {
+		return fmt.Errorf("vdi size must be a multiple of %d: %d", SECTOR_SIZE, size)
+	}
+	if len(opts.Comment) >= 256 {
+		return fmt.Errorf("vdi comment too long: %d", len(opts.Comment))
+	}
+
+	blockCount := (size + blockSize - 1) / blockSize
+	if blockCount >= BLOCK_ZERO {
+		return fmt.Errorf("vdi size too large for block size %d: %d", blockSize, size)
+	}
+	dataOffset := (BLOCKS_OFFSET + blockCount*4 + DATA_ALIGN - 1) / DATA_ALIGN * DATA_ALIGN
+
+	blockMap := make([]uint32, blockCount)
+	buf := make([]byte, blockSize)
+	zero := make([]byte, blockSize)
+	allocated := int64(0)
+	for block := int64(0); block < blockCount; block++ {
+		// the last block is read up to size and zero filled
+		offset := block * blockSize
+		length := min(blockSize, size-offset)
+		clear(buf)
+		if src != nil {
+			if n, err := src.ReadAt(buf[:length], offset); int64(n) < length {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return fmt.Errorf("reading vdi source at %d: %w", offset+int64(n), err)
+			}
+		}
+
+		if !opts.Fixed && bytes.Equal(buf, zero) {
+			blockMap[block] = BLOCK_FREE
+			continue
+		}
+		if _, err := w.Seek(dataOffset+allocated*blockSize, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		blockMap[block] = uint32(allocated)
+		allocated++
+	}
+
+	preHeader := PreHeader{Signature: VDI_SIGNATURE, Version: 0x00010001}
+	copy(preHeader.FileInfo[:], "<<< Oracle VM VirtualBox Disk Image >>>\n")
+	header := Header{
+		HeaderSize:      HEADER_V1_1_SIZE,
+		ImageType:       VDI_TYPE_NORMAL,
+		BlocksOffset:    BLOCKS_OFFSET,
+		DataOffset:      uint32(dataOffset),
+		LegacyGeometry:  Geometry{SectorSize: SECTOR_SIZE},
+		DiskSize:        uint64(size),
+		BlockSize:       uint32(blockSize),
+		BlockCount:      uint32(blockCount),
+		BlocksAllocated: uint32(allocated),
+		UUIDCreate:      uuidToBytes(uuid.New()),
+		UUIDModify:      uuidToBytes(uuid.New()),
+	}
+	if opts.Fixed {
+		header.ImageType = VDI_TYPE_FIXED
+	}
+	copy(header.Comment[:], opts.Comment)
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, &preHeader)
+	binary.Write(&out, binary.LittleEndian, &header)
+	out.Write(make([]byte, BLOCKS_OFFSET-out.Len()))
+	binary.Write(&out, binary.LittleEndian, blockMap)
+	// pad up to the data so images without allocated blocks are complete
+	out.Write(make([]byte, dataOffset-int64(out.Len())))
+
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// uuidToBytes is the inverse of uuidFromBytes.
+func uuidToBytes(u uuid.UUID) [16]byte {
+	var b [16]byte
+	b[0], b[1], b[2], b[3] = u[3], u[2], u[1], u[0]
+	b[4], b[5] = u[5], u[4]
+	b[6], b[7] = u[7], u[6]
+	copy(b[8:], u[8:])
+	return b
+}
@@ -0,0 +1,142 @@
+package vdi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	// blocks 1 and 4 are zero, the last block is three sectors long
+	data := make([]byte, 5*DEFAULT_BLOCK_SIZE+3*SECTOR_SIZE)
+	for _, block := range []int{0, 2, 3, 5} {
+		start := block * DEFAULT_BLOCK_SIZE
+		for i := start; i < min(start+DEFAULT_BLOCK_SIZE, len(data)); i++ {
+			data[i] = byte(block + i/SECTOR_SIZE)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		opts      *CreateOptions
+		imageType uint32
+		blockMap  []uint32
+	}{
+		{"dynamic", nil, VDI_TYPE_NORMAL, []uint32{0, BLOCK_FREE, 1, 2, BLOCK_FREE, 3}},
+		{"fixed", &CreateOptions{Fixed: true, Comment: "test"}, VDI_TYPE_FIXED, []uint32{0, 1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(dir, tt.name+".vdi")
+			f, err := os.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := Create(f, bytes.NewReader(data), int64(len(data)), tt.opts); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			image, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := NewVDI(bytes.NewReader(image))
+			if err != nil {
+				t.Fatalf("NewVDI() error = %v", err)
+			}
+
+			if v.preHeader.Signature != VDI_SIGNATURE || v.preHeader.Version != 0x00010001 {
+				t.Fatalf("pre-header = 0x%x, version 0x%x", v.preHeader.Signature, v.preHeader.Version)
+			}
+			h := v.Header()
+			if h.HeaderSize != HEADER_V1_1_SIZE || h.ImageType != tt.imageType || h.BlocksOffset != BLOCKS_OFFSET {
+				t.Fatalf("header size = %d, type = %d, blocks offset = %d", h.HeaderSize, h.ImageType, h.BlocksOffset)
+			}
+			// the data starts at the first 1 MiB boundary after the block map
+			if h.DataOffset != DATA_ALIGN {
+				t.Fatalf("DataOffset = %d, want %d", h.DataOffset, DATA_ALIGN)
+			}
+			if h.DiskSize != uint64(len(data)) || h.BlockSize != DEFAULT_BLOCK_SIZE || h.BlockExtraSize != 0 || h.BlockCount != 6 {
+				t.Fatalf("size = %d, block size = %d, extra = %d, count = %d", h.DiskSize, h.BlockSize, h.BlockExtraSize, h.BlockCount)
+			}
+			if h.LegacyGeometry.SectorSize != SECTOR_SIZE {
+				t.Fatalf("LegacyGeometry.SectorSize = %d", h.LegacyGeometry.SectorSize)
+			}
+			if v.UUID() == uuid.Nil || uuidFromBytes(h.UUIDModify) == uuid.Nil || v.ParentUUID() != uuid.Nil {
+				t.Fatalf("UUIDs = %s, %s, parent %s", v.UUID(), uuidFromBytes(h.UUIDModify), v.ParentUUID())
+			}
+			if tt.opts != nil && h.CommentString() != tt.opts.Comment {
+				t.Fatalf("CommentString() = %q", h.CommentString())
+			}
+
+			if !reflect.DeepEqual(v.blockMap, tt.blockMap) {
+				t.Fatalf("block map = %v, want %v", v.blockMap, tt.blockMap)
+			}
+			allocated := 0
+			for _, entry := range tt.blockMap {
+				if entry != BLOCK_FREE {
+					allocated++
+				}
+			}
+			if h.BlocksAllocated != uint32(allocated) {
+				t.Fatalf("BlocksAllocated = %d, want %d", h.BlocksAllocated, allocated)
+			}
+			if want := int64(h.DataOffset) + int64(allocated)*DEFAULT_BLOCK_SIZE; int64(len(image)) != want {
+				t.Fatalf("file size = %d, want %d", len(image), want)
+			}
+
+			got := make([]byte, len(data))
+			if _, err := v.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() error = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("read data does not match source")
+			}
+		})
+	}
+}
+
+func TestCreateSourceSize(t *testing.T) {
+	dir := t.TempDir()
+	// only the first sector of block 1 is part of the image, and it is zero
+	data := bytes.Repeat([]byte{0x55}, 2*DEFAULT_BLOCK_SIZE)
+	clear(data[DEFAULT_BLOCK_SIZE : DEFAULT_BLOCK_SIZE+SECTOR_SIZE])
+	size := int64(DEFAULT_BLOCK_SIZE + SECTOR_SIZE)
+
+	name := filepath.Join(dir, "long.vdi")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Create(f, bytes.NewReader(data), size, nil); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	image, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVDI(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("NewVDI() error = %v", err)
+	}
+	if want := []uint32{0, BLOCK_FREE}; !reflect.DeepEqual(v.blockMap, want) {
+		t.Fatalf("block map = %v, want %v", v.blockMap, want)
+	}
+
+	short, err := os.Create(filepath.Join(dir, "short.vdi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer short.Close()
+	if err := Create(short, bytes.NewReader(data), int64(len(data))+SECTOR_SIZE, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Create() from a short source error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,113 @@
+package vdi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// PreHeader starts every VDI file: an informational text followed by the
+// signature and the header version.
+type PreHeader struct {
+	FileInfo  [64]byte
+	Signature uint32
+	Version   uint32
+}
+
+// Geometry is the disk geometry as stored in the header.
+type Geometry struct {
+	Cylinders  uint32
+	Heads      uint32
+	Sectors    uint32
+	SectorSize uint32
+}
+
+// Header is the version 1.1 header; version 1.0 headers end before
+// LCHSGeometry.
+type Header struct {
+	HeaderSize       uint32
+	ImageType        uint32
+	Flags            uint32
+	Comment          [256]byte
+	BlocksOffset     uint32
+	DataOffset       uint32
+	LegacyGeometry   Geometry
+	Dummy            uint32
+	DiskSize         uint64
+	BlockSize        uint32
+	BlockExtraSize   uint32
+	BlockCount       uint32
+	BlocksAllocated  uint32
+	UUIDCreate       [16]byte
+	UUIDModify       [16]byte
+	UUIDLinkage      [16]byte
+	UUIDParentModify [16]byte
+	LCHSGeometry     Geometry
+}
+
+func readHeader(fh io.ReadSeeker, preHeader *PreHeader, header *Header) error {
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Read(fh, binary.LittleEndian, preHeader); err != nil {
+		return err
+	}
+	if preHeader.Signature != VDI_SIGNATURE {
+		return errors.New("invalid vdi signature")
+	}
+	if major := preHeader.Version >> 16; major != 1 {
+		return fmt.Errorf("unsupported vdi version: %d.%d", major, preHeader.Version&0xffff)
+	}
+
+	buf := make([]byte, binary.Size(header))
+	n, err := io.ReadFull(fh, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < HEADER_V1_SIZE {
+		return errors.New("vdi header is truncated")
+	}
+	if _, err := binary.Decode(buf, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if header.HeaderSize < HEADER_V1_SIZE {
+		return fmt.Errorf("invalid vdi header size: %d", header.HeaderSize)
+	}
+	if header.HeaderSize < HEADER_V1_1_SIZE {
+		header.LCHSGeometry = Geometry{}
+	}
+
+	switch header.ImageType {
+	case VDI_TYPE_NORMAL, VDI_TYPE_FIXED, VDI_TYPE_DIFF:
+	case VDI_TYPE_UNDO:
+		return errors.New("undo vdi images are not supported")
+	default:
+		return fmt.Errorf("unknown vdi image type: %d", header.ImageType)
+	}
+	if header.BlockSize == 0 || header.BlockSize%SECTOR_SIZE != 0 {
+		return fmt.Errorf("invalid vdi block size: %d", header.BlockSize)
+	}
+	if uint64(header.BlockCount)*uint64(header.BlockSize) < header.DiskSize {
+		return fmt.Errorf("vdi block map has %d blocks, too few for the disk size", header.BlockCount)
+	}
+	return nil
+}
+
+// CommentString returns the image description.
+func (h *Header) CommentString() string {
+	return strings.TrimRight(string(h.Comment[:]), "\x00")
+}
+
+// uuidFromBytes converts a UUID stored with little-endian leading fields.
+func uuidFromBytes(b [16]byte) uuid.UUID {
+	var u uuid.UUID
+	u[0], u[1], u[2], u[3] = b[3], b[2], b[1], b[0]
+	u[4], u[5] = b[5], b[4]
+	u[6], u[7] = b[7], b[6]
+	copy(u[8:], b[8:])
+	return u
+}
@@ -0,0 +1,235 @@
+package vdi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	VDI_SIGNATURE = 0xbeda107f
+
+	HEADER_V1_SIZE   = 384
+	HEADER_V1_1_SIZE = 400
+
+	VDI_TYPE_NORMAL = 1
+	VDI_TYPE_FIXED  = 2
+	VDI_TYPE_UNDO   = 3
+	VDI_TYPE_DIFF   = 4
+
+	BLOCK_FREE = 0xffffffff
+	BLOCK_ZERO = 0xfffffffe
+
+	SECTOR_SIZE = 512
+)
+
+type FileAccessorFn func(string) (io.ReadSeeker, error)
+
+var FileAccessor FileAccessorFn
+
+var ErrFileAccessorNotAvailable = errors.New("file accessor needed to access parent images")
+
+var ErrParentNeeded = errors.New("differencing vdi image needs its parent")
+
+type VDI struct {
+	fh        io.ReadSeeker
+	preHeader PreHeader
+	header    Header
+	blockMap  []uint32
+	parent    *VDI
+
+	size      int64
+	blockSize int64
+	// blockStride is the distance between two blocks in the file, the block
+	// data follows BlockExtraSize bytes of extra data
+	blockStride int64
+}
+
+// NewVDI opens a normal or fixed image. Differencing images need their
+// parent, see NewVDIWithParent and OpenChain.
+func NewVDI(fh io.ReadSeeker) (*VDI, error) {
+	v, err := readVDI(fh)
+	if err != nil {
+		return nil, err
+	}
+	if v.header.ImageType == VDI_TYPE_DIFF {
+		return nil, ErrParentNeeded
+	}
+	return v, nil
+}
+
+// NewVDIWithParent opens a differencing image on top of parent, whose
+// creation UUID must match the linkage UUID of the image.
+func NewVDIWithParent(fh io.ReadSeeker, parent *VDI) (*VDI, error) {
+	v, err := readVDI(fh)
+	if err != nil {
+		return nil, err
+	}
+	if v.header.ImageType != VDI_TYPE_DIFF {
+		return nil, errors.New("vdi image is not a differencing image")
+	}
+	if v.ParentUUID() != parent.UUID() {
+		return nil, fmt.Errorf("vdi parent UUID mismatch: want %s, got %s", v.ParentUUID(), parent.UUID())
+	}
+	v.parent = parent
+	return v, nil
+}
+
+// OpenChain opens the image name and, for differencing images, looks up
+// each parent by UUID among candidates. Files are opened through
+// FileAccessor.
+func OpenChain(name string, candidates []string) (*VDI, error) {
+	if FileAccessor == nil {
+		return nil, ErrFileAccessorNotAvailable
+	}
+
+	images := map[uuid.UUID]string{}
+	for _, candidate := range candidates {
+		fh, err := FileAccessor(strings.ReplaceAll(candidate, "\\", "/"))
+		if err != nil {
+			continue
+		}
+		var preHeader PreHeader
+		var header Header
+		if err := readHeader(fh, &preHeader, &header); err == nil {
+			images[uuidFromBytes(header.UUIDCreate)] = candidate
+		}
+		if closer, ok := fh.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return openChain(name, images, 0)
+}
+
+func openChain(name string, images map[uuid.UUID]string, depth int) (*VDI, error) {
+	if depth > len(images) {
+		return nil, errors.New("vdi parent chain is cyclic")
+	}
+	fh, err := FileAccessor(strings.ReplaceAll(name, "\\", "/"))
+	if err != nil {
+		return nil, err
+	}
+	v, err := readVDI(fh)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if v.header.ImageType != VDI_TYPE_DIFF {
+		return v, nil
+	}
+
+	parentName, ok := images[v.ParentUUID()]
+	if !ok {
+		return nil, fmt.Errorf("%s: parent %s not found", name, v.ParentUUID())
+	}
+	v.parent, err = openChain(parentName, images, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// readVDI parses the headers and the block map without resolving parents.
+func readVDI(fh io.ReadSeeker) (*VDI, error) {
+	v := &VDI{fh: fh}
+	if err := readHeader(fh, &v.preHeader, &v.header); err != nil {
+		return nil, err
+	}
+	h := &v.header
+
+	if _, err := fh.Seek(int64(h.BlocksOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	v.blockMap = make([]uint32, h.BlockCount)
+	if err := binary.Read(fh, binary.LittleEndian, v.blockMap); err != nil {
+		return nil, err
+	}
+
+	v.size = int64(h.DiskSize)
+	v.blockSize = int64(h.BlockSize)
+	v.blockStride = int64(h.BlockSize) + int64(h.BlockExtraSize)
+	return v, nil
+}
+
+func (v *VDI) Header() Header {
+	return v.header
+}
+
+// UUID returns the creation UUID that differencing children link to.
+func (v *VDI) UUID() uuid.UUID {
+	return uuidFromBytes(v.header.UUIDCreate)
+}
+
+// ParentUUID returns the creation UUID of the parent, the nil UUID for
+// images without one.
+func (v *VDI) ParentUUID() uuid.UUID {
+	return uuidFromBytes(v.header.UUIDLinkage)
+}
+
+func (v *VDI) Parent() *VDI {
+	return v.parent
+}
+
+func (v *VDI) Size() int64 {
+	return v.size
+}
+
+func (v *VDI) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= v.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), v.size-offset)
+	for read := int64(0); read < length; {
+		pos := offset + read
+		count := min(length-read, v.blockSize-pos%v.blockSize)
+		if err := v.readBlock(p[read:read+count], pos); err != nil {
+			return int(read), err
+		}
+		read += count
+	}
+
+	if length < int64(len(p)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+// readBlock fills buf, which lies within one block, with the data at pos.
+func (v *VDI) readBlock(buf []byte, pos int64) error {
+	entry := v.blockMap[pos/v.blockSize]
+	switch {
+	case entry == BLOCK_ZERO:
+		clear(buf)
+		return nil
+	case entry == BLOCK_FREE && v.parent != nil:
+		if pos >= v.parent.size {
+			clear(buf)
+			return nil
+		}
+		n, err := v.parent.ReadAt(buf, pos)
+		if err == io.EOF {
+			clear(buf[n:])
+			err = nil
+		}
+		return err
+	case entry == BLOCK_FREE:
+		clear(buf)
+		return nil
+	case entry >= v.header.BlockCount:
+		return fmt.Errorf("invalid vdi block map entry %d for block %d", entry, pos/v.blockSize)
+	}
+
+	offset := int64(v.header.DataOffset) + int64(entry)*v.blockStride + int64(v.header.BlockExtraSize) + pos%v.blockSize
+	if _, err := v.fh.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(v.fh, buf)
+	return err
+}
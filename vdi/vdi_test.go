@@ -0,0 +1,124 @@
+package vdi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const testBlockSize = 64 * 1024
+
+// newTestVDI builds an image of len(blockMap) blocks; the data of each
+// allocated block is stored in the order of the block map entries.
+func newTestVDI(imageType uint32, create, linkage uuid.UUID, blockMap []uint32, blocks map[uint32][]byte) []byte {
+	preHeader := PreHeader{Signature: VDI_SIGNATURE, Version: 0x00010001}
+	header := Header{
+		HeaderSize:      HEADER_V1_1_SIZE,
+		ImageType:       imageType,
+		BlocksOffset:    BLOCKS_OFFSET,
+		DataOffset:      BLOCKS_OFFSET + 512,
+		DiskSize:        uint64(len(blockMap)) * testBlockSize,
+		BlockSize:       testBlockSize,
+		BlockCount:      uint32(len(blockMap)),
+		BlocksAllocated: uint32(len(blocks)),
+		UUIDCreate:      uuidToBytes(create),
+		UUIDLinkage:     uuidToBytes(linkage),
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &preHeader)
+	binary.Write(&buf, binary.LittleEndian, &header)
+	buf.Write(make([]byte, BLOCKS_OFFSET-buf.Len()))
+	binary.Write(&buf, binary.LittleEndian, blockMap)
+	buf.Write(make([]byte, int(header.DataOffset)-buf.Len()))
+	for i := uint32(0); i < uint32(len(blocks)); i++ {
+		buf.Write(blocks[i])
+	}
+	return buf.Bytes()
+}
+
+func TestDifferencingImage(t *testing.T) {
+	dir := t.TempDir()
+	FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(dir, s))
+	}
+	t.Cleanup(func() { FileAccessor = nil })
+
+	block := func(b byte) []byte { return bytes.Repeat([]byte{b}, testBlockSize) }
+	parentID, childID := uuid.New(), uuid.New()
+	images := map[string][]byte{
+		// the parent stores its blocks out of order and has a zero block 3
+		"parent.vdi": newTestVDI(VDI_TYPE_NORMAL, parentID, uuid.Nil, []uint32{1, 2, 0, BLOCK_ZERO},
+			map[uint32][]byte{0: block(0x22), 1: block(0x10), 2: block(0x11)}),
+		// the child replaces block 1 and zeroes block 2
+		"child.vdi": newTestVDI(VDI_TYPE_DIFF, childID, parentID, []uint32{BLOCK_FREE, 0, BLOCK_ZERO, BLOCK_FREE},
+			map[uint32][]byte{0: block(0x33)}),
+		"other.vdi": newTestVDI(VDI_TYPE_NORMAL, uuid.New(), uuid.Nil, []uint32{BLOCK_FREE, BLOCK_FREE, BLOCK_FREE, BLOCK_FREE}, nil),
+	}
+	for name, image := range images {
+		if err := os.WriteFile(filepath.Join(dir, name), image, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := bytes.Join([][]byte{block(0x10), block(0x33), block(0x00), block(0x00)}, nil)
+
+	open := func(name string) *VDI {
+		fh, err := FileAccessor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := readVDI(fh)
+		if err != nil {
+			t.Fatalf("readVDI(%s) error = %v", name, err)
+		}
+		return v
+	}
+	read := func(v *VDI) []byte {
+		got := make([]byte, v.Size())
+		if _, err := v.ReadAt(got, 0); err != nil {
+			t.Fatalf("ReadAt() error = %v", err)
+		}
+		return got
+	}
+
+	fh, _ := FileAccessor("child.vdi")
+	if _, err := NewVDI(fh); !errors.Is(err, ErrParentNeeded) {
+		t.Fatalf("NewVDI() error = %v, want ErrParentNeeded", err)
+	}
+
+	fh, _ = FileAccessor("child.vdi")
+	v, err := NewVDIWithParent(fh, open("parent.vdi"))
+	if err != nil {
+		t.Fatalf("NewVDIWithParent() error = %v", err)
+	}
+	if v.ParentUUID() != parentID || v.UUID() != childID || v.Parent().UUID() != parentID {
+		t.Fatalf("UUIDs = %s, %s, want %s, %s", v.UUID(), v.ParentUUID(), childID, parentID)
+	}
+	if !bytes.Equal(read(v), want) {
+		t.Fatal("NewVDIWithParent() data does not match")
+	}
+
+	fh, _ = FileAccessor("child.vdi")
+	if _, err := NewVDIWithParent(fh, open("other.vdi")); err == nil || !strings.Contains(err.Error(), "UUID mismatch") {
+		t.Fatalf("NewVDIWithParent() error = %v, want a UUID mismatch", err)
+	}
+
+	v, err = OpenChain("child.vdi", []string{"other.vdi", "child.vdi", "parent.vdi", "missing.vdi"})
+	if err != nil {
+		t.Fatalf("OpenChain() error = %v", err)
+	}
+	if !bytes.Equal(read(v), want) {
+		t.Fatal("OpenChain() data does not match")
+	}
+
+	if _, err := OpenChain("child.vdi", []string{"other.vdi", "child.vdi"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("OpenChain() error = %v, want a missing parent", err)
+	}
+}
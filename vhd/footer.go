@@ -2,11 +2,19 @@ package vhd
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
 )
 
 const (
 	SECTOR_SIZE = 512
+
+	DISK_TYPE_FIXED        = 2
+	DISK_TYPE_DYNAMIC      = 3
+	DISK_TYPE_DIFFERENCING = 4
 )
 
 type Footer struct {
@@ -71,3 +79,48 @@ func readFooter(fh io.ReadSeeker) (*Footer, error) {
 	}
 	return footer, nil
 }
+
+// Identity holds the ids linking a differencing disk to its parent: the
+// ParentUniqueID of a child is the UniqueID of its parent's footer.
+type Identity struct {
+	DiskType       uint32
+	UniqueID       uuid.UUID
+	ParentUniqueID uuid.UUID
+	ParentName     string
+}
+
+// ReadIdentity reads the ids of a VHD without opening its parent.
+func ReadIdentity(fh io.ReadSeeker) (*Identity, error) {
+	footer, err := readFooter(fh)
+	if err != nil {
+		return nil, err
+	}
+	if string(footer.Cookie[:]) != VHD_MAGIC {
+		return nil, errors.New("invalid vhd footer cookie")
+	}
+
+	identity := &Identity{DiskType: footer.DiskType, UniqueID: uuid.UUID(footer.UniqueID)}
+	if footer.DiskType != DISK_TYPE_DIFFERENCING {
+		return identity, nil
+	}
+
+	if _, err := fh.Seek(int64(footer.DataOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := &DynamicHeader{}
+	if err := binary.Read(fh, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+	identity.ParentUniqueID = uuid.UUID(header.ParentUniqueID)
+
+	name := make([]uint16, 0, len(header.ParentUnicodeName)/2)
+	for i := 0; i < len(header.ParentUnicodeName); i += 2 {
+		c := binary.BigEndian.Uint16(header.ParentUnicodeName[i:])
+		if c == 0 {
+			break
+		}
+		name = append(name, c)
+	}
+	identity.ParentName = string(utf16.Decode(name))
+	return identity, nil
+}
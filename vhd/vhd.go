@@ -3,7 +3,11 @@ package vhd
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+
+	"github.com/google/uuid"
 )
 
 const VHD_MAGIC = "conectix"
@@ -13,8 +17,9 @@ type disk interface {
 }
 
 type VHD struct {
-	disk disk
-	size int64
+	disk     disk
+	size     int64
+	uniqueID uuid.UUID
 }
 
 func NewVHD(fh io.ReadSeeker) (*VHD, error) {
@@ -33,7 +38,30 @@ func NewVHD(fh io.ReadSeeker) (*VHD, error) {
 		}
 	}
 
-	return &VHD{disk: diskItem, size: int64(footer.CurrentSize)}, nil
+	return &VHD{disk: diskItem, size: int64(footer.CurrentSize), uniqueID: uuid.UUID(footer.UniqueID)}, nil
+}
+
+// NewVHDWithParent opens a differencing VHD on top of an already opened
+// parent, whose footer UniqueID must match the ParentUniqueID of the child.
+func NewVHDWithParent(fh io.ReadSeeker, parent *VHD) (*VHD, error) {
+	footer, err := readFooter(fh)
+	if err != nil {
+		return nil, err
+	}
+	if footer.DiskType != DISK_TYPE_DIFFERENCING {
+		return nil, errors.New("vhd is not a differencing disk")
+	}
+
+	diskItem, err := NewDynamicDisk(fh, footer)
+	if err != nil {
+		return nil, err
+	}
+	if parentID := uuid.UUID(diskItem.header.ParentUniqueID); parentID != parent.uniqueID {
+		return nil, fmt.Errorf("parent unique id %s does not match %s", parent.uniqueID, parentID)
+	}
+	diskItem.parent = parent.disk
+
+	return &VHD{disk: diskItem, size: int64(footer.CurrentSize), uniqueID: uuid.UUID(footer.UniqueID)}, nil
 }
 
 func (v *VHD) ReadAt(p []byte, offset int64) (int, error) {
@@ -87,6 +115,7 @@ func (d *FixedDisk) ReadSectors(sector int64, count int) ([]byte, error) {
 
 type DynamicDisk struct {
 	fh               io.ReadSeeker
+	parent           disk
 	footer           *Footer
 	header           *DynamicHeader
 	bat              *BlockAllocationTable
@@ -108,6 +137,9 @@ func NewDynamicDisk(fh io.ReadSeeker, footer *Footer) (*DynamicDisk, error) {
 	return d, nil
 }
 
+// ReadSectors reads from the blocks of the disk. Unallocated blocks, and
+// sectors of differencing disks not marked in the sector bitmap, come from
+// the parent or read as zeros.
 func (d *DynamicDisk) ReadSectors(sector int64, count int) ([]byte, error) {
 	var result bytes.Buffer
 	for count > 0 {
@@ -119,14 +151,12 @@ func (d *DynamicDisk) ReadSectors(sector int64, count int) ([]byte, error) {
 			return nil, err
 		}
 
-		boff := int64(sectorOffset) + int64(d.sectorBitmapSize) + offset
-		_, err = d.fh.Seek(int64(boff*SECTOR_SIZE), io.SeekStart)
-		if err != nil {
-			return nil, err
+		var buf []byte
+		if sectorOffset == 0 {
+			buf, err = d.readParent(sector, readCount)
+		} else {
+			buf, err = d.readBlock(int64(sectorOffset), sector, offset, readCount)
 		}
-
-		buf := make([]byte, readCount*SECTOR_SIZE)
-		_, err = d.fh.Read(buf)
 		if err != nil {
 			return nil, err
 		}
@@ -142,6 +172,54 @@ func (d *DynamicDisk) ReadSectors(sector int64, count int) ([]byte, error) {
 	return result.Bytes(), nil
 }
 
+func (d *DynamicDisk) readParent(sector int64, count int) ([]byte, error) {
+	if d.parent == nil {
+		return make([]byte, count*SECTOR_SIZE), nil
+	}
+	return d.parent.ReadSectors(sector, count)
+}
+
+// readBlock reads count sectors at offset of the block at blockSector.
+func (d *DynamicDisk) readBlock(blockSector, sector, offset int64, count int) ([]byte, error) {
+	boff := blockSector + int64(d.sectorBitmapSize) + offset
+	_, err := d.fh.Seek(int64(boff*SECTOR_SIZE), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, count*SECTOR_SIZE)
+	_, err = d.fh.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if d.parent == nil {
+		return buf, nil
+	}
+
+	// sectors without their bit set in the bitmap are read from the parent
+	bitmap := make([]byte, d.sectorBitmapSize*SECTOR_SIZE)
+	if _, err := d.fh.Seek(blockSector*SECTOR_SIZE, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(d.fh, bitmap); err != nil {
+		return nil, err
+	}
+	var parentData []byte
+	for i := 0; i < count; i++ {
+		bit := offset + int64(i)
+		if bitmap[bit/8]&(0x80>>(bit%8)) != 0 {
+			continue
+		}
+		if parentData == nil {
+			parentData, err = d.parent.ReadSectors(sector, count)
+			if err != nil {
+				return nil, err
+			}
+		}
+		copy(buf[i*SECTOR_SIZE:(i+1)*SECTOR_SIZE], parentData[i*SECTOR_SIZE:])
+	}
+	return buf, nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,279 @@
+package vhdx
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/asalih/go-vdisk/vhd"
+	"github.com/google/uuid"
+)
+
+const (
+	CHAIN_FORMAT_VHDX = "vhdx"
+	CHAIN_FORMAT_VHD  = "vhd"
+)
+
+var chainExtensions = []string{".vhdx", ".avhdx", ".vhd", ".avhd"}
+
+// ChainDisk is a virtual disk found while scanning for checkpoint chains.
+// Disks are linked by ids rather than by the paths stored in the parent
+// locators, so chains survive renamed or moved files.
+type ChainDisk struct {
+	Name   string
+	Format string
+	// VirtualDiskID is the VHDX virtual disk id, or the footer UniqueID of VHDs.
+	VirtualDiskID uuid.UUID
+	// DataWriteGuid is what children reference in their parent_linkage; for
+	// VHDs it is the footer UniqueID as well.
+	DataWriteGuid uuid.UUID
+	// ParentLinkage lists the ids the parent may be found by (parent_linkage
+	// and parent_linkage2), empty for base disks.
+	ParentLinkage []uuid.UUID
+	// ParentPath is the path recorded in the parent locator, for reporting.
+	ParentPath string
+
+	Parent   *ChainDisk
+	Children []*ChainDisk
+}
+
+// ChainReport is the result of a checkpoint chain scan.
+type ChainReport struct {
+	Disks []*ChainDisk
+	// Roots are the base disks, Orphans the differencing disks whose parent
+	// is not among the scanned files.
+	Roots   []*ChainDisk
+	Orphans []*ChainDisk
+	// Errors holds the files that could not be parsed.
+	Errors map[string]error
+}
+
+// HasParent reports whether d is a differencing disk.
+func (d *ChainDisk) HasParent() bool {
+	return len(d.ParentLinkage) > 0
+}
+
+// Chain returns d and its ancestors, from d down to the base disk.
+func (d *ChainDisk) Chain() []*ChainDisk {
+	var chain []*ChainDisk
+	seen := make(map[*ChainDisk]bool)
+	for disk := d; disk != nil && !seen[disk]; disk = disk.Parent {
+		seen[disk] = true
+		chain = append(chain, disk)
+	}
+	return chain
+}
+
+// DirectoryListerFn returns the names of the files in dir, relative to dir,
+// for the same storage FileAccessor opens files from.
+type DirectoryListerFn func(dir string) ([]string, error)
+
+// ScanDirectory discovers the checkpoint chains of the VHD, VHDX, AVHD and
+// AVHDX files list returns for dir. Files are opened through FileAccessor.
+func ScanDirectory(dir string, list DirectoryListerFn) (*ChainReport, error) {
+	entries, err := list(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		ext := strings.ToLower(path.Ext(entry))
+		for _, chainExt := range chainExtensions {
+			if ext == chainExt {
+				names = append(names, path.Join(dir, entry))
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return DiscoverChains(names)
+}
+
+// DiscoverChains reads the ids of the given files through FileAccessor and
+// rebuilds the parent/child tree from them.
+func DiscoverChains(names []string) (*ChainReport, error) {
+	if FileAccessor == nil {
+		return nil, ErrFileAccessorNotAvailable
+	}
+
+	report := &ChainReport{Errors: make(map[string]error)}
+	byDataWriteGuid := make(map[uuid.UUID]*ChainDisk)
+	for _, name := range names {
+		disk, err := readChainDisk(name)
+		if err != nil {
+			report.Errors[name] = err
+			continue
+		}
+		report.Disks = append(report.Disks, disk)
+		if _, ok := byDataWriteGuid[disk.DataWriteGuid]; !ok {
+			byDataWriteGuid[disk.DataWriteGuid] = disk
+		}
+	}
+
+	for _, disk := range report.Disks {
+		if !disk.HasParent() {
+			report.Roots = append(report.Roots, disk)
+			continue
+		}
+		for _, linkage := range disk.ParentLinkage {
+			parent, ok := byDataWriteGuid[linkage]
+			if ok && parent != disk && parent.Format == disk.Format {
+				disk.Parent = parent
+				parent.Children = append(parent.Children, disk)
+				break
+			}
+		}
+		if disk.Parent == nil {
+			report.Orphans = append(report.Orphans, disk)
+		}
+	}
+
+	for _, disk := range report.Disks {
+		sort.Slice(disk.Children, func(i, j int) bool { return disk.Children[i].Name < disk.Children[j].Name })
+	}
+	return report, nil
+}
+
+// Leaves returns the disks without children, the current state of each
+// chain.
+func (r *ChainReport) Leaves() []*ChainDisk {
+	var leaves []*ChainDisk
+	for _, disk := range r.Disks {
+		if len(disk.Children) == 0 {
+			leaves = append(leaves, disk)
+		}
+	}
+	return leaves
+}
+
+// Open opens the VHDX chain ending at d, using the discovered parents
+// instead of the parent locators.
+func (r *ChainReport) Open(d *ChainDisk) (*VHDX, error) {
+	chain, err := openableChain(d, CHAIN_FORMAT_VHDX)
+	if err != nil {
+		return nil, err
+	}
+
+	var vhdx *VHDX
+	for i := len(chain) - 1; i >= 0; i-- {
+		fh, err := FileAccessor(chain[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		if vhdx == nil {
+			vhdx, err = readVHDX(fh)
+		} else {
+			vhdx, err = NewVHDXWithParent(fh, vhdx)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", chain[i].Name, err)
+		}
+	}
+	return vhdx, nil
+}
+
+// OpenVHD opens the VHD chain ending at d, using the discovered parents
+// instead of the parent names stored in the dynamic headers.
+func (r *ChainReport) OpenVHD(d *ChainDisk) (*vhd.VHD, error) {
+	chain, err := openableChain(d, CHAIN_FORMAT_VHD)
+	if err != nil {
+		return nil, err
+	}
+
+	var image *vhd.VHD
+	for i := len(chain) - 1; i >= 0; i-- {
+		fh, err := FileAccessor(chain[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		if image == nil {
+			image, err = vhd.NewVHD(fh)
+		} else {
+			image, err = vhd.NewVHDWithParent(fh, image)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", chain[i].Name, err)
+		}
+	}
+	return image, nil
+}
+
+// openableChain returns the chain ending at d if it has the given format and
+// reaches a base disk.
+func openableChain(d *ChainDisk, format string) ([]*ChainDisk, error) {
+	if d.Format != format {
+		return nil, fmt.Errorf("%s is a %s disk, not %s", d.Name, d.Format, format)
+	}
+	chain := d.Chain()
+	root := chain[len(chain)-1]
+	if root.HasParent() {
+		return nil, fmt.Errorf("parent of %s not found, looked for %s", root.Name, root.ParentPath)
+	}
+	return chain, nil
+}
+
+func readChainDisk(name string) (*ChainDisk, error) {
+	fh, err := FileAccessor(name)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := fh.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	magic := make([]byte, len(VHDX_MAGIC))
+	if _, err := io.ReadFull(fh, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != VHDX_MAGIC {
+		return readVHDChainDisk(name, fh)
+	}
+
+	vhdx, err := readVHDX(fh)
+	if err != nil {
+		return nil, err
+	}
+	disk := &ChainDisk{
+		Name:          name,
+		Format:        CHAIN_FORMAT_VHDX,
+		VirtualDiskID: vhdx.id,
+		DataWriteGuid: vhdx.DataWriteGuid(),
+	}
+	if !vhdx.hasParent {
+		return disk, nil
+	}
+
+	locator, err := vhdx.parentLocator()
+	if err != nil {
+		return nil, err
+	}
+	if disk.ParentLinkage, err = locator.parentLinkage(); err != nil {
+		return nil, err
+	}
+	disk.ParentPath = locator.entries["relative_path"]
+	if disk.ParentPath == "" {
+		disk.ParentPath = locator.entries["absolute_win32_path"]
+	}
+	return disk, nil
+}
+
+func readVHDChainDisk(name string, fh io.ReadSeeker) (*ChainDisk, error) {
+	identity, err := vhd.ReadIdentity(fh)
+	if err != nil {
+		return nil, err
+	}
+	disk := &ChainDisk{
+		Name:          name,
+		Format:        CHAIN_FORMAT_VHD,
+		VirtualDiskID: identity.UniqueID,
+		DataWriteGuid: identity.UniqueID,
+	}
+	if identity.DiskType == vhd.DISK_TYPE_DIFFERENCING {
+		disk.ParentLinkage = []uuid.UUID{identity.ParentUniqueID}
+		disk.ParentPath = identity.ParentName
+	}
+	return disk, nil
+}
@@ -0,0 +1,345 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/asalih/go-vdisk/vhd"
+	"github.com/google/uuid"
+)
+
+const testBlockSize = 1 * MB
+
+// guidBytes returns the on-disk, little-endian form of a guid.
+func guidBytes(u uuid.UUID) uuid.UUID {
+	b := u
+	reverseBytes(b[0:4])
+	reverseBytes(b[4:6])
+	reverseBytes(b[6:8])
+	return b
+}
+
+func utf16LE(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, len(units)*2)
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[i*2:], u)
+	}
+	return b
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestVHDX builds a VHDX with 1 MiB blocks: metadata at 1 MiB, the BAT at
+// 2 MiB and the given blocks from 3 MiB on. A parent locator makes it a
+// differencing disk.
+func newTestVHDX(t *testing.T, size uint64, dataWriteGuid uuid.UUID, locator map[string]string, blocks map[int][]byte) []byte {
+	var image []byte
+	write := func(offset int64, v any) {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+		if end := offset + int64(buf.Len()); end > int64(len(image)) {
+			image = append(image, make([]byte, end-int64(len(image)))...)
+		}
+		copy(image[offset:], buf.Bytes())
+	}
+
+	identifier := FileIdentifier{}
+	copy(identifier.Signature[:], VHDX_MAGIC)
+	write(0, &identifier)
+	for i, sequence := range []uint64{1, 0} {
+		header := Header{SequenceNumber: sequence, DataWriteGuid: guidBytes(dataWriteGuid)}
+		copy(header.Signature[:], "head")
+		write(int64(i+1)*ALIGNMENT, &header)
+	}
+	for i := int64(3); i <= 4; i++ {
+		header := RegionTableHeader{EntryCount: 2}
+		copy(header.Signature[:], "regi")
+		write(i*ALIGNMENT, &header)
+		write(i*ALIGNMENT+16, []RegionTableEntry{
+			{Guid: guidBytes(BAT_REGION_GUID), FileOffset: 2 * MB, Length: MB, Required: 1},
+			{Guid: guidBytes(METADATA_REGION_GUID), FileOffset: MB, Length: MB, Required: 1},
+		})
+	}
+
+	flags := uint32(0)
+	if locator != nil {
+		flags = 2
+	}
+	items := []struct {
+		id   uuid.UUID
+		data any
+	}{
+		{FILE_PARAMETERS_GUID, []uint32{testBlockSize, flags}},
+		{VIRTUAL_DISK_SIZE_GUID, size},
+		{LOGICAL_SECTOR_SIZE_GUID, uint32(512)},
+		{VIRTUAL_DISK_ID_GUID, guidBytes(uuid.New())},
+	}
+	if locator != nil {
+		header := ParentLocatorHeader{LocatorType: guidBytes(VHDX_PARENT_LOCATOR_GUID), KeyValueCount: uint16(len(locator))}
+		var entries []ParentLocatorEntry
+		var strs bytes.Buffer
+		base := uint32(binary.Size(header) + len(locator)*binary.Size(ParentLocatorEntry{}))
+		for key, value := range locator {
+			k, v := utf16LE(key), utf16LE(value)
+			entry := ParentLocatorEntry{KeyOffset: base + uint32(strs.Len()), KeyLength: uint16(len(k))}
+			strs.Write(k)
+			entry.ValueOffset, entry.ValueLength = base+uint32(strs.Len()), uint16(len(v))
+			strs.Write(v)
+			entries = append(entries, entry)
+		}
+		var data bytes.Buffer
+		binary.Write(&data, binary.LittleEndian, &header)
+		binary.Write(&data, binary.LittleEndian, entries)
+		data.Write(strs.Bytes())
+		items = append(items, struct {
+			id   uuid.UUID
+			data any
+		}{PARENT_LOCATOR_GUID, data.Bytes()})
+	}
+	metadata := MetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(metadata.Signature[:], "metadata")
+	write(MB, &metadata)
+	for i, item := range items {
+		offset := uint32(ALIGNMENT + i*4096)
+		write(MB+32+int64(i)*32, &MetadataTableEntry{ItemID: guidBytes(item.id), Offset: offset, Length: uint32(binary.Size(item.data))})
+		write(MB+int64(offset), item.data)
+	}
+
+	chunkRatio := int64(1<<23) * 512 / testBlockSize
+	next := uint64(3)
+	for block := 0; block*testBlockSize < int(size); block++ {
+		entry := uint64(PAYLOAD_BLOCK_NOT_PRESENT)
+		if data, ok := blocks[block]; ok {
+			entry = PAYLOAD_BLOCK_FULLY_PRESENT | next<<20
+			write(int64(next)*MB, data)
+			next++
+		}
+		write(2*MB+(int64(block)+int64(block)/chunkRatio)*8, entry)
+	}
+	write(int64(next)*MB, []byte{})
+	return image
+}
+
+// newTestVHD builds a dynamic VHD with 64 KiB blocks, or a differencing one
+// when parentID is set. Only the sectors covered by the data of a block are
+// marked in its sector bitmap.
+func newTestVHD(t *testing.T, size uint64, uniqueID uuid.UUID, parentID uuid.UUID, parentName string, blocks map[int][]byte) []byte {
+	const blockSize = 64 * 1024
+	footer := vhd.Footer{Features: 2, Version: 0x10000, DataOffset: 512, OriginalSize: size, CurrentSize: size,
+		DiskType: vhd.DISK_TYPE_DYNAMIC, UniqueID: uniqueID}
+	copy(footer.Cookie[:], vhd.VHD_MAGIC)
+	blockCount := (size + blockSize - 1) / blockSize
+	header := vhd.DynamicHeader{DataOffset: ^uint64(0), TableOffset: 1536, HeaderVersion: 0x10000,
+		MaxTableEntries: uint32(blockCount), BlockSize: blockSize}
+	copy(header.Cookie[:], "cxsparse")
+	if parentID != uuid.Nil {
+		footer.DiskType = vhd.DISK_TYPE_DIFFERENCING
+		header.ParentUniqueID = parentID
+		for i, u := range utf16.Encode([]rune(parentName)) {
+			binary.BigEndian.PutUint16(header.ParentUnicodeName[i*2:], u)
+		}
+	}
+
+	// the Footer struct is one byte short of a sector
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &footer)
+	buf.WriteByte(0)
+	binary.Write(&buf, binary.BigEndian, &header)
+	bat := make([]uint32, (blockCount*4+511)/512*128)
+	for i := range bat {
+		bat[i] = 0xffffffff
+	}
+	next := uint32(1536/512 + len(bat)*4/512)
+	var data bytes.Buffer
+	for block := 0; block < int(blockCount); block++ {
+		blockData, ok := blocks[block]
+		if !ok {
+			continue
+		}
+		bat[block] = next
+		bitmap := make([]byte, 512)
+		for i := 0; i < len(blockData)/512; i++ {
+			bitmap[i/8] |= 0x80 >> (i % 8)
+		}
+		data.Write(bitmap)
+		data.Write(blockData)
+		data.Write(make([]byte, blockSize-len(blockData)))
+		next += 1 + blockSize/512
+	}
+	binary.Write(&buf, binary.BigEndian, bat)
+	buf.Write(data.Bytes())
+	binary.Write(&buf, binary.BigEndian, &footer)
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+func TestDiscoverChains(t *testing.T) {
+	root := t.TempDir()
+	FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.Open(filepath.Join(root, s))
+	}
+	t.Cleanup(func() { FileAccessor = nil })
+	list := func(dir string) ([]string, error) {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+		return names, nil
+	}
+
+	// a renamed VHDX base, its checkpoint and an orphaned checkpoint
+	baseGuid := uuid.New()
+	baseBlock := bytes.Repeat([]byte{0x11}, testBlockSize)
+	childBlock := bytes.Repeat([]byte{0x22}, testBlockSize)
+	writeTestFile(t, filepath.Join(root, "vm", "base-renamed.vhdx"), newTestVHDX(t, 2*MB, baseGuid, nil, map[int][]byte{0: baseBlock}))
+	writeTestFile(t, filepath.Join(root, "vm", "disk_A1B2.avhdx"), newTestVHDX(t, 2*MB, uuid.New(), map[string]string{
+		"parent_linkage":      "{" + baseGuid.String() + "}",
+		"relative_path":       `.\old-base.vhdx`,
+		"absolute_win32_path": `C:\old\old-base.vhdx`,
+	}, map[int][]byte{1: childBlock}))
+	writeTestFile(t, filepath.Join(root, "vm", "orphan.avhdx"), newTestVHDX(t, 2*MB, uuid.New(), map[string]string{
+		"parent_linkage": uuid.New().String(),
+		"relative_path":  `.\missing.vhdx`,
+	}, nil))
+
+	// a VHD chain whose parent was moved next to the child
+	parentID, childID := uuid.New(), uuid.New()
+	parentData := append(bytes.Repeat([]byte{0x44}, 64*1024), bytes.Repeat([]byte{0x55}, 64*1024)...)
+	childData := bytes.Repeat([]byte{0x33}, 10*512)
+	writeTestFile(t, filepath.Join(root, "vm", "parent.vhd"), newTestVHD(t, 2*64*1024, parentID, uuid.Nil, "", map[int][]byte{
+		0: parentData[:64*1024], 1: parentData[64*1024:],
+	}))
+	writeTestFile(t, filepath.Join(root, "vm", "child.avhd"), newTestVHD(t, 2*64*1024, childID, parentID, `D:\moved\away\parent.vhd`, map[int][]byte{1: childData}))
+
+	writeTestFile(t, filepath.Join(root, "vm", "notes.txt"), []byte("not a disk"))
+	writeTestFile(t, filepath.Join(root, "vm", "broken.vhdx"), []byte("vhdxfile but nothing else"))
+
+	report, err := ScanDirectory("vm", list)
+	if err != nil {
+		t.Fatalf("ScanDirectory() error = %v", err)
+	}
+	names := func(disks []*ChainDisk) string {
+		var n []string
+		for _, disk := range disks {
+			n = append(n, disk.Name)
+		}
+		return strings.Join(n, ",")
+	}
+	if got, want := names(report.Disks), "vm/base-renamed.vhdx,vm/child.avhd,vm/disk_A1B2.avhdx,vm/orphan.avhdx,vm/parent.vhd"; got != want {
+		t.Fatalf("Disks = %s, want %s", got, want)
+	}
+	if _, ok := report.Errors["vm/broken.vhdx"]; !ok || len(report.Errors) != 1 {
+		t.Fatalf("Errors = %v, want vm/broken.vhdx", report.Errors)
+	}
+	if got, want := names(report.Roots), "vm/base-renamed.vhdx,vm/parent.vhd"; got != want {
+		t.Fatalf("Roots = %s, want %s", got, want)
+	}
+	if got, want := names(report.Orphans), "vm/orphan.avhdx"; got != want {
+		t.Fatalf("Orphans = %s, want %s", got, want)
+	}
+	if got, want := names(report.Leaves()), "vm/child.avhd,vm/disk_A1B2.avhdx,vm/orphan.avhdx"; got != want {
+		t.Fatalf("Leaves() = %s, want %s", got, want)
+	}
+
+	byName := make(map[string]*ChainDisk)
+	for _, disk := range report.Disks {
+		byName[disk.Name] = disk
+	}
+	if got := byName["vm/disk_A1B2.avhdx"].ParentPath; got != `.\old-base.vhdx` {
+		t.Fatalf("ParentPath = %q", got)
+	}
+
+	vhdxImage, err := report.Open(byName["vm/disk_A1B2.avhdx"])
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	got := make([]byte, vhdxImage.Size())
+	if _, err := vhdxImage.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, append(baseBlock, childBlock...)) {
+		t.Fatal("VHDX chain data does not match")
+	}
+
+	// NewVHDXWithParent only accepts the parent named by parent_linkage
+	writeTestFile(t, filepath.Join(root, "other.vhdx"), newTestVHDX(t, 2*MB, uuid.New(), nil, nil))
+	open := func(name string) io.ReadSeeker {
+		fh, err := FileAccessor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fh
+	}
+	base, err := NewVHDX(open("vm/base-renamed.vhdx"))
+	if err != nil {
+		t.Fatalf("NewVHDX() error = %v", err)
+	}
+	if _, err := NewVHDXWithParent(open("vm/disk_A1B2.avhdx"), base); err != nil {
+		t.Fatalf("NewVHDXWithParent() error = %v", err)
+	}
+	other, err := NewVHDX(open("other.vhdx"))
+	if err != nil {
+		t.Fatalf("NewVHDX() error = %v", err)
+	}
+	if _, err := NewVHDXWithParent(open("vm/disk_A1B2.avhdx"), other); err == nil || !strings.Contains(err.Error(), "does not match parent_linkage") {
+		t.Fatalf("NewVHDXWithParent() error = %v, want a parent_linkage mismatch", err)
+	}
+
+	vhdImage, err := report.OpenVHD(byName["vm/child.avhd"])
+	if err != nil {
+		t.Fatalf("OpenVHD() error = %v", err)
+	}
+	got = make([]byte, vhdImage.Size())
+	if _, err := vhdImage.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	want := bytes.Clone(parentData)
+	copy(want[64*1024:], childData)
+	if !bytes.Equal(got, want) {
+		t.Fatal("VHD chain data does not match")
+	}
+
+	if _, err := report.Open(byName["vm/orphan.avhdx"]); err == nil {
+		t.Fatal("Open() opened an orphaned disk")
+	}
+	if _, err := report.Open(byName["vm/child.avhd"]); err == nil {
+		t.Fatal("Open() opened a VHD chain")
+	}
+	if _, err := report.OpenVHD(byName["vm/disk_A1B2.avhdx"]); err == nil {
+		t.Fatal("OpenVHD() opened a VHDX chain")
+	}
+
+	// a parent moved to another directory is found by its id as well
+	if err := os.Rename(filepath.Join(root, "vm", "base-renamed.vhdx"), filepath.Join(root, "archive.vhdx")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = DiscoverChains([]string{"vm/disk_A1B2.avhdx", "archive.vhdx"})
+	if err != nil {
+		t.Fatalf("DiscoverChains() error = %v", err)
+	}
+	if len(report.Orphans) != 0 || report.Disks[0].Parent != report.Disks[1] {
+		t.Fatalf("moved parent was not linked: orphans %s", names(report.Orphans))
+	}
+}
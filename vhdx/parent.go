@@ -2,6 +2,8 @@ package vhdx
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/google/uuid"
@@ -69,3 +71,24 @@ func NewParentLocator(fh io.ReadSeeker) (*ParentLocator, error) {
 		entries: entries,
 	}, nil
 }
+
+// parentLinkage returns the ids the parent may be found by: parent_linkage
+// and, when present, parent_linkage2.
+func (pl *ParentLocator) parentLinkage() ([]uuid.UUID, error) {
+	var linkage []uuid.UUID
+	for _, key := range []string{"parent_linkage", "parent_linkage2"} {
+		value, ok := pl.entries[key]
+		if !ok {
+			continue
+		}
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", key, value, err)
+		}
+		linkage = append(linkage, id)
+	}
+	if len(linkage) == 0 {
+		return nil, errors.New("parent locator has no parent_linkage")
+	}
+	return linkage, nil
+}
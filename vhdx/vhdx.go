@@ -9,6 +9,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/google/uuid"
@@ -86,8 +87,61 @@ func NewVHDX(fh io.ReadSeeker) (*VHDX, error) {
 		return nil, ErrFileAccessorNotAvailable
 	}
 
+	vhdx, err := readVHDX(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle parent locator if exists
+	if vhdx.hasParent {
+		parentLocatorEntry, err := vhdx.parentLocator()
+		if err != nil {
+			return nil, err
+		}
+		parent, err := openParent(parentLocatorEntry.entries)
+		if err != nil {
+			return nil, err
+		}
+		vhdx.parent = parent
+	}
+
+	return vhdx, nil
+}
+
+// NewVHDXWithParent opens a differencing disk on top of an already opened
+// parent instead of resolving the parent locator. The DataWriteGuid of the
+// parent must match the parent_linkage or parent_linkage2 of the child.
+func NewVHDXWithParent(fh io.ReadSeeker, parent *VHDX) (*VHDX, error) {
+	vhdx, err := readVHDX(fh)
+	if err != nil {
+		return nil, err
+	}
+	if !vhdx.hasParent {
+		return nil, errors.New("vhdx is not a differencing disk")
+	}
+	locator, err := vhdx.parentLocator()
+	if err != nil {
+		return nil, err
+	}
+	linkage, err := locator.parentLinkage()
+	if err != nil {
+		return nil, err
+	}
+	if parentID := parent.DataWriteGuid(); !slices.Contains(linkage, parentID) {
+		return nil, fmt.Errorf("parent data write guid %s does not match parent_linkage %s", parentID, linkage[0])
+	}
+	vhdx.parent = parent
+	return vhdx, nil
+}
+
+// readVHDX parses headers, region tables, metadata and the BAT location
+// without opening the parent of differencing disks.
+func readVHDX(fh io.ReadSeeker) (*VHDX, error) {
 	vhdx := &VHDX{fh: fh}
 
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
 	if err := binary.Read(fh, binary.LittleEndian, &vhdx.fileIdentifier); err != nil {
 		return nil, err
 	}
@@ -150,19 +204,6 @@ func NewVHDX(fh io.ReadSeeker) (*VHDX, error) {
 	vhdx.sectorsPerBlock = int(vhdx.blockSize / vhdx.sectorSize)
 	vhdx.chunkRatio = (int64(math.Pow(2, 23)) * int64(vhdx.sectorSize)) / int64(vhdx.blockSize)
 
-	// Handle parent locator if exists
-	if vhdx.hasParent {
-		parentLocatorEntry := vhdx.metadata.lookup[PARENT_LOCATOR_GUID].(*ParentLocator)
-		if !bytes.Equal(parentLocatorEntry.typeID[:], VHDX_PARENT_LOCATOR_GUID[:]) {
-			return nil, fmt.Errorf("unknown parent locator type: %v", parentLocatorEntry.typeID)
-		}
-		parent, err := openParent(parentLocatorEntry.entries)
-		if err != nil {
-			return nil, err
-		}
-		vhdx.parent = parent
-	}
-
 	// Read BAT
 	batEntry, ok := vhdx.regionTable.lookup[BAT_REGION_GUID]
 	if !ok {
@@ -173,6 +214,18 @@ func NewVHDX(fh io.ReadSeeker) (*VHDX, error) {
 	return vhdx, nil
 }
 
+// parentLocator returns the VHDX parent locator of a differencing disk.
+func (v *VHDX) parentLocator() (*ParentLocator, error) {
+	parentLocatorEntry, ok := v.metadata.lookup[PARENT_LOCATOR_GUID].(*ParentLocator)
+	if !ok {
+		return nil, errors.New("missing parent locator metadata")
+	}
+	if !bytes.Equal(parentLocatorEntry.typeID[:], VHDX_PARENT_LOCATOR_GUID[:]) {
+		return nil, fmt.Errorf("unknown parent locator type: %v", parentLocatorEntry.typeID)
+	}
+	return parentLocatorEntry, nil
+}
+
 func (v *VHDX) ReadSectors(sector int64, count int64) ([]byte, error) {
 	var sectorsRead bytes.Buffer
 
@@ -317,3 +370,15 @@ func openParent(locator map[string]string) (*VHDX, error) {
 
 	return NewVHDX(fhp)
 }
+
+// ID returns the virtual disk id from the metadata region.
+func (v *VHDX) ID() uuid.UUID {
+	return v.id
+}
+
+// DataWriteGuid returns the data write guid of the current header, which
+// differencing children record as their parent_linkage.
+func (v *VHDX) DataWriteGuid() uuid.UUID {
+	guid := v.header.DataWriteGuid
+	return newUUIDFromBytesLE(guid[:])
+}
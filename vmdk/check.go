@@ -0,0 +1,136 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// GrainIssue describes an inconsistency found in the grain directory or
+// grain tables of a sparse extent.
+type GrainIssue struct {
+	Extent    int
+	Directory int64
+	Table     int64
+	Sector    uint64
+	Redundant bool
+	Reason    string
+}
+
+func (g GrainIssue) String() string {
+	return fmt.Sprintf("extent %d, gd entry %d, gt entry %d (sector %d): %s", g.Extent, g.Directory, g.Table, g.Sector, g.Reason)
+}
+
+// UsingRedundantGrainDirectory reports whether the extent is read through
+// the redundant grain directory because the primary one is damaged.
+func (sd *SparseDisk) UsingRedundantGrainDirectory() bool {
+	return sd.usingRedundantGD
+}
+
+// Check validates the primary and redundant grain directories of a hosted
+// sparse extent against each other and against the size of the extent.
+func (sd *SparseDisk) Check() ([]GrainIssue, error) {
+	h, ok := sd.header.AsVMDK()
+	if !ok {
+		return nil, fmt.Errorf("checking %q sparse extents is not supported", sd.header.Magic)
+	}
+
+	var issues []GrainIssue
+	sectors := uint64((sd.fileSize + SECTOR_SIZE - 1) / SECTOR_SIZE)
+	grainSize := h.GrainSize
+
+	if sd.usingRedundantGD {
+		issues = append(issues, GrainIssue{Directory: -1, Table: -1, Sector: h.PrimaryGrainDirectoryOffset,
+			Reason: "primary grain directory is damaged, using redundant copy"})
+	}
+
+	primary, err := sd.readGrainDirectory(int64(h.PrimaryGrainDirectoryOffset))
+	if err != nil {
+		primary = nil
+	}
+	var redundant []uint64
+	if h.SecondaryGrainDirectoryOffset != 0 {
+		redundant, err = sd.readGrainDirectory(int64(h.SecondaryGrainDirectoryOffset))
+		if err != nil {
+			issues = append(issues, GrainIssue{Directory: -1, Table: -1, Sector: h.SecondaryGrainDirectoryOffset, Redundant: true,
+				Reason: fmt.Sprintf("redundant grain directory is unreadable: %v", err)})
+			redundant = nil
+		}
+	}
+
+	readTable := func(offset uint64) ([]uint32, error) {
+		if _, err := sd.fh.Seek(int64(offset)*SECTOR_SIZE, io.SeekStart); err != nil {
+			return nil, err
+		}
+		table := make([]uint32, sd.grainTableSize)
+		err := binary.Read(sd.fh, binary.LittleEndian, &table)
+		return table, err
+	}
+
+	gtSectors := uint64(sd.grainTableSize*4+SECTOR_SIZE-1) / SECTOR_SIZE
+	for dir := range sd.grainDirectory {
+		var tables [2][]uint32
+		for i, gd := range [][]uint64{primary, redundant} {
+			if gd == nil || gd[dir] == 0 {
+				continue
+			}
+			if gd[dir]+gtSectors > sectors {
+				issues = append(issues, GrainIssue{Directory: int64(dir), Table: -1, Sector: gd[dir], Redundant: i == 1,
+					Reason: "grain table points past the end of the extent"})
+				continue
+			}
+			table, err := readTable(gd[dir])
+			if err != nil {
+				return nil, err
+			}
+			tables[i] = table
+
+			for entry, sector := range table {
+				if sector > 1 && uint64(sector)+grainSize > sectors {
+					issues = append(issues, GrainIssue{Directory: int64(dir), Table: int64(entry), Sector: uint64(sector), Redundant: i == 1,
+						Reason: "grain points past the end of the extent"})
+				}
+			}
+		}
+
+		if primary != nil && redundant != nil && (primary[dir] == 0) != (redundant[dir] == 0) {
+			issues = append(issues, GrainIssue{Directory: int64(dir), Table: -1,
+				Reason: "grain table is allocated in only one grain directory"})
+			continue
+		}
+		if tables[0] == nil || tables[1] == nil {
+			continue
+		}
+		for entry := range tables[0] {
+			if tables[0][entry] != tables[1][entry] {
+				issues = append(issues, GrainIssue{Directory: int64(dir), Table: int64(entry), Sector: uint64(tables[0][entry]),
+					Reason: fmt.Sprintf("primary and redundant grain tables differ (redundant points to sector %d)", tables[1][entry])})
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+// Check runs SparseDisk.Check on every hosted sparse extent of the disk.
+func (v *VMDK) Check() ([]GrainIssue, error) {
+	var issues []GrainIssue
+	for i, disk := range v.Disks {
+		sd, ok := disk.(*SparseDisk)
+		if !ok {
+			continue
+		}
+		if _, ok := sd.header.AsVMDK(); !ok {
+			continue
+		}
+		extentIssues, err := sd.Check()
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range extentIssues {
+			issue.Extent = i
+			issues = append(issues, issue)
+		}
+	}
+	return issues, nil
+}
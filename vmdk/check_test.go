@@ -0,0 +1,90 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+func hasGrainIssue(issues []GrainIssue, reason string) bool {
+	for _, issue := range issues {
+		if strings.Contains(issue.Reason, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSparseDiskRedundantGrainDirectory(t *testing.T) {
+	capacity := uint64(DEFAULT_NUM_GRAIN_TABLE_ENTRIES * DEFAULT_GRAIN_SIZE)
+	fh := newTestSparseExtent(t, capacity)
+	sd, err := NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	data := newTestDiskData(300000)
+	if _, err := sd.WriteAt(data, 4096+5); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	want := make([]byte, capacity*SECTOR_SIZE)
+	copy(want[4096+5:], data)
+	h, _ := sd.header.AsVMDK()
+
+	reopen := func(t *testing.T, fh *os.File) *SparseDisk {
+		sd, err := NewSparseDisk(fh, nil)
+		if err != nil {
+			t.Fatalf("NewSparseDisk() error = %v", err)
+		}
+		got, err := sd.ReadSectors(0, int(capacity))
+		if err != nil {
+			t.Fatalf("ReadSectors() error = %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("ReadSectors() data does not match written data")
+		}
+		return sd
+	}
+
+	sd = reopen(t, fh)
+	if issues, err := sd.Check(); err != nil || len(issues) != 0 {
+		t.Fatalf("Check() = %v, %v, want no issues", issues, err)
+	}
+
+	// a grain table entry pointing past the end of the extent
+	gtEntry := make([]byte, 4)
+	if _, err := fh.ReadAt(gtEntry, int64(h.PrimaryGrainDirectoryOffset)*SECTOR_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	gtOffset := int64(binary.LittleEndian.Uint32(gtEntry)) * SECTOR_SIZE
+	if _, err := fh.WriteAt([]byte{0xff, 0xff, 0xff, 0x00}, gtOffset+8*4); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := sd.Check()
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if !hasGrainIssue(issues, "grain points past the end") || !hasGrainIssue(issues, "grain tables differ") {
+		t.Fatalf("Check() = %v, want a damaged grain table entry", issues)
+	}
+
+	// a primary grain directory pointing past the end of the extent
+	if _, err := fh.WriteAt([]byte{0xff, 0xff, 0xff, 0x00}, int64(h.PrimaryGrainDirectoryOffset)*SECTOR_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	sd = reopen(t, fh)
+	if !sd.UsingRedundantGrainDirectory() {
+		t.Fatal("UsingRedundantGrainDirectory() = false")
+	}
+	issues, err = sd.Check()
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if !hasGrainIssue(issues, "primary grain directory is damaged") || !hasGrainIssue(issues, "grain table points past the end") {
+		t.Fatalf("Check() = %v, want a damaged primary grain directory", issues)
+	}
+	if err := sd.WriteSectors(0, make([]byte, SECTOR_SIZE)); err == nil {
+		t.Fatal("WriteSectors() wrote through a damaged primary grain directory")
+	}
+}
@@ -0,0 +1,122 @@
+package vmdk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Consolidate writes the contents of the chain ending at v into a new disk
+// without parent. createType is any type Create supports, usually
+// monolithicSparse or monolithicFlat. Grains that are all zeros are not
+// written, so sparse targets only hold the data the chain holds.
+func (v *VMDK) Consolidate(name string, createType string) error {
+	if FileAccessor == nil {
+		return ErrFileAccessorNotAvailable
+	}
+
+	opts := &CreateOptions{CreateType: createType, Capacity: v.Size}
+	if descriptor := v.descriptor(); descriptor != nil {
+		opts.AdapterType = descriptor.Ddb["ddb.adapterType"]
+	}
+	if err := Create(name, opts); err != nil {
+		return err
+	}
+
+	fh, err := FileAccessor(name)
+	if err != nil {
+		return err
+	}
+	target, err := NewVMDK([]io.ReadSeeker{fh})
+	if err != nil {
+		return err
+	}
+
+	sectors := v.Size / SECTOR_SIZE
+	zero := make([]byte, DEFAULT_GRAIN_SIZE*SECTOR_SIZE)
+	for sector := int64(0); sector < sectors; sector += DEFAULT_GRAIN_SIZE {
+		count := min(DEFAULT_GRAIN_SIZE, sectors-sector)
+		data, err := v.ReadSectors(sector, int(count))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(data, zero[:len(data)]) {
+			continue
+		}
+		if err := target.WriteSectors(sector, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit writes the grains held by the top delta of v into its parent in
+// place. The parent gets a new CID, so v and any other delta based on the
+// parent are no longer valid afterwards and should be removed.
+func (v *VMDK) Commit() error {
+	parent := v.parent()
+	if parent == nil {
+		return errors.New("disk has no parent to commit into")
+	}
+	if parent.Size != v.Size {
+		return fmt.Errorf("parent size %d does not match delta size %d", parent.Size, v.Size)
+	}
+
+	for _, disk := range v.Disks {
+		sd, ok := disk.(*SparseDisk)
+		if !ok {
+			return fmt.Errorf("cannot commit %T extents, only sparse deltas", disk)
+		}
+		err := sd.mappedGrains(func(sector, count int64) error {
+			data, err := sd.ReadSectors(sector, int(count))
+			if err != nil {
+				return err
+			}
+			return parent.WriteSectors(sector, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parent returns the disk the top delta of v falls through to, either from
+// the descriptor file or the descriptor embedded in a sparse extent.
+func (v *VMDK) parent() *VMDK {
+	if v.Parent != nil {
+		return v.Parent
+	}
+	for _, disk := range v.Disks {
+		if sd, ok := disk.(*SparseDisk); ok && sd.parent != nil {
+			return sd.parent
+		}
+	}
+	return nil
+}
+
+// mappedGrains calls fn for every grain the extent holds data or zeros for,
+// with sectors of the virtual disk.
+func (sd *SparseDisk) mappedGrains(fn func(sector, count int64) error) error {
+	grainSize := int64(sd.header.Raw.GetGrainSize())
+	for directory := range sd.grainDirectory {
+		table, err := sd.lookupGrainTable(int64(directory))
+		if err != nil {
+			return err
+		}
+		for i, entry := range table {
+			if sd.grainSector(entry) == 0 {
+				continue
+			}
+			start := (int64(directory)*sd.grainTableSize + int64(i)) * grainSize
+			if start >= sd.sectorCount {
+				break
+			}
+			if err := fn(sd.sectorOffset+start, min(grainSize, sd.sectorCount-start)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package vmdk
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func openTestDisk(t *testing.T, name string) *VMDK {
+	fh, err := FileAccessor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, err := NewVMDK([]io.ReadSeeker{fh})
+	if err != nil {
+		t.Fatalf("NewVMDK(%s) error = %v", name, err)
+	}
+	return disk
+}
+
+func readTestDisk(t *testing.T, disk *VMDK) []byte {
+	data := make([]byte, disk.Size)
+	if _, err := disk.ReadAt(data, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	return data
+}
+
+// newTestChain writes a base disk and a delta on top of it and returns the
+// contents the delta exposes.
+func newTestChain(t *testing.T, capacity int64) []byte {
+	useTempDir(t)
+	if err := Create("base.vmdk", &CreateOptions{CreateType: CREATE_TYPE_MONOLITHIC_SPARSE, Capacity: capacity}); err != nil {
+		t.Fatal(err)
+	}
+	base := openTestDisk(t, "base.vmdk")
+	want := make([]byte, capacity)
+	baseData := bytes.Repeat([]byte{0x11}, 500000)
+	if _, err := base.WriteAt(baseData, 4096); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[4096:], baseData)
+
+	if err := Create("delta.vmdk", &CreateOptions{CreateType: CREATE_TYPE_TWO_GB_MAX_SPARSE, Capacity: capacity}); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := FileAccessor("base.vmdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseDescriptor, err := readDescriptor(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseCID, err := baseDescriptor.CID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err = FileAccessor("delta.vmdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor, err := readDescriptor(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor.SetParentCID(baseCID)
+	descriptor.SetParentFileNameHint("base.vmdk")
+	if err := writeDescriptor(fh.(io.WriteSeeker), descriptor); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := openTestDisk(t, "delta.vmdk")
+	deltaData := newTestDiskData(300000)
+	if _, err := delta.WriteAt(deltaData, 200000+3); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[200000+3:], deltaData)
+	return want
+}
+
+func TestConsolidate(t *testing.T) {
+	for _, createType := range []string{CREATE_TYPE_MONOLITHIC_SPARSE, CREATE_TYPE_MONOLITHIC_FLAT} {
+		t.Run(createType, func(t *testing.T) {
+			want := newTestChain(t, 2*1024*1024)
+
+			if err := openTestDisk(t, "delta.vmdk").Consolidate("flat.vmdk", createType); err != nil {
+				t.Fatalf("Consolidate() error = %v", err)
+			}
+			disk := openTestDisk(t, "flat.vmdk")
+			if disk.parent() != nil {
+				t.Fatal("consolidated disk has a parent")
+			}
+			if !bytes.Equal(readTestDisk(t, disk), want) {
+				t.Fatal("consolidated data does not match the chain")
+			}
+		})
+	}
+}
+
+func TestCommit(t *testing.T) {
+	want := newTestChain(t, 2*1024*1024)
+
+	if err := openTestDisk(t, "delta.vmdk").Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if !bytes.Equal(readTestDisk(t, openTestDisk(t, "base.vmdk")), want) {
+		t.Fatal("parent data does not match the chain after commit")
+	}
+}
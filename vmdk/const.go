@@ -7,12 +7,38 @@ const (
 	SESPARSE_MAGIC    = "\xbe\xba\xfe\xca"
 	CONFIG_FILE_MAGIC = "# Di"
 
-	SPARSEFLAG_COMPRESSED   = 0x10000
-	SPARSEFLAG_EMBEDDED_LBA = 0x20000
+	SPARSEFLAG_VALID_NEWLINE_DETECTOR = 0x1
+	SPARSEFLAG_USE_REDUNDANT          = 0x2
+	SPARSEFLAG_COMPRESSED             = 0x10000
+	SPARSEFLAG_EMBEDDED_LBA           = 0x20000
+
+	SPARSE_COMPRESSALGORITHM_DEFLATE = 1
+	SPARSE_GD_AT_END                 = 0xFFFFFFFFFFFFFFFF
+
+	MARKER_EOS    = 0
+	MARKER_GT     = 1
+	MARKER_GD     = 2
+	MARKER_FOOTER = 3
 
 	SESPARSE_GRAIN_TYPE_MASK        = 0xF000000000000000
 	SESPARSE_GRAIN_TYPE_UNALLOCATED = 0x0000000000000000
 	SESPARSE_GRAIN_TYPE_FALLTHROUGH = 0x1000000000000000
 	SESPARSE_GRAIN_TYPE_ZERO        = 0x2000000000000000
 	SESPARSE_GRAIN_TYPE_ALLOCATED   = 0x3000000000000000
+
+	CREATE_TYPE_MONOLITHIC_SPARSE   = "monolithicSparse"
+	CREATE_TYPE_MONOLITHIC_FLAT     = "monolithicFlat"
+	CREATE_TYPE_TWO_GB_MAX_SPARSE   = "twoGbMaxExtentSparse"
+	CREATE_TYPE_TWO_GB_MAX_FLAT     = "twoGbMaxExtentFlat"
+	CREATE_TYPE_STREAM_OPTIMIZED    = "streamOptimized"
+	CREATE_TYPE_VMFS                = "vmfs"
+	CREATE_TYPE_VMFS_THIN           = "vmfsThin"
+	CREATE_TYPE_VMFS_RDM            = "vmfsRawDeviceMap"
+	CREATE_TYPE_VMFS_RDMP           = "vmfsPassthroughRawDeviceMap"
+	CREATE_TYPE_PARTITIONED_DEVICE  = "partitionedDevice"
+	CREATE_TYPE_FULL_DEVICE         = "fullDevice"
+	TWO_GB_MAX_EXTENT_SECTORS       = 4192256
+	EMBEDDED_DESCRIPTOR_SECTORS     = 20
+	DEFAULT_GRAIN_SIZE              = 128
+	DEFAULT_NUM_GRAIN_TABLE_ENTRIES = 512
 )
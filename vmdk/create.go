@@ -0,0 +1,229 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type FileCreatorFn func(string) (io.WriteSeeker, error)
+
+// FileCreator creates the descriptor and extent files of new disks, in the
+// same way FileAccessor opens them.
+var FileCreator FileCreatorFn
+
+var ErrFileCreatorNotAvailable = errors.New("file creator needed to create descriptor and extent files")
+
+type CreateOptions struct {
+	CreateType string
+	// Capacity of the virtual disk in bytes, rounded up to whole sectors.
+	Capacity    int64
+	AdapterType string
+	// GrainSize in sectors for sparse extents, defaults to 128.
+	GrainSize uint64
+}
+
+// Create writes a new, empty VMDK. name is the descriptor file name (or the
+// only file for monolithicSparse); extent files are named after it the way
+// VMware names them.
+func Create(name string, opts *CreateOptions) error {
+	if FileCreator == nil {
+		return ErrFileCreatorNotAvailable
+	}
+	if opts == nil || opts.Capacity <= 0 {
+		return errors.New("capacity is required to create a vmdk")
+	}
+	grainSize := opts.GrainSize
+	if grainSize == 0 {
+		grainSize = DEFAULT_GRAIN_SIZE
+	}
+	capacity := uint64(opts.Capacity+SECTOR_SIZE-1) / SECTOR_SIZE
+	base := strings.TrimSuffix(name, ".vmdk")
+
+	var extents []DiskExtent
+	switch opts.CreateType {
+	case CREATE_TYPE_MONOLITHIC_SPARSE:
+		extents = []DiskExtent{{AccessType: "RW", Size: int64(capacity), ExtentType: "SPARSE", Filename: baseName(name)}}
+		descriptor := newDescriptorText(opts.CreateType, capacity, opts.AdapterType, extents)
+		return createFile(name, func(w io.WriteSeeker) error {
+			return writeSparseExtent(w, capacity, grainSize, []byte(descriptor))
+		})
+
+	case CREATE_TYPE_MONOLITHIC_FLAT, CREATE_TYPE_VMFS, CREATE_TYPE_VMFS_THIN:
+		extentType := "FLAT"
+		if opts.CreateType != CREATE_TYPE_MONOLITHIC_FLAT {
+			extentType = "VMFS"
+		}
+		extents = []DiskExtent{{AccessType: "RW", Size: int64(capacity), ExtentType: extentType, Filename: baseName(base) + "-flat.vmdk"}}
+		if err := createFile(base+"-flat.vmdk", func(w io.WriteSeeker) error {
+			return writeFlatExtent(w, int64(capacity)*SECTOR_SIZE)
+		}); err != nil {
+			return err
+		}
+
+	case CREATE_TYPE_TWO_GB_MAX_SPARSE, CREATE_TYPE_TWO_GB_MAX_FLAT:
+		sparse := opts.CreateType == CREATE_TYPE_TWO_GB_MAX_SPARSE
+		for i, remaining := 1, capacity; remaining > 0; i++ {
+			size := min(remaining, TWO_GB_MAX_EXTENT_SECTORS)
+			remaining -= size
+
+			var extentName string
+			var write func(w io.WriteSeeker) error
+			if sparse {
+				extentName = fmt.Sprintf("%s-s%03d.vmdk", base, i)
+				extents = append(extents, DiskExtent{AccessType: "RW", Size: int64(size), ExtentType: "SPARSE", Filename: baseName(extentName)})
+				write = func(w io.WriteSeeker) error {
+					return writeSparseExtent(w, size, grainSize, nil)
+				}
+			} else {
+				extentName = fmt.Sprintf("%s-f%03d.vmdk", base, i)
+				extents = append(extents, DiskExtent{AccessType: "RW", Size: int64(size), ExtentType: "FLAT", Filename: baseName(extentName)})
+				write = func(w io.WriteSeeker) error {
+					return writeFlatExtent(w, int64(size)*SECTOR_SIZE)
+				}
+			}
+			if err := createFile(extentName, write); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("unsupported create type: %s", opts.CreateType)
+	}
+
+	descriptor := newDescriptorText(opts.CreateType, capacity, opts.AdapterType, extents)
+	return createFile(name, func(w io.WriteSeeker) error {
+		_, err := w.Write([]byte(descriptor))
+		return err
+	})
+}
+
+func createFile(name string, write func(w io.WriteSeeker) error) error {
+	w, err := FileCreator(name)
+	if err != nil {
+		return err
+	}
+	err = write(w)
+	if c, ok := w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// writeFlatExtent extends w to size bytes without writing the data, so file
+// systems supporting it keep the extent sparse.
+func writeFlatExtent(w io.WriteSeeker, size int64) error {
+	if t, ok := w.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(size)
+	}
+	if size == 0 {
+		return nil
+	}
+	if _, err := w.Seek(size-1, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// writeSparseExtent writes a hosted sparse extent with preallocated primary
+// and redundant grain tables and, if given, an embedded descriptor.
+func writeSparseExtent(w io.WriteSeeker, capacity, grainSize uint64, descriptor []byte) error {
+	numGTEsPerGT := uint64(DEFAULT_NUM_GRAIN_TABLE_ENTRIES)
+	gtCount := (capacity + numGTEsPerGT*grainSize - 1) / (numGTEsPerGT * grainSize)
+	gdSectors := (gtCount*4 + SECTOR_SIZE - 1) / SECTOR_SIZE
+	gtSectors := numGTEsPerGT * 4 / SECTOR_SIZE
+
+	descriptorOffset, descriptorSectors := uint64(0), uint64(0)
+	if descriptor != nil {
+		descriptorOffset, descriptorSectors = 1, EMBEDDED_DESCRIPTOR_SECTORS
+		if uint64(len(descriptor)) > descriptorSectors*SECTOR_SIZE {
+			return errors.New("descriptor does not fit into the embedded descriptor area")
+		}
+	}
+
+	rgdOffset := 1 + descriptorSectors
+	gdOffset := rgdOffset + gdSectors + gtCount*gtSectors
+	overhead := gdOffset + gdSectors + gtCount*gtSectors
+	overhead = (overhead + grainSize - 1) / grainSize * grainSize
+
+	header := VMDKSparseExtentHeader{
+		Version:                       1,
+		Flags:                         SPARSEFLAG_VALID_NEWLINE_DETECTOR | SPARSEFLAG_USE_REDUNDANT,
+		Capacity:                      capacity,
+		GrainSize:                     grainSize,
+		DescriptorOffset:              descriptorOffset,
+		DescriptorSize:                descriptorSectors,
+		NumGrainTableEntries:          uint32(numGTEsPerGT),
+		SecondaryGrainDirectoryOffset: rgdOffset,
+		PrimaryGrainDirectoryOffset:   gdOffset,
+		Overhead:                      overhead,
+		SingleEndLineChar:             '\n',
+		NonEndLineChar:                ' ',
+		DoubleEndLineChars:            [2]byte{'\r', '\n'},
+	}
+	copy(header.Magic[:], VMDK_MAGIC)
+
+	buf := bytes.NewBuffer(make([]byte, 0, overhead*SECTOR_SIZE))
+	if err := binary.Write(buf, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if descriptor != nil {
+		area := make([]byte, descriptorSectors*SECTOR_SIZE)
+		copy(area, descriptor)
+		buf.Write(area)
+	}
+	for _, directory := range []uint64{rgdOffset, gdOffset} {
+		gd := make([]uint32, gdSectors*SECTOR_SIZE/4)
+		for i := uint64(0); i < gtCount; i++ {
+			gd[i] = uint32(directory + gdSectors + i*gtSectors)
+		}
+		buf.Write(uint32Bytes(gd))
+		buf.Write(make([]byte, gtCount*gtSectors*SECTOR_SIZE))
+	}
+	buf.Write(make([]byte, overhead*SECTOR_SIZE-uint64(buf.Len())))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// newDescriptorText renders a DiskDescriptor file for a disk without parent.
+func newDescriptorText(createType string, capacity uint64, adapterType string, extents []DiskExtent) string {
+	if adapterType == "" {
+		adapterType = "lsilogic"
+	}
+	cylinders, heads, sectors := diskGeometry(capacity, adapterType)
+
+	var sb bytes.Buffer
+	sb.WriteString("# Disk DescriptorFile\n")
+	sb.WriteString("version=1\n")
+	sb.WriteString("encoding=\"UTF-8\"\n")
+	fmt.Fprintf(&sb, "CID=%08x\n", newCID())
+	sb.WriteString("parentCID=ffffffff\n")
+	fmt.Fprintf(&sb, "createType=\"%s\"\n", createType)
+	sb.WriteString("\n# Extent description\n")
+	for _, extent := range extents {
+		sb.WriteString(formatExtentLine(extent, extent.ExtentType == "FLAT", true))
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n# The Disk Data Base\n#DDB\n\n")
+	sb.WriteString("ddb.virtualHWVersion = \"4\"\n")
+	fmt.Fprintf(&sb, "ddb.geometry.cylinders = \"%d\"\n", cylinders)
+	fmt.Fprintf(&sb, "ddb.geometry.heads = \"%d\"\n", heads)
+	fmt.Fprintf(&sb, "ddb.geometry.sectors = \"%d\"\n", sectors)
+	fmt.Fprintf(&sb, "ddb.adapterType = \"%s\"\n", adapterType)
+	if createType == CREATE_TYPE_VMFS_THIN {
+		sb.WriteString("ddb.thinProvisioned = \"1\"\n")
+	}
+	return sb.String()
+}
+
+func baseName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return name[strings.LastIndex(name, "/")+1:]
+}
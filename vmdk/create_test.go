@@ -0,0 +1,86 @@
+package vmdk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func useTempDir(t *testing.T) string {
+	dir := t.TempDir()
+	FileAccessor = func(s string) (io.ReadSeeker, error) {
+		return os.OpenFile(filepath.Join(dir, s), os.O_RDWR, 0)
+	}
+	FileCreator = func(s string) (io.WriteSeeker, error) {
+		return os.Create(filepath.Join(dir, s))
+	}
+	t.Cleanup(func() {
+		FileAccessor = nil
+		FileCreator = nil
+	})
+	return dir
+}
+
+func TestCreateWriteRead(t *testing.T) {
+	for _, createType := range []string{
+		CREATE_TYPE_MONOLITHIC_SPARSE,
+		CREATE_TYPE_MONOLITHIC_FLAT,
+		CREATE_TYPE_TWO_GB_MAX_SPARSE,
+		CREATE_TYPE_TWO_GB_MAX_FLAT,
+		CREATE_TYPE_VMFS,
+		CREATE_TYPE_VMFS_THIN,
+	} {
+		t.Run(createType, func(t *testing.T) {
+			useTempDir(t)
+
+			capacity := int64(3*1024*1024 + 7*SECTOR_SIZE)
+			if err := Create("test.vmdk", &CreateOptions{CreateType: createType, Capacity: capacity}); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			fh, err := FileAccessor("test.vmdk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			disk, err := NewVMDK([]io.ReadSeeker{fh})
+			if err != nil {
+				t.Fatalf("NewVMDK() error = %v", err)
+			}
+			if disk.Size != capacity {
+				t.Fatalf("Size = %d, want %d", disk.Size, capacity)
+			}
+			if got := disk.descriptor().Attr["createType"]; got != createType {
+				t.Fatalf("createType = %q, want %q", got, createType)
+			}
+
+			if createType != CREATE_TYPE_MONOLITHIC_SPARSE && createType != CREATE_TYPE_TWO_GB_MAX_SPARSE {
+				return
+			}
+
+			data := newTestDiskData(200000)
+			if _, err := disk.WriteAt(data, 1000000+13); err != nil {
+				t.Fatalf("WriteAt() error = %v", err)
+			}
+
+			fh, err = FileAccessor("test.vmdk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			disk, err = NewVMDK([]io.ReadSeeker{fh})
+			if err != nil {
+				t.Fatalf("NewVMDK() error = %v", err)
+			}
+			got := make([]byte, capacity)
+			if _, err := disk.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() error = %v", err)
+			}
+			want := make([]byte, capacity)
+			copy(want[1000000+13:], data)
+			if !bytes.Equal(got, want) {
+				t.Fatal("ReadAt() data does not match written data")
+			}
+		})
+	}
+}
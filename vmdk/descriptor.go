@@ -2,6 +2,7 @@ package vmdk
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -14,33 +15,80 @@ type DiskExtent struct {
 	StartSector int64
 }
 
+type DescriptorLineKind int
+
+const (
+	DESCRIPTOR_LINE_TEXT DescriptorLineKind = iota
+	DESCRIPTOR_LINE_ATTR
+	DESCRIPTOR_LINE_EXTENT
+	DESCRIPTOR_LINE_DDB
+)
+
+// DescriptorLine keeps the position and formatting of a descriptor line so
+// the descriptor can be written back with comments and ordering intact.
+type DescriptorLine struct {
+	Kind DescriptorLineKind
+	// Text is the verbatim line for comments, blank and unparsed lines.
+	Text string
+	// Key and Prefix (everything up to the value, e.g. `ddb.uuid = `) for
+	// attribute and ddb lines; the value itself lives in Attr or Ddb.
+	Key    string
+	Prefix string
+	// Quoted is set when the value, or the file name of an extent line, was
+	// written in quotes.
+	Quoted bool
+	// Extent is the index into Extents for extent lines, FieldCount the
+	// number of fields the line had when parsed.
+	Extent     int
+	FieldCount int
+}
+
+// DiskDescriptor is a parsed descriptor. String writes it back with the
+// layout, line endings and quoting of the parsed text; entries added to Attr,
+// Extents or Ddb without a line are written after the last line of their
+// section.
 type DiskDescriptor struct {
 	Attr    map[string]string
 	Extents []DiskExtent
 	Ddb     map[string]string
+	Lines   []DescriptorLine
 	Sectors int64
-	Raw     string
+	// Raw is the text the descriptor was parsed from. It is not updated by
+	// edits; use String for the current contents.
+	Raw string
+
+	lineEnding string
 }
 
 func ParseDiskDescriptor(data string) (*DiskDescriptor, error) {
 	attr := make(map[string]string)
 	extents := []DiskExtent{}
 	ddb := make(map[string]string)
+	descriptorLines := []DescriptorLine{}
 	sectors := int64(0)
 
-	lines := strings.Split(data, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+	// embedded descriptors are padded to whole sectors with zeros
+	text := strings.TrimRight(data, "\x00")
+	lineEnding := "\n"
+	if strings.Contains(text, "\r\n") {
+		lineEnding = "\r\n"
+	}
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	lines := strings.Split(text, "\n")
+	for _, rawLine := range lines {
+		line := strings.TrimSpace(rawLine)
 		if line == "" || strings.HasPrefix(line, "#") {
+			descriptorLines = append(descriptorLines, DescriptorLine{Kind: DESCRIPTOR_LINE_TEXT, Text: rawLine})
 			continue
 		}
 
-		if strings.HasPrefix(line, "RW ") || strings.HasPrefix(line, "RDONLY ") || strings.HasPrefix(line, "NOACCESS ") {
+		if isExtentLine(line) {
 			parts, err := parseDescriptorFields(line)
 			if err != nil {
 				return nil, err
 			}
-			if len(parts) < 4 {
+			if len(parts) < 3 || (len(parts) < 4 && parts[2] != "ZERO") {
 				return nil, fmt.Errorf("invalid extent line: %s", line)
 			}
 			size, err := strconv.ParseInt(parts[1], 10, 64)
@@ -52,39 +100,67 @@ func ParseDiskDescriptor(data string) (*DiskDescriptor, error) {
 			if len(parts) > 4 {
 				sectorOff, _ = strconv.ParseInt(parts[4], 10, 64)
 			}
+			var filename string
+			if len(parts) > 3 {
+				filename = parts[3]
+			}
 			extents = append(extents, DiskExtent{
 				AccessType:  parts[0],
 				Size:        size,
 				ExtentType:  parts[2],
-				Filename:    parts[3],
+				Filename:    filename,
 				StartSector: sectorOff,
 			})
+			descriptorLines = append(descriptorLines, DescriptorLine{
+				Kind:       DESCRIPTOR_LINE_EXTENT,
+				Quoted:     strings.Contains(line, `"`),
+				Extent:     len(extents) - 1,
+				FieldCount: len(parts),
+			})
 			continue
 		}
 
 		parts := strings.SplitN(line, "=", 2)
 		if len(parts) < 2 {
+			descriptorLines = append(descriptorLines, DescriptorLine{Kind: DESCRIPTOR_LINE_TEXT, Text: rawLine})
 			continue
 		}
 		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		value = strings.Trim(value, `"`)
+		rawValue := strings.TrimSpace(parts[1])
+		value := strings.Trim(rawValue, `"`)
+		prefix := line[:len(line)-len(strings.TrimLeft(parts[1], " \t"))]
+
+		descriptorLine := DescriptorLine{
+			Kind:   DESCRIPTOR_LINE_ATTR,
+			Key:    key,
+			Prefix: prefix,
+			Quoted: strings.HasPrefix(rawValue, `"`),
+		}
 		if strings.HasPrefix(key, "ddb.") {
 			ddb[key] = value
+			descriptorLine.Kind = DESCRIPTOR_LINE_DDB
 		} else {
 			attr[key] = value
 		}
+		descriptorLines = append(descriptorLines, descriptorLine)
 	}
 
 	return &DiskDescriptor{
 		Attr:    attr,
 		Extents: extents,
 		Ddb:     ddb,
+		Lines:   descriptorLines,
 		Sectors: sectors,
 		Raw:     data,
+
+		lineEnding: lineEnding,
 	}, nil
 }
 
+func isExtentLine(line string) bool {
+	return strings.HasPrefix(line, "RW ") || strings.HasPrefix(line, "RDONLY ") || strings.HasPrefix(line, "NOACCESS ")
+}
+
 func parseDescriptorFields(line string) ([]string, error) {
 	var fields []string
 	var field strings.Builder
@@ -118,3 +194,197 @@ func parseDescriptorFields(line string) ([]string, error) {
 
 	return fields, nil
 }
+
+// String serializes the descriptor, keeping the order and comments of the
+// parsed text and the current values of Attr, Extents and Ddb.
+func (d *DiskDescriptor) String() string {
+	lineEnding := d.lineEnding
+	if lineEnding == "" {
+		lineEnding = "\n"
+	}
+	var sb strings.Builder
+	writeLine := func(line string) {
+		sb.WriteString(line)
+		sb.WriteString(lineEnding)
+	}
+
+	lastLine := map[DescriptorLineKind]int{DESCRIPTOR_LINE_ATTR: -1, DESCRIPTOR_LINE_EXTENT: -1, DESCRIPTOR_LINE_DDB: -1}
+	for i, line := range d.Lines {
+		lastLine[line.Kind] = i
+	}
+
+	written := make(map[string]bool)
+	extentWritten := make([]bool, len(d.Extents))
+	writeUnrecorded := func(kind DescriptorLineKind) {
+		switch kind {
+		case DESCRIPTOR_LINE_ATTR:
+			for _, key := range unwrittenKeys(d.Attr, written) {
+				value := d.Attr[key]
+				if attrQuoted(key) {
+					value = `"` + value + `"`
+				}
+				writeLine(key + "=" + value)
+			}
+		case DESCRIPTOR_LINE_EXTENT:
+			for i, extent := range d.Extents {
+				if !extentWritten[i] {
+					writeLine(formatExtentLine(extent, false, true))
+				}
+			}
+		case DESCRIPTOR_LINE_DDB:
+			for _, key := range unwrittenKeys(d.Ddb, written) {
+				writeLine(key + ` = "` + d.Ddb[key] + `"`)
+			}
+		}
+	}
+
+	for i, line := range d.Lines {
+		switch line.Kind {
+		case DESCRIPTOR_LINE_ATTR, DESCRIPTOR_LINE_DDB:
+			values := d.Attr
+			if line.Kind == DESCRIPTOR_LINE_DDB {
+				values = d.Ddb
+			}
+			value, ok := values[line.Key]
+			if ok && !written[line.Key] {
+				written[line.Key] = true
+				if line.Quoted {
+					value = `"` + value + `"`
+				}
+				writeLine(line.Prefix + value)
+			}
+		case DESCRIPTOR_LINE_EXTENT:
+			if line.Extent < len(d.Extents) {
+				extentWritten[line.Extent] = true
+				writeLine(formatExtentLine(d.Extents[line.Extent], line.FieldCount > 4, line.Quoted))
+			}
+		default:
+			writeLine(line.Text)
+		}
+		if lastLine[line.Kind] == i {
+			writeUnrecorded(line.Kind)
+		}
+	}
+	for _, kind := range []DescriptorLineKind{DESCRIPTOR_LINE_ATTR, DESCRIPTOR_LINE_EXTENT, DESCRIPTOR_LINE_DDB} {
+		if lastLine[kind] < 0 {
+			writeUnrecorded(kind)
+		}
+	}
+
+	return sb.String()
+}
+
+// unwrittenKeys returns the keys of values not in written, sorted.
+func unwrittenKeys(values map[string]string, written map[string]bool) []string {
+	var keys []string
+	for key := range values {
+		if !written[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// attrQuoted reports whether VMware writes the value of a header attribute
+// in quotes.
+func attrQuoted(key string) bool {
+	return key != "version" && key != "CID" && key != "parentCID"
+}
+
+// formatExtentLine renders an extent the way VMware writes it. The start
+// sector is written when it is not zero or withOffset is set; file names
+// with spaces are always quoted.
+func formatExtentLine(extent DiskExtent, withOffset, quoted bool) string {
+	if extent.ExtentType == "ZERO" && extent.Filename == "" {
+		return fmt.Sprintf("%s %d %s", extent.AccessType, extent.Size, extent.ExtentType)
+	}
+	filename := extent.Filename
+	if quoted || filename == "" || strings.ContainsAny(filename, " \t") {
+		filename = `"` + filename + `"`
+	}
+	line := fmt.Sprintf("%s %d %s %s", extent.AccessType, extent.Size, extent.ExtentType, filename)
+	if withOffset || extent.StartSector != 0 {
+		line += fmt.Sprintf(" %d", extent.StartSector)
+	}
+	return line
+}
+
+// SetAttr sets a header attribute, adding a line after the last attribute
+// when the descriptor does not have it yet, or after the "# Disk
+// DescriptorFile" header when it has no attributes at all.
+func (d *DiskDescriptor) SetAttr(key, value string) {
+	if _, ok := d.Attr[key]; !ok {
+		pos := -1
+		for i, line := range d.Lines {
+			if line.Kind == DESCRIPTOR_LINE_ATTR {
+				pos = i + 1
+			}
+		}
+		for i := 0; pos < 0 && i < len(d.Lines) && d.Lines[i].Kind == DESCRIPTOR_LINE_TEXT; i++ {
+			if strings.EqualFold(strings.TrimSpace(d.Lines[i].Text), "# Disk DescriptorFile") {
+				pos = i + 1
+			}
+		}
+		pos = max(pos, 0)
+		d.Lines = append(d.Lines[:pos], append([]DescriptorLine{
+			{Kind: DESCRIPTOR_LINE_ATTR, Key: key, Prefix: key + "=", Quoted: attrQuoted(key)},
+		}, d.Lines[pos:]...)...)
+	}
+	d.Attr[key] = value
+}
+
+// SetDdb sets a disk database entry, appending it when missing. The "ddb."
+// prefix is added if key does not have it.
+func (d *DiskDescriptor) SetDdb(key, value string) {
+	if !strings.HasPrefix(key, "ddb.") {
+		key = "ddb." + key
+	}
+	if _, ok := d.Ddb[key]; !ok {
+		d.Lines = append(d.Lines, DescriptorLine{Kind: DESCRIPTOR_LINE_DDB, Key: key, Prefix: key + " = ", Quoted: true})
+	}
+	d.Ddb[key] = value
+}
+
+func (d *DiskDescriptor) SetCID(cid uint32) {
+	d.SetAttr("CID", fmt.Sprintf("%08x", cid))
+}
+
+func (d *DiskDescriptor) SetParentCID(cid uint32) {
+	d.SetAttr("parentCID", fmt.Sprintf("%08x", cid))
+}
+
+func (d *DiskDescriptor) SetParentFileNameHint(path string) {
+	d.SetAttr("parentFileNameHint", path)
+}
+
+// SetExtentFilename points the extent at index to a new file.
+func (d *DiskDescriptor) SetExtentFilename(index int, filename string) error {
+	if index < 0 || index >= len(d.Extents) {
+		return fmt.Errorf("extent index out of range: %d", index)
+	}
+	d.Extents[index].Filename = filename
+	return nil
+}
+
+// CID returns the parsed content id of the descriptor.
+func (d *DiskDescriptor) CID() (uint32, error) {
+	return parseCID(d.Attr["CID"])
+}
+
+// ParentCID returns the parsed content id of the parent descriptor.
+func (d *DiskDescriptor) ParentCID() (uint32, error) {
+	return parseCID(d.Attr["parentCID"])
+}
+
+func (d *DiskDescriptor) bumpCID() {
+	d.SetCID(newCID())
+}
+
+func parseCID(value string) (uint32, error) {
+	cid, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cid %q: %w", value, err)
+	}
+	return uint32(cid), nil
+}
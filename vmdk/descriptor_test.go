@@ -63,3 +63,126 @@ RW 2048 FLAT disk-flat.vmdk 4224`
 		t.Fatalf("StartSector = %d, want %d", got, want)
 	}
 }
+
+func TestDiskDescriptorRoundTrip(t *testing.T) {
+	descriptor := `# Disk DescriptorFile
+version=1
+encoding="UTF-8"
+CID=1a2b3c4d
+parentCID=5e6f7a8b
+createType="monolithicSparse"
+parentFileNameHint="C:\VMs\base.vmdk"
+
+# Extent description
+RW 4096 SPARSE "disk-000001.vmdk"
+RW 2048 FLAT "disk-flat.vmdk" 0
+
+# The Disk Data Base
+#DDB
+
+ddb.longContentID = "0123456789abcdef0123456789abcdef"
+ddb.adapterType = "lsilogic"
+`
+
+	parsed, err := ParseDiskDescriptor(descriptor)
+	if err != nil {
+		t.Fatalf("ParseDiskDescriptor() error = %v", err)
+	}
+	if got := parsed.String(); got != descriptor {
+		t.Fatalf("String() = %q, want %q", got, descriptor)
+	}
+
+	parsed.SetCID(0xdeadbeef)
+	parsed.SetParentCID(0x01020304)
+	parsed.SetParentFileNameHint("/vmfs/volumes/ds2/vm/base.vmdk")
+	if err := parsed.SetExtentFilename(0, "moved-000001.vmdk"); err != nil {
+		t.Fatalf("SetExtentFilename() error = %v", err)
+	}
+	parsed.SetAttr("isNativeSnapshot", "no")
+	parsed.SetDdb("uuid", "60 00 C2 9b")
+
+	want := `# Disk DescriptorFile
+version=1
+encoding="UTF-8"
+CID=deadbeef
+parentCID=01020304
+createType="monolithicSparse"
+parentFileNameHint="/vmfs/volumes/ds2/vm/base.vmdk"
+isNativeSnapshot="no"
+
+# Extent description
+RW 4096 SPARSE "moved-000001.vmdk"
+RW 2048 FLAT "disk-flat.vmdk" 0
+
+# The Disk Data Base
+#DDB
+
+ddb.longContentID = "0123456789abcdef0123456789abcdef"
+ddb.adapterType = "lsilogic"
+ddb.uuid = "60 00 C2 9b"
+`
+	if got := parsed.String(); got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+
+	reparsed, err := ParseDiskDescriptor(parsed.String())
+	if err != nil {
+		t.Fatalf("ParseDiskDescriptor() error = %v", err)
+	}
+	if cid, err := reparsed.ParentCID(); err != nil || cid != 0x01020304 {
+		t.Fatalf("ParentCID() = %x, %v, want 01020304", cid, err)
+	}
+}
+
+func TestDiskDescriptorLayoutPreserved(t *testing.T) {
+	descriptor := "# Disk DescriptorFile\r\nversion=1\r\nCID=1a2b3c4d\r\ncreateType=\"vmfs\"\r\n\r\n" +
+		"RW 4096 VMFS disk-flat.vmdk\r\n\r\nddb.adapterType = \"lsilogic\"\r\n"
+
+	parsed, err := ParseDiskDescriptor(descriptor)
+	if err != nil {
+		t.Fatalf("ParseDiskDescriptor() error = %v", err)
+	}
+	if got := parsed.String(); got != descriptor {
+		t.Fatalf("String() = %q, want %q", got, descriptor)
+	}
+
+	// entries added without the setters are written after their section
+	parsed.Attr["parentCID"] = "ffffffff"
+	parsed.Extents = append(parsed.Extents, DiskExtent{AccessType: "RW", Size: 2048, ExtentType: "VMFS", Filename: "disk 2-flat.vmdk"})
+	parsed.Ddb["ddb.uuid"] = "60 00 C2 9b"
+	parsed.Ddb["ddb.geometry.heads"] = "16"
+
+	want := "# Disk DescriptorFile\r\nversion=1\r\nCID=1a2b3c4d\r\ncreateType=\"vmfs\"\r\nparentCID=ffffffff\r\n\r\n" +
+		"RW 4096 VMFS disk-flat.vmdk\r\nRW 2048 VMFS \"disk 2-flat.vmdk\"\r\n\r\n" +
+		"ddb.adapterType = \"lsilogic\"\r\nddb.geometry.heads = \"16\"\r\nddb.uuid = \"60 00 C2 9b\"\r\n"
+	if got := parsed.String(); got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+	if parsed.Raw != descriptor {
+		t.Fatal("Raw changed after editing the descriptor")
+	}
+}
+
+func TestDiskDescriptorSetAttrWithoutAttributes(t *testing.T) {
+	descriptor, err := ParseDiskDescriptor(`# Disk DescriptorFile
+
+# Extent description
+RW 2048 FLAT "disk-flat.vmdk" 0
+`)
+	if err != nil {
+		t.Fatalf("ParseDiskDescriptor() error = %v", err)
+	}
+	descriptor.SetAttr("version", "1")
+	descriptor.SetAttr("createType", "monolithicFlat")
+
+	want := `# Disk DescriptorFile
+version=1
+createType="monolithicFlat"
+
+# Extent description
+RW 2048 FLAT "disk-flat.vmdk" 0
+`
+	if got := descriptor.String(); got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+}
@@ -1,18 +1,35 @@
 package vmdk
 
-import "io"
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrNoAccessExtent = errors.New("extent is marked NOACCESS")
 
 type RawDisk struct {
 	fh           io.ReadSeeker
 	size         int64
 	offset       int64
 	sectorOffset int64
+	startSector  int64
 }
 
 func NewRawDisk(fh io.ReadSeeker, size int64) (*RawDisk, error) {
-	rd := &RawDisk{fh: fh}
-	if size == 0 {
+	return NewRawDiskAt(fh, size, 0)
+}
 
+// NewRawDiskAt creates a raw extent whose data starts at startSector of the
+// backing file, as FLAT and VMFS extents with an offset field do.
+func NewRawDiskAt(fh io.ReadSeeker, size int64, startSector int64) (*RawDisk, error) {
+	rd := &RawDisk{fh: fh, startSector: startSector}
+	if size == 0 {
+		fileSize, err := getSize(fh)
+		if err != nil {
+			return nil, err
+		}
+		rd.size = fileSize - startSector*SECTOR_SIZE
 	} else {
 		rd.size = size
 	}
@@ -21,7 +38,7 @@ func NewRawDisk(fh io.ReadSeeker, size int64) (*RawDisk, error) {
 }
 
 func (rd *RawDisk) ReadSectors(sector int64, count int) ([]byte, error) {
-	offset := (int64(sector) - rd.sectorOffset) * SECTOR_SIZE
+	offset := (int64(sector) - rd.sectorOffset + rd.startSector) * SECTOR_SIZE
 	_, err := rd.fh.Seek(offset, io.SeekStart)
 	if err != nil {
 		return nil, err
@@ -34,6 +51,28 @@ func (rd *RawDisk) ReadSectors(sector int64, count int) ([]byte, error) {
 	return data, nil
 }
 
+func (rd *RawDisk) WriteAt(p []byte, offset int64) (int, error) {
+	return writeAtSectors(rd, p, offset)
+}
+
+// WriteSectors method for RawDisk writes in place when the backing file is
+// writable.
+func (rd *RawDisk) WriteSectors(sector int64, data []byte) error {
+	w, ok := rd.fh.(io.Writer)
+	if !ok {
+		return ErrReadOnly
+	}
+	readSector := sector - rd.sectorOffset
+	if readSector < 0 || readSector*SECTOR_SIZE+int64(len(data)) > rd.size {
+		return fmt.Errorf("write out of bounds: sector %d, count %d", sector, len(data)/SECTOR_SIZE)
+	}
+	if _, err := rd.fh.Seek((readSector+rd.startSector)*SECTOR_SIZE, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
 func (rd *RawDisk) GetSize() int64 {
 	return rd.size
 }
@@ -50,3 +89,40 @@ func (rd *RawDisk) SetOffset(offset, sectorOffset int64) {
 	rd.offset = offset
 	rd.sectorOffset = sectorOffset
 }
+
+// ZeroDisk backs ZERO extents, which read as zeros without a file, and
+// NOACCESS extents, which keep their place in the disk but cannot be read.
+type ZeroDisk struct {
+	size         int64
+	offset       int64
+	sectorOffset int64
+	noAccess     bool
+}
+
+func NewZeroDisk(size int64, noAccess bool) *ZeroDisk {
+	return &ZeroDisk{size: size, noAccess: noAccess}
+}
+
+func (zd *ZeroDisk) ReadSectors(sector int64, count int) ([]byte, error) {
+	if zd.noAccess {
+		return nil, ErrNoAccessExtent
+	}
+	return make([]byte, count*SECTOR_SIZE), nil
+}
+
+func (zd *ZeroDisk) GetSize() int64 {
+	return zd.size
+}
+
+func (zd *ZeroDisk) GetSectorCount() int64 {
+	return zd.size / SECTOR_SIZE
+}
+
+func (zd *ZeroDisk) GetSectorOffset() int64 {
+	return zd.sectorOffset
+}
+
+func (zd *ZeroDisk) SetOffset(offset, sectorOffset int64) {
+	zd.offset = offset
+	zd.sectorOffset = sectorOffset
+}
@@ -0,0 +1,260 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	SESPARSE_GD_ENTRY_ALLOCATED = 0x1000000000000000
+	SESPARSE_GD_ENTRY_MASK      = 0xFFFFFFFF00000000
+)
+
+// Unmapper is implemented by extents that can release grains.
+type Unmapper interface {
+	Unmap(sector, count int64, zero bool) error
+}
+
+// Unmap releases the grains fully covered by the sector range of an
+// SESparse extent. With zero set the grains read as zeros afterwards,
+// otherwise they fall through to the parent again. Partially covered grains
+// are zeroed in place when zero is set and left untouched otherwise.
+func (sd *SparseDisk) Unmap(sector, count int64, zero bool) error {
+	w, ok := sd.fh.(io.Writer)
+	if !ok {
+		return ErrReadOnly
+	}
+	if !sd.isSESparse {
+		return errors.New("unmap is only supported for sesparse extents")
+	}
+
+	readSector := sector - sd.sectorOffset
+	if readSector < 0 || count < 0 || readSector+count > sd.sectorCount {
+		return fmt.Errorf("unmap out of bounds: sector %d, count %d", sector, count)
+	}
+	if err := sd.loadSESparseAllocation(); err != nil {
+		return err
+	}
+
+	entryType := uint64(SESPARSE_GRAIN_TYPE_UNALLOCATED)
+	if zero {
+		entryType = SESPARSE_GRAIN_TYPE_ZERO
+	}
+
+	grainSize := int64(sd.header.Raw.GetGrainSize())
+	for count > 0 {
+		grain, grainOffset := readSector/grainSize, readSector%grainSize
+		n := min(count, grainSize-grainOffset)
+
+		if err := sd.unmapGrain(w, grain, grainOffset, n, entryType); err != nil {
+			return err
+		}
+
+		readSector += n
+		count -= n
+	}
+	return nil
+}
+
+// unmapGrain releases a whole grain, or zeroes count sectors of it when it
+// is only partially covered and unmapping to zeros.
+func (sd *SparseDisk) unmapGrain(w io.Writer, grain, grainOffset, count int64, entryType uint64) error {
+	grainSize := int64(sd.header.Raw.GetGrainSize())
+	start := grain*grainSize + grainOffset
+	if grainOffset == 0 && (count == grainSize || start+count == sd.sectorCount) {
+		return sd.setSESparseGrainEntry(w, grain, entryType)
+	}
+	if entryType != SESPARSE_GRAIN_TYPE_ZERO {
+		return nil
+	}
+
+	grainSector, err := sd.lookupGrain(grain)
+	if err != nil {
+		return err
+	}
+	// grains already reading as zeros are left alone
+	if grainSector == 1 || (grainSector == 0 && sd.parent == nil) {
+		return nil
+	}
+	return sd.WriteSectors(sd.sectorOffset+start, make([]byte, count*SECTOR_SIZE))
+}
+
+// allocateSESparseGrain stores a grain in the lowest free cluster of the
+// grains region and points the grain table entry at it. The backmap is left
+// untouched: its entry layout is not documented, and grains are only ever
+// located through the grain tables.
+func (sd *SparseDisk) allocateSESparseGrain(w io.Writer, grain int64, data []byte) error {
+	h, _ := sd.header.AsVMDKSES()
+	if err := sd.loadSESparseAllocation(); err != nil {
+		return err
+	}
+
+	cluster := -1
+	for i, used := range sd.usedClusters {
+		if !used {
+			cluster = i
+			break
+		}
+	}
+	if cluster < 0 {
+		return errors.New("sesparse grains region is full")
+	}
+
+	if err := sd.writeAtOffset(w, int64(h.GrainsOffset+uint64(cluster)*h.GrainSize)*SECTOR_SIZE, data); err != nil {
+		return err
+	}
+	entry := uint64(SESPARSE_GRAIN_TYPE_ALLOCATED) | uint64(cluster&0xFFF)<<48 | uint64(cluster)>>12
+	if err := sd.setSESparseGrainEntry(w, grain, entry); err != nil {
+		return err
+	}
+	sd.usedClusters[cluster] = true
+	return nil
+}
+
+// setSESparseGrainEntry replaces the grain table entry of grain, allocating
+// the grain table if needed, and frees the cluster it pointed to.
+func (sd *SparseDisk) setSESparseGrainEntry(w io.Writer, grain int64, entry uint64) error {
+	h, _ := sd.header.AsVMDKSES()
+	gdirEntry, gtblEntry := grain/sd.grainTableSize, grain%sd.grainTableSize
+
+	if sd.grainDirectory[gdirEntry]&SESPARSE_GD_ENTRY_MASK != SESPARSE_GD_ENTRY_ALLOCATED {
+		if entry&SESPARSE_GRAIN_TYPE_MASK == SESPARSE_GRAIN_TYPE_UNALLOCATED {
+			return nil
+		}
+		if err := sd.allocateSESparseGrainTable(w, gdirEntry); err != nil {
+			return err
+		}
+	}
+
+	gtSectors := uint64(sd.grainTableSize) * 8 / SECTOR_SIZE
+	gtIndex := sd.grainDirectory[gdirEntry] &^ SESPARSE_GD_ENTRY_MASK
+	entryOffset := int64(h.GrainTablesOffset+gtIndex*gtSectors)*SECTOR_SIZE + gtblEntry*8
+
+	if _, err := sd.fh.Seek(entryOffset, io.SeekStart); err != nil {
+		return err
+	}
+	var old uint64
+	if err := binary.Read(sd.fh, binary.LittleEndian, &old); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, entry)
+	if err := sd.writeAtOffset(w, entryOffset, buf); err != nil {
+		return err
+	}
+
+	if old&SESPARSE_GRAIN_TYPE_MASK == SESPARSE_GRAIN_TYPE_ALLOCATED && old != entry {
+		if cluster := seSparseCluster(old); cluster < uint64(len(sd.usedClusters)) {
+			sd.usedClusters[cluster] = false
+		}
+	}
+	return nil
+}
+
+// allocateSESparseGrainTable takes the first unused grain table of the grain
+// tables region and links it into the grain directory.
+func (sd *SparseDisk) allocateSESparseGrainTable(w io.Writer, gdirEntry int64) error {
+	h, _ := sd.header.AsVMDKSES()
+
+	index := -1
+	for i, used := range sd.usedGrainTables {
+		if !used {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return errors.New("sesparse grain tables region is full")
+	}
+
+	gtSectors := uint64(sd.grainTableSize) * 8 / SECTOR_SIZE
+	table := make([]byte, sd.grainTableSize*8)
+	if err := sd.writeAtOffset(w, int64(h.GrainTablesOffset+uint64(index)*gtSectors)*SECTOR_SIZE, table); err != nil {
+		return err
+	}
+
+	entry := uint64(SESPARSE_GD_ENTRY_ALLOCATED) | uint64(index)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, entry)
+	if err := sd.writeAtOffset(w, int64(h.GrainDirectoryOffset)*SECTOR_SIZE+gdirEntry*8, buf); err != nil {
+		return err
+	}
+	sd.grainDirectory[gdirEntry] = entry
+	sd.usedGrainTables[index] = true
+	return nil
+}
+
+// loadSESparseAllocation walks the grain directory once to learn which grain
+// tables and clusters are in use.
+func (sd *SparseDisk) loadSESparseAllocation() error {
+	if sd.usedClusters != nil {
+		return nil
+	}
+	h, _ := sd.header.AsVMDKSES()
+
+	gtSectors := uint64(sd.grainTableSize) * 8 / SECTOR_SIZE
+	usedGrainTables := make([]bool, h.GrainTablesSize/gtSectors)
+	usedClusters := make([]bool, h.GrainsSize/h.GrainSize)
+
+	for directory, gdEntry := range sd.grainDirectory {
+		if gdEntry&SESPARSE_GD_ENTRY_MASK != SESPARSE_GD_ENTRY_ALLOCATED {
+			continue
+		}
+		if index := gdEntry &^ SESPARSE_GD_ENTRY_MASK; index < uint64(len(usedGrainTables)) {
+			usedGrainTables[index] = true
+		}
+		table, err := sd.lookupGrainTable(int64(directory))
+		if err != nil {
+			return err
+		}
+		for _, entry := range table {
+			if entry&SESPARSE_GRAIN_TYPE_MASK != SESPARSE_GRAIN_TYPE_ALLOCATED {
+				continue
+			}
+			if cluster := seSparseCluster(entry); cluster < uint64(len(usedClusters)) {
+				usedClusters[cluster] = true
+			}
+		}
+	}
+
+	sd.usedGrainTables = usedGrainTables
+	sd.usedClusters = usedClusters
+	return nil
+}
+
+// seSparseCluster decodes the cluster number of an allocated grain entry.
+func seSparseCluster(entry uint64) uint64 {
+	return (entry&0x0FFF000000000000)>>48 | (entry&0x0000FFFFFFFFFFFF)<<12
+}
+
+// Unmap releases the grains in the sector range of the virtual disk. Every
+// extent touched must support unmapping.
+func (v *VMDK) Unmap(sector, count int64, zero bool) error {
+	if err := v.markModified(); err != nil {
+		return err
+	}
+
+	diskIdx := bisectRight(v.DiskOffsets, sector)
+	for count > 0 {
+		if diskIdx >= len(v.Disks) {
+			return fmt.Errorf("out of bounds disk, disk count: %v, requested: %v", len(v.Disks), sector)
+		}
+		disk := v.Disks[diskIdx]
+		unmapper, ok := disk.(Unmapper)
+		if !ok {
+			return errors.New("extent does not support unmap")
+		}
+		n := min(disk.GetSectorCount()-(sector-disk.GetSectorOffset()), count)
+		if err := unmapper.Unmap(sector, n, zero); err != nil {
+			return err
+		}
+
+		sector += n
+		count -= n
+		diskIdx++
+	}
+	return nil
+}
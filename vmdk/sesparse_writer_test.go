@@ -0,0 +1,145 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSESparse writes an empty SESparse extent with a single grain
+// directory sector, room for two grain tables and 512 clusters of 4 KiB.
+func newTestSESparse(t *testing.T, capacity uint64) *os.File {
+	header := VMDKSESparseConstHeader{
+		Magic:                0xcafebabe,
+		Version:              0x200000001,
+		Capacity:             capacity,
+		GrainSize:            8,
+		GrainTableSize:       64,
+		GrainDirectoryOffset: 16,
+		GrainDirectorySize:   1,
+		GrainTablesOffset:    32,
+		GrainTablesSize:      128,
+		BackmapOffset:        160,
+		BackmapSize:          8,
+		GrainsOffset:         256,
+		GrainsSize:           4096,
+	}
+
+	fh, err := os.OpenFile(filepath.Join(t.TempDir(), "test-sesparse.vmdk"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fh.Close() })
+	if err := binary.Write(fh, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Truncate(int64(header.GrainsOffset+header.GrainsSize) * SECTOR_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	return fh
+}
+
+func TestSESparseWriteUnmap(t *testing.T) {
+	capacity := uint64(4096)
+	fh := newTestSESparse(t, capacity)
+
+	sd, err := NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	data := newTestDiskData(300000)
+	if _, err := sd.WriteAt(data, 100000+7); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	want := make([]byte, capacity*SECTOR_SIZE)
+	copy(want[100000+7:], data)
+
+	// whole grains in the middle are released, the partial ones zeroed
+	if err := sd.Unmap(300, 1000, true); err != nil {
+		t.Fatalf("Unmap() error = %v", err)
+	}
+	clear(want[300*SECTOR_SIZE : 1300*SECTOR_SIZE])
+	if err := sd.Unmap(0, 400, false); err != nil {
+		t.Fatalf("Unmap() error = %v", err)
+	}
+	clear(want[:400*SECTOR_SIZE])
+
+	// released clusters are reused
+	if err := sd.WriteSectors(2000, bytes.Repeat([]byte{0xAB}, 64*SECTOR_SIZE)); err != nil {
+		t.Fatalf("WriteSectors() error = %v", err)
+	}
+	copy(want[2000*SECTOR_SIZE:], bytes.Repeat([]byte{0xAB}, 64*SECTOR_SIZE))
+
+	sd, err = NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	got, err := sd.ReadSectors(0, int(capacity))
+	if err != nil {
+		t.Fatalf("ReadSectors() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("ReadSectors() data does not match written data")
+	}
+
+	if err := sd.loadSESparseAllocation(); err != nil {
+		t.Fatal(err)
+	}
+	used := 0
+	for _, u := range sd.usedClusters {
+		if u {
+			used++
+		}
+	}
+	// only the eight grains written last still hold clusters
+	if used != 8 {
+		t.Fatalf("used clusters = %d, want 8", used)
+	}
+}
+
+func TestSESparseAllocateGrain(t *testing.T) {
+	fh := newTestSESparse(t, 4096)
+	sd, err := NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	// grain 5 takes cluster 0, grain 3 cluster 1
+	grains := map[int64][]byte{
+		5: bytes.Repeat([]byte{0x05}, 8*SECTOR_SIZE),
+		3: bytes.Repeat([]byte{0x03}, 8*SECTOR_SIZE),
+	}
+	for _, grain := range []int64{5, 3} {
+		if err := sd.WriteSectors(grain*8, grains[grain]); err != nil {
+			t.Fatalf("WriteSectors() error = %v", err)
+		}
+	}
+
+	sd, err = NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	for grain, wantSector := range map[int64]int{5: 256, 3: 264} {
+		sector, err := sd.lookupGrain(grain)
+		if err != nil || sector != wantSector {
+			t.Fatalf("lookupGrain(%d) = %d, %v, want %d", grain, sector, err, wantSector)
+		}
+		got := make([]byte, 8*SECTOR_SIZE)
+		if _, err := fh.ReadAt(got, int64(sector)*SECTOR_SIZE); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, grains[grain]) {
+			t.Fatalf("grain %d data does not match", grain)
+		}
+	}
+
+	// the undocumented backmap is not written
+	backmap := make([]byte, 8*SECTOR_SIZE)
+	if _, err := fh.ReadAt(backmap, 160*SECTOR_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backmap, make([]byte, len(backmap))) {
+		t.Fatal("backmap was modified")
+	}
+}
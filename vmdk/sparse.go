@@ -15,12 +15,20 @@ type SparseDisk struct {
 	offset         int64
 	sectorOffset   int64
 	size           int64
+	fileSize       int64
 	sectorCount    int64
 	isSESparse     bool
 	header         *SparseExtentHeader
 	descriptor     *DiskDescriptor
 	grainDirectory []uint64
 	grainTableSize int64
+	modified       bool
+
+	usingRedundantGD bool
+
+	// clusters and grain tables in use, loaded on the first SESparse write
+	usedClusters    []bool
+	usedGrainTables []bool
 }
 
 type SparseGrainLBAHeader struct {
@@ -39,7 +47,7 @@ type run struct {
 func NewSparseDisk(fh io.ReadSeeker, parent *VMDK) (*SparseDisk, error) {
 	sd := &SparseDisk{fh: fh, parent: parent}
 	var err error
-	sd.size, err = getSize(fh)
+	sd.fileSize, err = getSize(fh)
 	if err != nil {
 		return nil, err
 	}
@@ -100,19 +108,20 @@ func NewSparseDisk(fh io.ReadSeeker, parent *VMDK) (*SparseDisk, error) {
 			capacity = uint64(h.Capacity)
 		}
 
-		_, err = fh.Seek(gdOffset*SECTOR_SIZE, io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
-
-		gd := make([]uint32, len(sd.grainDirectory))
-		err = binary.Read(fh, binary.LittleEndian, &gd)
-		if err != nil {
-			return nil, err
+		gd, gdErr := sd.readGrainDirectory(gdOffset)
+		if h, ok := sd.header.AsVMDK(); ok && h.SecondaryGrainDirectoryOffset != 0 &&
+			(gdErr != nil || !sd.validGrainDirectory(gdOffset, gd)) {
+			rgdOffset := int64(h.SecondaryGrainDirectoryOffset)
+			rgd, err := sd.readGrainDirectory(rgdOffset)
+			if err == nil && sd.validGrainDirectory(rgdOffset, rgd) {
+				gd, gdErr = rgd, nil
+				sd.usingRedundantGD = true
+			}
 		}
-		for i, v := range gd {
-			sd.grainDirectory[i] = uint64(v)
+		if gdErr != nil {
+			return nil, gdErr
 		}
+		sd.grainDirectory = gd
 
 	case SESPARSE_MAGIC:
 		sd.isSESparse = true
@@ -139,6 +148,53 @@ func NewSparseDisk(fh io.ReadSeeker, parent *VMDK) (*SparseDisk, error) {
 	return sd, nil
 }
 
+// readGrainDirectory reads the grain directory of a VMDK or COWD extent.
+func (sd *SparseDisk) readGrainDirectory(gdOffset int64) ([]uint64, error) {
+	if gdOffset <= 0 {
+		return nil, errors.New("grain directory offset is zero")
+	}
+	_, err := sd.fh.Seek(gdOffset*SECTOR_SIZE, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	gd := make([]uint32, len(sd.grainDirectory))
+	err = binary.Read(sd.fh, binary.LittleEndian, &gd)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]uint64, len(gd))
+	for i, v := range gd {
+		entries[i] = uint64(v)
+	}
+	return entries, nil
+}
+
+// validGrainDirectory reports whether a grain directory lies inside the
+// extent and all of its grain tables do too. A directory without any grain
+// table is only valid if the other copy has none either, which the caller
+// decides by trying the redundant copy.
+func (sd *SparseDisk) validGrainDirectory(gdOffset int64, gd []uint64) bool {
+	sectors := (sd.fileSize + SECTOR_SIZE - 1) / SECTOR_SIZE
+	if gdOffset <= 0 || gdOffset+int64(len(gd)*4+SECTOR_SIZE-1)/SECTOR_SIZE > sectors {
+		return false
+	}
+
+	gtSectors := (sd.grainTableSize*4 + SECTOR_SIZE - 1) / SECTOR_SIZE
+	allocated := false
+	for _, entry := range gd {
+		if entry == 0 {
+			continue
+		}
+		if int64(entry)+gtSectors > sectors {
+			return false
+		}
+		allocated = true
+	}
+	return allocated
+}
+
 // readSectors method for SparseDisk
 func (sd *SparseDisk) ReadSectors(sector int64, count int) ([]byte, error) {
 	runs, err := sd.getRuns(sector, count)
@@ -327,23 +383,28 @@ func (sd *SparseDisk) lookupGrain(grain int64) (int, error) {
 	if table == nil {
 		return 0, nil
 	}
-	grainEntry := table[gtblEntry]
+	return sd.grainSector(table[gtblEntry]), nil
+}
+
+// grainSector decodes a grain table entry to the sector of the grain, 0 for
+// unallocated and 1 for zero grains.
+func (sd *SparseDisk) grainSector(grainEntry uint64) int {
 	if sd.isSESparse {
 		grainType := grainEntry & SESPARSE_GRAIN_TYPE_MASK
 		switch grainType {
 		case SESPARSE_GRAIN_TYPE_UNALLOCATED, SESPARSE_GRAIN_TYPE_FALLTHROUGH:
-			return 0, nil
+			return 0
 		case SESPARSE_GRAIN_TYPE_ZERO:
-			return 1, nil
+			return 1
 		case SESPARSE_GRAIN_TYPE_ALLOCATED:
 			clusterSectorHi := (grainEntry & 0x0FFF000000000000) >> 48
 			clusterSectorLo := (grainEntry & 0x0000FFFFFFFFFFFF) << 12
 			clusterSector := clusterSectorHi | clusterSectorLo
 			return int(sd.header.Raw.GrainOffset() +
-				(clusterSector * sd.header.Raw.GetGrainSize())), nil
+				(clusterSector * sd.header.Raw.GetGrainSize()))
 		}
 	}
-	return int(grainEntry), nil
+	return int(grainEntry)
 }
 
 // lookupGrainTable method for SparseDisk
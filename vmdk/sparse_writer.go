@@ -0,0 +1,350 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrReadOnly = errors.New("disk is not opened for writing")
+
+// WritableDisk is implemented by extents that support in-place modification.
+type WritableDisk interface {
+	Disk
+	WriteSectors(sector int64, data []byte) error
+}
+
+// WriteAt writes p at the given offset of the extent, reading back partially
+// covered sectors first.
+func (sd *SparseDisk) WriteAt(p []byte, offset int64) (int, error) {
+	return writeAtSectors(sd, p, offset)
+}
+
+// WriteSectors method for SparseDisk writes whole sectors, allocating grains
+// and grain tables at the end of the extent as needed.
+func (sd *SparseDisk) WriteSectors(sector int64, data []byte) error {
+	w, ok := sd.fh.(io.Writer)
+	if !ok {
+		return ErrReadOnly
+	}
+	if len(data)%SECTOR_SIZE != 0 {
+		return fmt.Errorf("write length %d is not a multiple of the sector size", len(data))
+	}
+	if _, ok := sd.header.AsVMDK(); !ok && !sd.isSESparse {
+		return fmt.Errorf("writing %q sparse extents is not supported", sd.header.Magic)
+	}
+	if sd.header.Raw.IsCompressed() {
+		return errors.New("writing compressed sparse extents is not supported")
+	}
+	if sd.usingRedundantGD {
+		return errors.New("primary grain directory is damaged, refusing to write")
+	}
+
+	readSector := sector - sd.sectorOffset
+	if readSector < 0 || readSector+int64(len(data)/SECTOR_SIZE) > sd.sectorCount {
+		return fmt.Errorf("write out of bounds: sector %d, count %d", sector, len(data)/SECTOR_SIZE)
+	}
+
+	if err := sd.markModified(w); err != nil {
+		return err
+	}
+
+	grainSize := int64(sd.header.Raw.GetGrainSize())
+	for len(data) > 0 {
+		grain, grainOffset := readSector/grainSize, readSector%grainSize
+		count := min(int64(len(data)/SECTOR_SIZE), grainSize-grainOffset)
+
+		grainSector, err := sd.lookupGrain(grain)
+		if err != nil {
+			return err
+		}
+
+		if grainSector > 1 {
+			if _, err := sd.fh.Seek((int64(grainSector)+grainOffset)*SECTOR_SIZE, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := w.Write(data[:count*SECTOR_SIZE]); err != nil {
+				return err
+			}
+		} else {
+			buf, err := sd.initialGrain(grain, grainSector == 0)
+			if err != nil {
+				return err
+			}
+			copy(buf[grainOffset*SECTOR_SIZE:], data[:count*SECTOR_SIZE])
+			if err := sd.allocateGrain(w, grain, buf); err != nil {
+				return err
+			}
+		}
+
+		data = data[count*SECTOR_SIZE:]
+		readSector += count
+	}
+
+	return nil
+}
+
+// initialGrain returns the contents a newly allocated grain starts with:
+// the parent's data for unallocated grains of delta disks, zeros otherwise.
+func (sd *SparseDisk) initialGrain(grain int64, fromParent bool) ([]byte, error) {
+	grainSize := int64(sd.header.Raw.GetGrainSize())
+	buf := make([]byte, grainSize*SECTOR_SIZE)
+	if !fromParent || sd.parent == nil {
+		return buf, nil
+	}
+
+	start := grain * grainSize
+	count := min(grainSize, sd.sectorCount-start)
+	data, err := sd.parent.ReadSectors(sd.sectorOffset+start, int(count))
+	if err != nil {
+		return nil, err
+	}
+	copy(buf, data)
+	return buf, nil
+}
+
+// allocateGrain appends a grain to the extent and records it in the primary
+// and redundant grain tables.
+func (sd *SparseDisk) allocateGrain(w io.Writer, grain int64, data []byte) error {
+	if sd.isSESparse {
+		return sd.allocateSESparseGrain(w, grain, data)
+	}
+
+	gdirEntry, gtblEntry := grain/sd.grainTableSize, grain%sd.grainTableSize
+
+	if sd.grainDirectory[gdirEntry] == 0 {
+		if err := sd.allocateGrainTable(w, gdirEntry); err != nil {
+			return err
+		}
+	}
+
+	grainSector, err := sd.appendSectors(w, data)
+	if err != nil {
+		return err
+	}
+
+	entry := make([]byte, 4)
+	binary.LittleEndian.PutUint32(entry, uint32(grainSector))
+	if err := sd.writeAtOffset(w, int64(sd.grainDirectory[gdirEntry])*SECTOR_SIZE+gtblEntry*4, entry); err != nil {
+		return err
+	}
+
+	rgtOffset, err := sd.redundantGrainTable(gdirEntry)
+	if err != nil {
+		return err
+	}
+	if rgtOffset != 0 {
+		return sd.writeAtOffset(w, int64(rgtOffset)*SECTOR_SIZE+gtblEntry*4, entry)
+	}
+	return nil
+}
+
+// allocateGrainTable appends zeroed grain tables for a grain directory entry
+// and links them into the primary and redundant grain directories.
+func (sd *SparseDisk) allocateGrainTable(w io.Writer, gdirEntry int64) error {
+	h, _ := sd.header.AsVMDK()
+	table := make([]byte, sd.grainTableSize*4)
+
+	gtSector, err := sd.appendSectors(w, table)
+	if err != nil {
+		return err
+	}
+	entry := make([]byte, 4)
+	binary.LittleEndian.PutUint32(entry, uint32(gtSector))
+	if err := sd.writeAtOffset(w, int64(h.PrimaryGrainDirectoryOffset)*SECTOR_SIZE+gdirEntry*4, entry); err != nil {
+		return err
+	}
+	sd.grainDirectory[gdirEntry] = gtSector
+
+	if h.SecondaryGrainDirectoryOffset == 0 {
+		return nil
+	}
+	rgtSector, err := sd.appendSectors(w, table)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(entry, uint32(rgtSector))
+	return sd.writeAtOffset(w, int64(h.SecondaryGrainDirectoryOffset)*SECTOR_SIZE+gdirEntry*4, entry)
+}
+
+// redundantGrainTable returns the sector of the redundant grain table for a
+// grain directory entry, or 0 when the extent has none.
+func (sd *SparseDisk) redundantGrainTable(gdirEntry int64) (uint64, error) {
+	h, _ := sd.header.AsVMDK()
+	if h.SecondaryGrainDirectoryOffset == 0 {
+		return 0, nil
+	}
+	if _, err := sd.fh.Seek(int64(h.SecondaryGrainDirectoryOffset)*SECTOR_SIZE+gdirEntry*4, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var entry uint32
+	if err := binary.Read(sd.fh, binary.LittleEndian, &entry); err != nil {
+		return 0, err
+	}
+	return uint64(entry), nil
+}
+
+// appendSectors writes data at the end of the extent and returns its sector.
+func (sd *SparseDisk) appendSectors(w io.Writer, data []byte) (uint64, error) {
+	sector := (sd.fileSize + SECTOR_SIZE - 1) / SECTOR_SIZE
+	padded := make([]byte, (len(data)+SECTOR_SIZE-1)/SECTOR_SIZE*SECTOR_SIZE)
+	copy(padded, data)
+	if err := sd.writeAtOffset(w, sector*SECTOR_SIZE, padded); err != nil {
+		return 0, err
+	}
+	sd.fileSize = sector*SECTOR_SIZE + int64(len(padded))
+	return uint64(sector), nil
+}
+
+func (sd *SparseDisk) writeAtOffset(w io.Writer, offset int64, data []byte) error {
+	if _, err := sd.fh.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// markModified gives the embedded descriptor a new CID on the first write.
+func (sd *SparseDisk) markModified(w io.Writer) error {
+	if sd.modified {
+		return nil
+	}
+
+	h, ok := sd.header.AsVMDK()
+	if !ok || sd.descriptor == nil || h.DescriptorSize == 0 {
+		sd.modified = true
+		return nil
+	}
+	sd.descriptor.bumpCID()
+
+	text := sd.descriptor.String()
+	buf := make([]byte, h.DescriptorSize*SECTOR_SIZE)
+	if len(text) > len(buf) {
+		return errors.New("descriptor does not fit into the embedded descriptor area")
+	}
+	copy(buf, text)
+	if err := sd.writeAtOffset(w, int64(h.DescriptorOffset)*SECTOR_SIZE, buf); err != nil {
+		return err
+	}
+	sd.modified = true
+	return nil
+}
+
+// WriteAt writes p at the given offset of the virtual disk. Every extent
+// touched by the write must support writing.
+func (v *VMDK) WriteAt(p []byte, offset int64) (int, error) {
+	return writeAtSectors(v, p, offset)
+}
+
+// WriteSectors method for VMDK
+func (v *VMDK) WriteSectors(sector int64, data []byte) error {
+	if err := v.markModified(); err != nil {
+		return err
+	}
+
+	diskIdx := bisectRight(v.DiskOffsets, sector)
+	for len(data) > 0 {
+		if diskIdx >= len(v.Disks) {
+			return fmt.Errorf("out of bounds disk, disk count: %v, requested: %v", len(v.Disks), sector)
+		}
+		disk, ok := v.Disks[diskIdx].(WritableDisk)
+		if !ok {
+			return ErrReadOnly
+		}
+		diskRemainingSectors := disk.GetSectorCount() - (sector - disk.GetSectorOffset())
+		count := min(diskRemainingSectors, int64(len(data)/SECTOR_SIZE))
+		if err := disk.WriteSectors(sector, data[:count*SECTOR_SIZE]); err != nil {
+			return err
+		}
+
+		data = data[count*SECTOR_SIZE:]
+		sector += count
+		diskIdx++
+	}
+	return nil
+}
+
+// markModified gives the descriptor file a new CID on the first write.
+func (v *VMDK) markModified() error {
+	if v.modified || v.Descriptor == nil {
+		return nil
+	}
+	w, ok := v.descriptorFh.(io.WriteSeeker)
+	if !ok {
+		return ErrReadOnly
+	}
+
+	v.Descriptor.bumpCID()
+	if err := writeDescriptor(w, v.Descriptor); err != nil {
+		return err
+	}
+	v.modified = true
+	return nil
+}
+
+type sectorReadWriter interface {
+	ReadSectors(sector int64, count int) ([]byte, error)
+	WriteSectors(sector int64, data []byte) error
+}
+
+func writeAtSectors(d sectorReadWriter, p []byte, offset int64) (int, error) {
+	sector := offset / SECTOR_SIZE
+	offsetInSector := int(offset % SECTOR_SIZE)
+	sectorCount := (offsetInSector + len(p) + SECTOR_SIZE - 1) / SECTOR_SIZE
+	if sectorCount == 0 {
+		return 0, nil
+	}
+
+	var buf []byte
+	if offsetInSector == 0 && len(p)%SECTOR_SIZE == 0 {
+		buf = p
+	} else {
+		// only the first and last sectors can be partially covered
+		buf = make([]byte, sectorCount*SECTOR_SIZE)
+		first, err := d.ReadSectors(sector, 1)
+		if err != nil {
+			return 0, err
+		}
+		copy(buf, first)
+		if sectorCount > 1 {
+			last, err := d.ReadSectors(sector+int64(sectorCount)-1, 1)
+			if err != nil {
+				return 0, err
+			}
+			copy(buf[(sectorCount-1)*SECTOR_SIZE:], last)
+		}
+		copy(buf[offsetInSector:], p)
+	}
+
+	if err := d.WriteSectors(sector, buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeDescriptor replaces the contents of a descriptor file. A file that
+// cannot be truncated keeps its size, with the text padded with NULs as in
+// embedded descriptors.
+func writeDescriptor(w io.WriteSeeker, descriptor *DiskDescriptor) error {
+	size, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	buf := []byte(descriptor.String())
+	t, truncatable := w.(interface{ Truncate(int64) error })
+	if !truncatable && int64(len(buf)) < size {
+		buf = append(buf, make([]byte, size-int64(len(buf)))...)
+	}
+
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	if truncatable {
+		return t.Truncate(int64(len(buf)))
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSparseExtent writes an empty monolithicSparse extent whose second
+// grain directory entry has no grain tables yet.
+func newTestSparseExtent(t *testing.T, capacity uint64) *os.File {
+	fh, err := os.OpenFile(filepath.Join(t.TempDir(), "test.vmdk"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fh.Close() })
+
+	descriptor := newDescriptorText(CREATE_TYPE_MONOLITHIC_SPARSE, capacity, "", []DiskExtent{
+		{AccessType: "RW", Size: int64(capacity), ExtentType: "SPARSE", Filename: "test.vmdk"},
+	})
+	if err := writeSparseExtent(fh, capacity, DEFAULT_GRAIN_SIZE, []byte(descriptor)); err != nil {
+		t.Fatal(err)
+	}
+
+	var header VMDKSparseExtentHeader
+	if err := binary.Read(io.NewSectionReader(fh, 0, SECTOR_SIZE), binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	for _, gd := range []uint64{header.PrimaryGrainDirectoryOffset, header.SecondaryGrainDirectoryOffset} {
+		if _, err := fh.WriteAt(make([]byte, 4), int64(gd)*SECTOR_SIZE+4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fh
+}
+
+// grainTableEntry returns the grain table entry of grain through the grain
+// directory at gdOffset.
+func grainTableEntry(t *testing.T, fh *os.File, gdOffset uint64, grain int64) uint32 {
+	entry := make([]byte, 4)
+	gdirEntry, gtblEntry := grain/DEFAULT_NUM_GRAIN_TABLE_ENTRIES, grain%DEFAULT_NUM_GRAIN_TABLE_ENTRIES
+	if _, err := fh.ReadAt(entry, int64(gdOffset)*SECTOR_SIZE+gdirEntry*4); err != nil {
+		t.Fatal(err)
+	}
+	gt := binary.LittleEndian.Uint32(entry)
+	if gt == 0 {
+		return 0
+	}
+	if _, err := fh.ReadAt(entry, int64(gt)*SECTOR_SIZE+gtblEntry*4); err != nil {
+		t.Fatal(err)
+	}
+	return binary.LittleEndian.Uint32(entry)
+}
+
+func TestSparseDiskWrite(t *testing.T) {
+	// two grain tables, the second one not allocated
+	capacity := uint64(2 * DEFAULT_NUM_GRAIN_TABLE_ENTRIES * DEFAULT_GRAIN_SIZE)
+	fh := newTestSparseExtent(t, capacity)
+
+	sd, err := NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	cid := sd.descriptor.Attr["CID"]
+	h, _ := sd.header.AsVMDK()
+	grainBytes := int64(DEFAULT_GRAIN_SIZE * SECTOR_SIZE)
+	want := make([]byte, capacity*SECTOR_SIZE)
+
+	// a whole grain in the existing, empty grain table
+	data := newTestDiskData(int(grainBytes))
+	if _, err := sd.WriteAt(data, grainBytes); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	copy(want[grainBytes:], data)
+
+	// a partial write keeps the rest of the grain
+	partial := bytes.Repeat([]byte{0xee}, 700)
+	if _, err := sd.WriteAt(partial, grainBytes+1003); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	copy(want[grainBytes+1003:], partial)
+
+	// a partial write into a grain table that has to be allocated
+	tail := DEFAULT_NUM_GRAIN_TABLE_ENTRIES * grainBytes
+	if _, err := sd.WriteAt(partial, tail+13); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	copy(want[tail+13:], partial)
+
+	for _, grain := range []int64{1, DEFAULT_NUM_GRAIN_TABLE_ENTRIES} {
+		primary := grainTableEntry(t, fh, h.PrimaryGrainDirectoryOffset, grain)
+		redundant := grainTableEntry(t, fh, h.SecondaryGrainDirectoryOffset, grain)
+		if primary == 0 || primary != redundant {
+			t.Fatalf("grain %d: primary entry %d, redundant entry %d", grain, primary, redundant)
+		}
+	}
+
+	sd, err = NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	if got := sd.descriptor.Attr["CID"]; got == cid {
+		t.Fatalf("CID = %s was not changed by the write", got)
+	}
+	got, err := sd.ReadSectors(0, int(capacity))
+	if err != nil {
+		t.Fatalf("ReadSectors() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("ReadSectors() data does not match written data")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestSparseDiskMarkModifiedError(t *testing.T) {
+	fh := newTestSparseExtent(t, DEFAULT_GRAIN_SIZE)
+	sd, err := NewSparseDisk(fh, nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+
+	if err := sd.markModified(failingWriter{}); err == nil {
+		t.Fatal("markModified() error = nil, want write error")
+	}
+	if sd.modified {
+		t.Fatal("disk is marked modified although the CID was not written")
+	}
+	if err := sd.markModified(fh); err != nil || !sd.modified {
+		t.Fatalf("markModified() error = %v, modified = %v", err, sd.modified)
+	}
+}
+
+func TestWriteDescriptor(t *testing.T) {
+	long := newDescriptorText(CREATE_TYPE_MONOLITHIC_FLAT, 2048, "", []DiskExtent{
+		{AccessType: "RW", Size: 2048, ExtentType: "FLAT", Filename: "test-flat.vmdk"},
+	})
+	descriptor, err := ParseDiskDescriptor(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor.Attr["createType"] = CREATE_TYPE_VMFS
+	short := descriptor.String()
+	if len(short) >= len(long) {
+		t.Fatalf("rewritten descriptor is %d bytes, want less than %d", len(short), len(long))
+	}
+
+	for _, truncatable := range []bool{true, false} {
+		fh, err := os.OpenFile(filepath.Join(t.TempDir(), "test.vmdk"), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fh.Close()
+		if _, err := fh.WriteString(long); err != nil {
+			t.Fatal(err)
+		}
+
+		var w io.WriteSeeker = fh
+		if !truncatable {
+			// hide Truncate
+			w = struct{ io.WriteSeeker }{fh}
+		}
+		if err := writeDescriptor(w, descriptor); err != nil {
+			t.Fatalf("writeDescriptor() error = %v", err)
+		}
+
+		data, err := os.ReadFile(fh.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []byte(short)
+		if !truncatable {
+			want = append(want, make([]byte, len(long)-len(short))...)
+		}
+		if !bytes.Equal(data, want) {
+			t.Fatalf("truncatable %v: descriptor file = %q, want %q", truncatable, data, want)
+		}
+		parsed, err := ParseDiskDescriptor(string(data))
+		if err != nil || parsed.Attr["createType"] != CREATE_TYPE_VMFS {
+			t.Fatalf("ParseDiskDescriptor() = %v, %v", parsed, err)
+		}
+	}
+}
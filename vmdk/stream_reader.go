@@ -0,0 +1,179 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StreamReader reads a streamOptimized VMDK sequentially from a plain
+// io.Reader, following the grain markers instead of the grain directory, and
+// emits the virtual disk contents in order.
+type StreamReader struct {
+	r          io.Reader
+	header     VMDKSparseExtentHeader
+	descriptor *DiskDescriptor
+	size       int64
+
+	pos           int64
+	pending       []byte
+	pendingOffset int64
+	eos           bool
+}
+
+func NewStreamReader(r io.Reader) (*StreamReader, error) {
+	sr := &StreamReader{r: r}
+	if err := binary.Read(r, binary.LittleEndian, &sr.header); err != nil {
+		return nil, err
+	}
+	if string(sr.header.Magic[:]) != VMDK_MAGIC {
+		return nil, fmt.Errorf("sparse extent not supported: %s", sr.header.Magic[:])
+	}
+	if !sr.header.IsCompressed() || !sr.header.IsEmeddedLBA() {
+		return nil, errors.New("vmdk extent is not streamOptimized")
+	}
+
+	consumed := uint64(1)
+	if sr.header.DescriptorSize > 0 {
+		if sr.header.DescriptorOffset < consumed {
+			return nil, fmt.Errorf("invalid descriptor offset: %d", sr.header.DescriptorOffset)
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(sr.header.DescriptorOffset-consumed)*SECTOR_SIZE); err != nil {
+			return nil, err
+		}
+		descriptorBuf := make([]byte, sr.header.DescriptorSize*SECTOR_SIZE)
+		if _, err := io.ReadFull(r, descriptorBuf); err != nil {
+			return nil, err
+		}
+		var err error
+		sr.descriptor, err = ParseDiskDescriptor(string(descriptorBuf))
+		if err != nil {
+			return nil, err
+		}
+		consumed = sr.header.DescriptorOffset + sr.header.DescriptorSize
+	}
+	if sr.header.Overhead > consumed {
+		if _, err := io.CopyN(io.Discard, r, int64(sr.header.Overhead-consumed)*SECTOR_SIZE); err != nil {
+			return nil, err
+		}
+	}
+
+	sr.size = int64(sr.header.Capacity) * SECTOR_SIZE
+	sr.pendingOffset = -1
+	return sr, nil
+}
+
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && sr.pos < sr.size {
+		if sr.pendingOffset < 0 && !sr.eos {
+			if err := sr.nextGrain(); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		zeroUntil := sr.size
+		if !sr.eos {
+			zeroUntil = sr.pendingOffset
+		}
+		if sr.pos < zeroUntil {
+			count := int(min(int64(len(p)-n), zeroUntil-sr.pos))
+			clear(p[n : n+count])
+			n += count
+			sr.pos += int64(count)
+			continue
+		}
+
+		count := copy(p[n:], sr.pending[sr.pos-sr.pendingOffset:])
+		n += count
+		sr.pos += int64(count)
+		if sr.pos-sr.pendingOffset >= int64(len(sr.pending)) {
+			sr.pending = nil
+			sr.pendingOffset = -1
+		}
+	}
+
+	if n == 0 && sr.pos >= sr.size {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// nextGrain consumes markers until the next grain or the end of stream. A
+// stream ending before its end-of-stream marker is truncated.
+func (sr *StreamReader) nextGrain() error {
+	sector := make([]byte, SECTOR_SIZE)
+	for {
+		if _, err := io.ReadFull(sr.r, sector); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		var marker StreamMarker
+		if err := binary.Read(bytes.NewReader(sector), binary.LittleEndian, &marker); err != nil {
+			return err
+		}
+
+		if marker.Size != 0 {
+			return sr.readGrain(sector, marker.NumSectors, marker.Size)
+		}
+
+		switch marker.Type {
+		case MARKER_EOS:
+			sr.eos = true
+			return nil
+		case MARKER_GT, MARKER_GD, MARKER_FOOTER:
+			if _, err := io.CopyN(io.Discard, sr.r, int64(marker.NumSectors)*SECTOR_SIZE); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown stream marker type: %d", marker.Type)
+		}
+	}
+}
+
+func (sr *StreamReader) readGrain(sector []byte, lba uint64, cmpSize uint32) error {
+	offset := int64(lba) * SECTOR_SIZE
+	if offset < sr.pos {
+		return fmt.Errorf("grain at sector %d is out of order", lba)
+	}
+
+	headerLen := 12
+	total := (headerLen + int(cmpSize) + SECTOR_SIZE - 1) / SECTOR_SIZE * SECTOR_SIZE
+	buf := make([]byte, total)
+	copy(buf, sector)
+	if _, err := io.ReadFull(sr.r, buf[SECTOR_SIZE:]); err != nil {
+		return err
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(buf[headerLen : headerLen+int(cmpSize)]))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	if offset+int64(len(data)) > sr.size {
+		data = data[:max(0, sr.size-offset)]
+	}
+	sr.pending = data
+	sr.pendingOffset = offset
+	return nil
+}
+
+func (sr *StreamReader) Size() int64 {
+	return sr.size
+}
+
+func (sr *StreamReader) Descriptor() *DiskDescriptor {
+	return sr.descriptor
+}
@@ -0,0 +1,62 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestStreamReaderRoundTrip(t *testing.T) {
+	data := newTestDiskData(1100*65536 + 5*SECTOR_SIZE)
+
+	var out bytes.Buffer
+	err := WriteStreamOptimized(&out, bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("WriteStreamOptimized() error = %v", err)
+	}
+
+	sr, err := NewStreamReader(struct{ io.Reader }{&out})
+	if err != nil {
+		t.Fatalf("NewStreamReader() error = %v", err)
+	}
+	if got, want := sr.Size(), int64(len(data)); got != want {
+		t.Fatalf("Size() = %d, want %d", got, want)
+	}
+
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("streamed data does not match source")
+	}
+}
+
+func TestStreamReaderInvalid(t *testing.T) {
+	// the second grain is zero, so reading it needs the markers up to EOS
+	data := newTestDiskData(2 * 65536)
+	var out bytes.Buffer
+	if err := WriteStreamOptimized(&out, bytes.NewReader(data), int64(len(data)), nil); err != nil {
+		t.Fatalf("WriteStreamOptimized() error = %v", err)
+	}
+	image := out.Bytes()
+
+	t.Run("missing eos", func(t *testing.T) {
+		sr, err := NewStreamReader(bytes.NewReader(image[:len(image)-SECTOR_SIZE]))
+		if err != nil {
+			t.Fatalf("NewStreamReader() error = %v", err)
+		}
+		if _, err := io.ReadAll(sr); err != io.ErrUnexpectedEOF {
+			t.Fatalf("ReadAll() error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+
+	t.Run("descriptor offset", func(t *testing.T) {
+		corrupt := bytes.Clone(image)
+		binary.LittleEndian.PutUint64(corrupt[28:], 0)
+		if _, err := NewStreamReader(bytes.NewReader(corrupt)); err == nil {
+			t.Fatal("NewStreamReader() accepted a descriptor offset inside the header")
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// StreamMarker is the sector-sized metadata marker of streamOptimized
+// extents. Grain markers share the first 12 bytes with SparseGrainLBAHeader.
+type StreamMarker struct {
+	NumSectors uint64
+	Size       uint32
+	Type       uint32
+	Pad        [496]byte
+}
+
+type StreamOptimizedOptions struct {
+	// Filename is the extent file name written into the embedded descriptor.
+	Filename    string
+	AdapterType string
+	// GrainSize in sectors, defaults to 128.
+	GrainSize uint64
+	// CompressionLevel is passed to zlib, nil selects zlib.DefaultCompression.
+	CompressionLevel *int
+}
+
+type streamWriter struct {
+	w      io.Writer
+	sector uint64
+}
+
+func (sw *streamWriter) write(data []byte) error {
+	pad := (SECTOR_SIZE - len(data)%SECTOR_SIZE) % SECTOR_SIZE
+	if _, err := sw.w.Write(data); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(make([]byte, pad)); err != nil {
+		return err
+	}
+	sw.sector += uint64(len(data)+pad) / SECTOR_SIZE
+	return nil
+}
+
+func (sw *streamWriter) writeMarker(markerType uint32, numSectors uint64) error {
+	var buf bytes.Buffer
+	marker := StreamMarker{NumSectors: numSectors, Type: markerType}
+	if err := binary.Write(&buf, binary.LittleEndian, &marker); err != nil {
+		return err
+	}
+	return sw.write(buf.Bytes())
+}
+
+// WriteStreamOptimized writes size bytes of src into w as a streamOptimized
+// VMDK. Grains that contain only zeros are not stored.
+func WriteStreamOptimized(w io.Writer, src io.ReaderAt, size int64, opts *StreamOptimizedOptions) error {
+	if opts == nil {
+		opts = &StreamOptimizedOptions{}
+	}
+	grainSize := opts.GrainSize
+	if grainSize == 0 {
+		grainSize = DEFAULT_GRAIN_SIZE
+	}
+	level := zlib.DefaultCompression
+	if opts.CompressionLevel != nil {
+		level = *opts.CompressionLevel
+	}
+	filename := opts.Filename
+	if filename == "" {
+		filename = "disk.vmdk"
+	}
+
+	capacity := uint64(size+SECTOR_SIZE-1) / SECTOR_SIZE
+	numGTEsPerGT := uint64(DEFAULT_NUM_GRAIN_TABLE_ENTRIES)
+	grainCount := (capacity + grainSize - 1) / grainSize
+	gtCount := (grainCount + numGTEsPerGT - 1) / numGTEsPerGT
+	gtSectors := numGTEsPerGT * 4 / SECTOR_SIZE
+	gdSectors := (gtCount*4 + SECTOR_SIZE - 1) / SECTOR_SIZE
+
+	descriptor := []byte(newDescriptorText(CREATE_TYPE_STREAM_OPTIMIZED, capacity, opts.AdapterType, []DiskExtent{
+		{AccessType: "RW", Size: int64(capacity), ExtentType: "SPARSE", Filename: filename},
+	}))
+	descriptorSectors := uint64(len(descriptor)+SECTOR_SIZE-1) / SECTOR_SIZE
+	overhead := (1 + descriptorSectors + grainSize - 1) / grainSize * grainSize
+
+	header := VMDKSparseExtentHeader{
+		Version:              3,
+		Flags:                SPARSEFLAG_VALID_NEWLINE_DETECTOR | SPARSEFLAG_COMPRESSED | SPARSEFLAG_EMBEDDED_LBA,
+		Capacity:             capacity,
+		GrainSize:            grainSize,
+		DescriptorOffset:     1,
+		DescriptorSize:       descriptorSectors,
+		NumGrainTableEntries: uint32(numGTEsPerGT),
+		Overhead:             overhead,
+		SingleEndLineChar:    '\n',
+		NonEndLineChar:       ' ',
+		DoubleEndLineChars:   [2]byte{'\r', '\n'},
+		CompressAlgorithm:    SPARSE_COMPRESSALGORITHM_DEFLATE,
+	}
+	copy(header.Magic[:], VMDK_MAGIC)
+	header.PrimaryGrainDirectoryOffset = SPARSE_GD_AT_END
+
+	sw := &streamWriter{w: w}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := sw.write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := sw.write(descriptor); err != nil {
+		return err
+	}
+	if err := sw.write(make([]byte, (overhead-sw.sector)*SECTOR_SIZE)); err != nil {
+		return err
+	}
+
+	gd := make([]uint32, gtCount)
+	gt := make([]uint32, numGTEsPerGT)
+	grainBuf := make([]byte, grainSize*SECTOR_SIZE)
+	zero := make([]byte, len(grainBuf))
+	gtAllocated := false
+
+	for grain := uint64(0); grain < grainCount; grain++ {
+		// the last grain may extend past size, which is zero filled
+		offset := int64(grain * grainSize * SECTOR_SIZE)
+		length := min(int64(len(grainBuf)), size-offset)
+		clear(grainBuf[length:])
+		if n, err := src.ReadAt(grainBuf[:length], offset); int64(n) < length {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("reading vmdk source at %d: %w", offset+int64(n), err)
+		}
+
+		if !bytes.Equal(grainBuf, zero) {
+			gt[grain%numGTEsPerGT] = uint32(sw.sector)
+			gtAllocated = true
+			data, err := compressGrain(grainBuf, grain*grainSize, level)
+			if err != nil {
+				return err
+			}
+			if err := sw.write(data); err != nil {
+				return err
+			}
+		}
+
+		if (grain+1)%numGTEsPerGT != 0 && grain+1 != grainCount {
+			continue
+		}
+		if gtAllocated {
+			if err := sw.writeMarker(MARKER_GT, gtSectors); err != nil {
+				return err
+			}
+			gd[grain/numGTEsPerGT] = uint32(sw.sector)
+			if err := sw.write(uint32Bytes(gt)); err != nil {
+				return err
+			}
+		}
+		clear(gt)
+		gtAllocated = false
+	}
+
+	if err := sw.writeMarker(MARKER_GD, gdSectors); err != nil {
+		return err
+	}
+	header.PrimaryGrainDirectoryOffset = sw.sector
+	if err := sw.write(uint32Bytes(gd)); err != nil {
+		return err
+	}
+
+	if err := sw.writeMarker(MARKER_FOOTER, 1); err != nil {
+		return err
+	}
+	buf.Reset()
+	if err := binary.Write(&buf, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := sw.write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return sw.writeMarker(MARKER_EOS, 0)
+}
+
+// compressGrain deflates a grain and prefixes it with its LBA header.
+func compressGrain(data []byte, lba uint64, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 12))
+	zw, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	out := buf.Bytes()
+	binary.LittleEndian.PutUint64(out[0:8], lba)
+	binary.LittleEndian.PutUint32(out[8:12], uint32(len(out)-12))
+	return out, nil
+}
+
+func uint32Bytes(values []uint32) []byte {
+	buf := make([]byte, len(values)*4)
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(buf[i*4:], v)
+	}
+	return buf
+}
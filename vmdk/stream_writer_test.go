@@ -0,0 +1,86 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newTestDiskData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		// leave every other 64KiB grain zeroed
+		if (i/65536)%2 == 0 {
+			data[i] = byte(i*7 + i/512)
+		}
+	}
+	return data
+}
+
+func TestWriteStreamOptimizedRoundTrip(t *testing.T) {
+	data := newTestDiskData(40*65536 + 3*SECTOR_SIZE)
+
+	var out bytes.Buffer
+	err := WriteStreamOptimized(&out, bytes.NewReader(data), int64(len(data)), &StreamOptimizedOptions{Filename: "test.vmdk"})
+	if err != nil {
+		t.Fatalf("WriteStreamOptimized() error = %v", err)
+	}
+
+	sd, err := NewSparseDisk(bytes.NewReader(out.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	if got, want := sd.GetSectorCount(), int64(len(data)/SECTOR_SIZE); got != want {
+		t.Fatalf("GetSectorCount() = %d, want %d", got, want)
+	}
+	if got, want := sd.descriptor.Attr["createType"], "streamOptimized"; got != want {
+		t.Fatalf("createType = %q, want %q", got, want)
+	}
+
+	got, err := sd.ReadSectors(0, len(data)/SECTOR_SIZE)
+	if err != nil {
+		t.Fatalf("ReadSectors() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("ReadSectors() data does not match source")
+	}
+}
+
+func TestWriteStreamOptimizedOptions(t *testing.T) {
+	// the source extends past size; those bytes must not reach the image
+	src := bytes.Repeat([]byte{0x5a}, 3*65536)
+	size := int64(65536 + 1000)
+	level := zlib.NoCompression
+
+	var out bytes.Buffer
+	err := WriteStreamOptimized(&out, bytes.NewReader(src), size, &StreamOptimizedOptions{CompressionLevel: &level})
+	if err != nil {
+		t.Fatalf("WriteStreamOptimized() error = %v", err)
+	}
+	if out.Len() < int(size) {
+		t.Fatalf("image is %d bytes, smaller than the stored data", out.Len())
+	}
+
+	sd, err := NewSparseDisk(bytes.NewReader(out.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("NewSparseDisk() error = %v", err)
+	}
+	got, err := sd.ReadSectors(0, int(sd.GetSectorCount()))
+	if err != nil {
+		t.Fatalf("ReadSectors() error = %v", err)
+	}
+	want := make([]byte, len(got))
+	copy(want, src[:size])
+	if !bytes.Equal(got, want) {
+		t.Fatal("data past size was written into the image")
+	}
+
+	// a source shorter than size is an error, not zero padding
+	out.Reset()
+	err = WriteStreamOptimized(&out, bytes.NewReader(src[:size-1]), size, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("WriteStreamOptimized() from a short source error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
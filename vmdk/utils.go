@@ -1,6 +1,11 @@
 package vmdk
 
-import "io"
+import (
+	"io"
+	"math/rand/v2"
+	"path"
+	"strings"
+)
 
 func getSize(fh io.ReadSeeker) (int64, error) {
 	_, err := fh.Seek(0, io.SeekEnd)
@@ -18,6 +23,16 @@ func getSize(fh io.ReadSeeker) (int64, error) {
 	return size, nil
 }
 
+// resolvePath resolves a file name from a descriptor, .vmx or .vmsd file
+// against the directory of the file referencing it. Absolute paths are kept.
+func resolvePath(dir, name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || dir == "" || dir == "." || path.IsAbs(name) || (len(name) > 1 && name[1] == ':') {
+		return name
+	}
+	return path.Join(dir, name)
+}
+
 func bisectRight(a []int64, x int64) int {
 	lo, hi := 0, len(a)
 	for lo < hi {
@@ -37,3 +52,29 @@ func min32(a, b int) int {
 	}
 	return b
 }
+
+// diskGeometry returns the CHS geometry VMware records in the DDB for a disk
+// of capacity sectors.
+func diskGeometry(capacity uint64, adapterType string) (cylinders, heads, sectors uint64) {
+	heads, sectors = 255, 63
+	if adapterType == "ide" {
+		heads = 16
+	}
+	cylinders = capacity / (heads * sectors)
+	if adapterType == "ide" && cylinders > 16383 {
+		cylinders = 16383
+	}
+	if cylinders == 0 {
+		cylinders = 1
+	}
+	return cylinders, heads, sectors
+}
+
+func newCID() uint32 {
+	for {
+		cid := rand.Uint32()
+		if cid != 0xFFFFFFFF && cid != 0xFFFFFFFE {
+			return cid
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path"
 	"strings"
 )
 
@@ -22,6 +23,15 @@ type VMDK struct {
 	DiskOffsets []int64
 	SectorCount int64
 	Size        int64
+	// ParentCIDMismatch is set when OpenOptions.LenientParentCID let a parent
+	// with a non-matching or unreadable CID be opened.
+	ParentCIDMismatch *CIDMismatchError
+
+	descriptorFh io.ReadSeeker
+	modified     bool
+	// dir is the directory relative extent and parent names are resolved
+	// against, empty when the disk was not opened by name.
+	dir string
 }
 
 type FileAccessorFn func(string) (io.ReadSeeker, error)
@@ -30,12 +40,53 @@ var FileAccessor FileAccessorFn
 
 var ErrFileAccessorNotAvailable = errors.New("file accessor needed to access for parent and extents from file")
 
+// DeviceAccessorFn opens the device behind a raw device mapping or a
+// partitionedDevice/fullDevice extent. The returned reader may be the block
+// device itself or an image copied from it.
+type DeviceAccessorFn func(extent DiskExtent) (io.ReadSeeker, error)
+
+var DeviceAccessor DeviceAccessorFn
+
+var ErrDeviceAccessorNotAvailable = errors.New("device accessor needed to access raw device mapped extents")
+
+// OpenOptions changes how NewVMDKWithOptions opens a disk and its parents.
+type OpenOptions struct {
+	// LenientParentCID opens parents whose CID does not match, or cannot be
+	// compared with, the parentCID of the child instead of failing. The
+	// mismatch is recorded in ParentCIDMismatch.
+	LenientParentCID bool
+}
+
+// CIDMismatchError is returned when the CID of a parent disk does not match
+// the parentCID recorded in its child, i.e. the parent was modified after
+// the child was created.
+type CIDMismatchError struct {
+	ParentFileNameHint string
+	ParentCID          string
+	CID                string
+}
+
+func (e *CIDMismatchError) Error() string {
+	return fmt.Sprintf("parent %s has CID %s, child expects parentCID %s", e.ParentFileNameHint, e.CID, e.ParentCID)
+}
+
 func NewVMDK(fhs []io.ReadSeeker) (*VMDK, error) {
+	return NewVMDKWithOptions(fhs, nil)
+}
+
+func NewVMDKWithOptions(fhs []io.ReadSeeker, opts *OpenOptions) (*VMDK, error) {
+	return newVMDK(fhs, "", opts)
+}
+
+func newVMDK(fhs []io.ReadSeeker, dir string, opts *OpenOptions) (*VMDK, error) {
 	if FileAccessor == nil {
 		return nil, ErrFileAccessorNotAvailable
 	}
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
 
-	vmdk := &VMDK{}
+	vmdk := &VMDK{dir: dir}
 	for _, fh := range fhs {
 		magic := make([]byte, 4)
 		_, err := fh.Read(magic)
@@ -61,31 +112,22 @@ func NewVMDK(fhs []io.ReadSeeker) (*VMDK, error) {
 			if err != nil {
 				return nil, err
 			}
+			vmdk.descriptorFh = fh
 			if vmdk.Descriptor.Attr["parentCID"] != "ffffffff" {
-				vmdk.Parent, err = openParent(vmdk.Descriptor.Attr["parentFileNameHint"])
+				vmdk.Parent, err = openDiskFile(resolvePath(dir, vmdk.Descriptor.Attr["parentFileNameHint"]), opts)
 				if err != nil {
 					return nil, err
 				}
+				if err := vmdk.validateParentCID(vmdk.Descriptor, vmdk.Parent, opts.LenientParentCID); err != nil {
+					return nil, err
+				}
 			}
 			for _, extent := range vmdk.Descriptor.Extents {
-				extentFile, err := FileAccessor(extent.Filename)
+				disk, err := vmdk.openExtent(extent)
 				if err != nil {
 					return nil, err
 				}
-				switch extent.ExtentType {
-				case "SPARSE", "VMFSSPARSE", "SESPARSE":
-					sd, err := NewSparseDisk(extentFile, vmdk.Parent)
-					if err != nil {
-						return nil, err
-					}
-					vmdk.Disks = append(vmdk.Disks, sd)
-				case "VMFS", "FLAT":
-					rd, err := NewRawDisk(extentFile, extent.Size*SECTOR_SIZE)
-					if err != nil {
-						return nil, err
-					}
-					vmdk.Disks = append(vmdk.Disks, rd)
-				}
+				vmdk.Disks = append(vmdk.Disks, disk)
 			}
 		case COWD_MAGIC, VMDK_MAGIC, SESPARSE_MAGIC:
 			sparseDisk, err := NewSparseDisk(fh, nil)
@@ -93,10 +135,13 @@ func NewVMDK(fhs []io.ReadSeeker) (*VMDK, error) {
 				return nil, err
 			}
 			if sparseDisk.descriptor != nil && sparseDisk.descriptor.Attr["parentCID"] != "ffffffff" {
-				sparseDisk.parent, err = openParent(sparseDisk.descriptor.Attr["parentFileNameHint"])
+				sparseDisk.parent, err = openDiskFile(resolvePath(dir, sparseDisk.descriptor.Attr["parentFileNameHint"]), opts)
 				if err != nil {
 					return nil, err
 				}
+				if err := vmdk.validateParentCID(sparseDisk.descriptor, sparseDisk.parent, opts.LenientParentCID); err != nil {
+					return nil, err
+				}
 			}
 			vmdk.Disks = append(vmdk.Disks, sparseDisk)
 		default:
@@ -123,6 +168,70 @@ func NewVMDK(fhs []io.ReadSeeker) (*VMDK, error) {
 	return vmdk, nil
 }
 
+// openExtent opens the backing disk of a descriptor extent. Every extent
+// yields a disk so the following extents keep their position.
+func (v *VMDK) openExtent(extent DiskExtent) (Disk, error) {
+	if extent.AccessType == "NOACCESS" {
+		return NewZeroDisk(extent.Size*SECTOR_SIZE, true), nil
+	}
+	if extent.ExtentType == "ZERO" {
+		return NewZeroDisk(extent.Size*SECTOR_SIZE, false), nil
+	}
+
+	switch extent.ExtentType {
+	case "SPARSE", "VMFSSPARSE", "SESPARSE":
+		extentFile, err := FileAccessor(resolvePath(v.dir, extent.Filename))
+		if err != nil {
+			return nil, err
+		}
+		return NewSparseDisk(extentFile, v.Parent)
+	case "VMFSRDM", "VMFSRAW":
+		device, err := openDevice(extent)
+		if err != nil {
+			return nil, err
+		}
+		return NewRawDiskAt(device, extent.Size*SECTOR_SIZE, extent.StartSector)
+	case "VMFS", "FLAT":
+		if v.isDeviceExtent(extent) {
+			device, err := openDevice(extent)
+			if err != nil {
+				return nil, err
+			}
+			return NewRawDiskAt(device, extent.Size*SECTOR_SIZE, extent.StartSector)
+		}
+		extentFile, err := FileAccessor(resolvePath(v.dir, extent.Filename))
+		if err != nil {
+			return nil, err
+		}
+		return NewRawDiskAt(extentFile, extent.Size*SECTOR_SIZE, extent.StartSector)
+	default:
+		return nil, fmt.Errorf("unsupported extent type: %s", extent.ExtentType)
+	}
+}
+
+// isDeviceExtent reports whether a FLAT extent of a Workstation
+// partitionedDevice or fullDevice disk refers to a physical device rather
+// than a file next to the descriptor.
+func (v *VMDK) isDeviceExtent(extent DiskExtent) bool {
+	if v.Descriptor == nil {
+		return false
+	}
+	switch v.Descriptor.Attr["createType"] {
+	case CREATE_TYPE_PARTITIONED_DEVICE, CREATE_TYPE_FULL_DEVICE:
+	default:
+		return false
+	}
+	name := extent.Filename
+	return strings.HasPrefix(name, "/dev/") || strings.HasPrefix(name, `\\.\`) || strings.HasPrefix(name, "//./")
+}
+
+func openDevice(extent DiskExtent) (io.ReadSeeker, error) {
+	if DeviceAccessor == nil {
+		return nil, ErrDeviceAccessorNotAvailable
+	}
+	return DeviceAccessor(extent)
+}
+
 func (v *VMDK) ReadSectors(sector int64, count int) ([]byte, error) {
 	var sectorsRead []byte
 
@@ -175,12 +284,60 @@ func (v *VMDK) ReadAt(p []byte, offset int64) (int, error) {
 	return len(readData), nil
 }
 
-func openParent(filenameHint string) (*VMDK, error) {
-	filenameHint = strings.ReplaceAll(filenameHint, "\\", "/")
-	parentFh, err := FileAccessor(filenameHint)
+func openDiskFile(fileName string, opts *OpenOptions) (*VMDK, error) {
+	fileName = strings.ReplaceAll(fileName, "\\", "/")
+	parentFh, err := FileAccessor(fileName)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewVMDK([]io.ReadSeeker{parentFh})
+	return newVMDK([]io.ReadSeeker{parentFh}, path.Dir(fileName), opts)
+}
+
+// validateParentCID checks that the parent opened for descriptor is the disk
+// the child was created from. In lenient mode a mismatch, or a CID that
+// cannot be parsed, is recorded in ParentCIDMismatch instead of failing.
+func (v *VMDK) validateParentCID(descriptor *DiskDescriptor, parent *VMDK, lenient bool) error {
+	parentDescriptor := parent.descriptor()
+	if parentDescriptor == nil {
+		return nil
+	}
+
+	expected, actual := descriptor.Attr["parentCID"], parentDescriptor.Attr["CID"]
+	mismatch := &CIDMismatchError{
+		ParentFileNameHint: descriptor.Attr["parentFileNameHint"],
+		ParentCID:          expected,
+		CID:                actual,
+	}
+
+	expectedCID, err := parseCID(expected)
+	if err == nil {
+		var actualCID uint32
+		actualCID, err = parseCID(actual)
+		if err == nil && expectedCID == actualCID {
+			return nil
+		}
+	}
+	if !lenient {
+		if err != nil {
+			return err
+		}
+		return mismatch
+	}
+	v.ParentCIDMismatch = mismatch
+	return nil
+}
+
+// descriptor returns the descriptor of the disk, either from the descriptor
+// file or embedded in the first sparse extent.
+func (v *VMDK) descriptor() *DiskDescriptor {
+	if v.Descriptor != nil {
+		return v.Descriptor
+	}
+	for _, disk := range v.Disks {
+		if sd, ok := disk.(*SparseDisk); ok && sd.descriptor != nil {
+			return sd.descriptor
+		}
+	}
+	return nil
 }
@@ -0,0 +1,184 @@
+package vmdk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewVMDKExtentMapping(t *testing.T) {
+	dir := useTempDir(t)
+
+	backing := newTestDiskData(64 * SECTOR_SIZE)
+	if err := os.WriteFile(filepath.Join(dir, "backing-flat.vmdk"), backing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	descriptor := `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+RW 8 FLAT "backing-flat.vmdk" 16
+RW 4 ZERO
+RDONLY 8 FLAT "backing-flat.vmdk" 40
+NOACCESS 2 FLAT "missing-flat.vmdk"
+`
+	disk, err := NewVMDK([]io.ReadSeeker{bytes.NewReader([]byte(descriptor))})
+	if err != nil {
+		t.Fatalf("NewVMDK() error = %v", err)
+	}
+	if got, want := disk.SectorCount, int64(22); got != want {
+		t.Fatalf("SectorCount = %d, want %d", got, want)
+	}
+
+	got := make([]byte, 20*SECTOR_SIZE)
+	if _, err := disk.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	want := append([]byte{}, backing[16*SECTOR_SIZE:24*SECTOR_SIZE]...)
+	want = append(want, make([]byte, 4*SECTOR_SIZE)...)
+	want = append(want, backing[40*SECTOR_SIZE:48*SECTOR_SIZE]...)
+	if !bytes.Equal(got, want) {
+		t.Fatal("ReadAt() data does not match extent mapping")
+	}
+
+	if _, err := disk.ReadAt(make([]byte, SECTOR_SIZE), 20*SECTOR_SIZE); err != ErrNoAccessExtent {
+		t.Fatalf("ReadAt() on NOACCESS extent error = %v, want %v", err, ErrNoAccessExtent)
+	}
+}
+
+func TestNewVMDKParentCID(t *testing.T) {
+	newTestChain(t, 1024*1024)
+
+	setParentCID := func(t *testing.T, parentCID string) {
+		fh, err := FileAccessor("delta.vmdk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptor, err := readDescriptor(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parentCID == "" {
+			delete(descriptor.Attr, "parentCID")
+		} else {
+			descriptor.Attr["parentCID"] = parentCID
+		}
+		if err := writeDescriptor(fh.(io.WriteSeeker), descriptor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(t *testing.T, lenient bool) (*VMDK, error) {
+		fh, err := FileAccessor("delta.vmdk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewVMDKWithOptions([]io.ReadSeeker{fh}, &OpenOptions{LenientParentCID: lenient})
+	}
+
+	disk, err := open(t, false)
+	if err != nil {
+		t.Fatalf("NewVMDKWithOptions() error = %v", err)
+	}
+	if disk.ParentCIDMismatch != nil {
+		t.Fatalf("ParentCIDMismatch = %v for a matching parent", disk.ParentCIDMismatch)
+	}
+	baseCID := disk.Parent.descriptor().Attr["CID"]
+
+	for _, tt := range []struct {
+		name      string
+		parentCID string
+		mismatch  bool
+	}{
+		{"mismatch", "0badc1d0", true},
+		{"unparseable", "not-a-cid", false},
+		{"missing", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setParentCID(t, tt.parentCID)
+
+			_, err := open(t, false)
+			var mismatch *CIDMismatchError
+			if err == nil || errors.As(err, &mismatch) != tt.mismatch {
+				t.Fatalf("NewVMDKWithOptions() error = %v", err)
+			}
+			if tt.mismatch && (mismatch.ParentCID != tt.parentCID || mismatch.CID != baseCID) {
+				t.Fatalf("CIDMismatchError = %+v", mismatch)
+			}
+
+			disk, err := open(t, true)
+			if err != nil {
+				t.Fatalf("lenient NewVMDKWithOptions() error = %v", err)
+			}
+			if disk.ParentCIDMismatch == nil || disk.ParentCIDMismatch.ParentCID != tt.parentCID {
+				t.Fatalf("ParentCIDMismatch = %+v", disk.ParentCIDMismatch)
+			}
+		})
+	}
+}
+
+func TestNewVMDKDeviceExtents(t *testing.T) {
+	dir := useTempDir(t)
+	backing := newTestDiskData(32 * SECTOR_SIZE)
+	if err := os.WriteFile(filepath.Join(dir, "disk-pt.vmdk"), backing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	device := bytes.Repeat([]byte{0xd5}, 64*SECTOR_SIZE)
+	copy(device[8*SECTOR_SIZE:], backing)
+
+	descriptors := map[string]string{
+		"rdm": `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="vmfsRawDeviceMap"
+
+RW 16 VMFSRDM "disk-rdm.vmdk"
+RW 16 VMFSRAW "disk-rawp.vmdk" 8
+`,
+		"partitionedDevice": `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="partitionedDevice"
+
+RW 16 FLAT "/dev/sda" 0
+RW 16 FLAT "disk-pt.vmdk" 0
+`,
+	}
+	wants := map[string][]byte{
+		"rdm":               append(append([]byte{}, device[:16*SECTOR_SIZE]...), device[8*SECTOR_SIZE:24*SECTOR_SIZE]...),
+		"partitionedDevice": append(append([]byte{}, device[:16*SECTOR_SIZE]...), backing[:16*SECTOR_SIZE]...),
+	}
+
+	for name, descriptor := range descriptors {
+		t.Run(name, func(t *testing.T) {
+			DeviceAccessor = nil
+			if _, err := NewVMDK([]io.ReadSeeker{bytes.NewReader([]byte(descriptor))}); err != ErrDeviceAccessorNotAvailable {
+				t.Fatalf("NewVMDK() error = %v, want %v", err, ErrDeviceAccessorNotAvailable)
+			}
+
+			var opened []string
+			DeviceAccessor = func(extent DiskExtent) (io.ReadSeeker, error) {
+				opened = append(opened, extent.Filename)
+				return bytes.NewReader(device), nil
+			}
+			t.Cleanup(func() { DeviceAccessor = nil })
+
+			disk, err := NewVMDK([]io.ReadSeeker{bytes.NewReader([]byte(descriptor))})
+			if err != nil {
+				t.Fatalf("NewVMDK() error = %v", err)
+			}
+			if name == "partitionedDevice" && (len(opened) != 1 || opened[0] != "/dev/sda") {
+				t.Fatalf("DeviceAccessor opened %q, want only /dev/sda", opened)
+			}
+			if !bytes.Equal(readTestDisk(t, disk), wants[name]) {
+				t.Fatal("ReadAt() data does not match the device extents")
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package vmdk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	diskNodeRegexp    = regexp.MustCompile(`^(scsi|sata|ide|nvme)\d+:\d+$`)
+	snapshotUIDRegexp = regexp.MustCompile(`^snapshot(\d+)\.uid$`)
+)
+
+// VMXDisk is a virtual disk attached to a device node such as scsi0:0.
+type VMXDisk struct {
+	Node     string
+	FileName string
+}
+
+type Snapshot struct {
+	UID         int
+	DisplayName string
+	Description string
+	Filename    string
+	CreateTime  time.Time
+	Disks       []VMXDisk
+	Parent      *Snapshot
+	Children    []*Snapshot
+
+	parentUID int
+}
+
+// VirtualMachine is the disk layout of a VMware VM folder, built from its
+// .vmx configuration and .vmsd snapshot database.
+type VirtualMachine struct {
+	Config          map[string]string
+	Disks           []VMXDisk
+	Snapshots       []*Snapshot
+	CurrentSnapshot *Snapshot
+}
+
+// ParseVMX parses the key = "value" format shared by .vmx and .vmsd files.
+// Keys are lower-cased as VMware treats them case-insensitively.
+func ParseVMX(r io.Reader) (map[string]string, error) {
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		config[key] = value
+	}
+	return config, scanner.Err()
+}
+
+// OpenVirtualMachine reads the .vmx file and, when present, the .vmsd file
+// next to it through FileAccessor. Relative file names in both are resolved
+// against the directory of the .vmx file.
+func OpenVirtualMachine(vmxName string) (*VirtualMachine, error) {
+	if FileAccessor == nil {
+		return nil, ErrFileAccessorNotAvailable
+	}
+
+	fh, err := FileAccessor(vmxName)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseVMX(fh)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Dir(vmxName)
+	vm := &VirtualMachine{Config: config, Disks: vmxDisks(config, dir)}
+
+	vmsdName := strings.TrimSuffix(vmxName, ".vmx") + ".vmsd"
+	if name, ok := config["snapshot.filename"]; ok {
+		vmsdName = resolvePath(dir, name)
+	}
+	fh, err = FileAccessor(vmsdName)
+	if err != nil {
+		// VMs without snapshots have no .vmsd file
+		return vm, nil
+	}
+	vmsd, err := ParseVMX(fh)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.loadSnapshots(vmsd, dir); err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+func vmxDisks(config map[string]string, dir string) []VMXDisk {
+	var disks []VMXDisk
+	for key, fileName := range config {
+		node, ok := strings.CutSuffix(key, ".filename")
+		if !ok || !diskNodeRegexp.MatchString(node) {
+			continue
+		}
+		if present, ok := config[node+".present"]; ok && !strings.EqualFold(present, "TRUE") {
+			continue
+		}
+		deviceType := strings.ToLower(config[node+".devicetype"])
+		if strings.Contains(deviceType, "cdrom") || !strings.HasSuffix(strings.ToLower(fileName), ".vmdk") {
+			continue
+		}
+		disks = append(disks, VMXDisk{Node: node, FileName: resolvePath(dir, fileName)})
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Node < disks[j].Node })
+	return disks
+}
+
+// loadSnapshots builds the snapshot tree of the .vmsd file. Snapshot indices
+// may have gaps after snapshots were deleted, so every snapshotN.uid key is
+// used rather than counting up to the first missing one.
+func (vm *VirtualMachine) loadSnapshots(vmsd map[string]string, dir string) error {
+	var indices []int
+	for key := range vmsd {
+		if m := snapshotUIDRegexp.FindStringSubmatch(key); m != nil {
+			i, _ := strconv.Atoi(m[1])
+			indices = append(indices, i)
+		}
+	}
+	sort.Ints(indices)
+
+	byUID := make(map[int]*Snapshot)
+	for _, i := range indices {
+		prefix := fmt.Sprintf("snapshot%d.", i)
+		uidValue := vmsd[prefix+"uid"]
+		uid, err := strconv.Atoi(uidValue)
+		if err != nil {
+			return fmt.Errorf("invalid snapshot uid %q: %w", uidValue, err)
+		}
+		snapshot := &Snapshot{
+			UID:         uid,
+			DisplayName: vmsd[prefix+"displayname"],
+			Description: vmsd[prefix+"description"],
+			Filename:    vmsd[prefix+"filename"],
+			CreateTime:  vmsdTime(vmsd[prefix+"createtimehigh"], vmsd[prefix+"createtimelow"]),
+		}
+		if parent, ok := vmsd[prefix+"parent"]; ok {
+			snapshot.parentUID, _ = strconv.Atoi(parent)
+		}
+		numDisks, _ := strconv.Atoi(vmsd[prefix+"numdisks"])
+		for d := 0; d < numDisks; d++ {
+			diskPrefix := fmt.Sprintf("%sdisk%d.", prefix, d)
+			snapshot.Disks = append(snapshot.Disks, VMXDisk{
+				Node:     vmsd[diskPrefix+"node"],
+				FileName: resolvePath(dir, vmsd[diskPrefix+"filename"]),
+			})
+		}
+		byUID[uid] = snapshot
+		vm.Snapshots = append(vm.Snapshots, snapshot)
+	}
+
+	for _, snapshot := range vm.Snapshots {
+		if parent, ok := byUID[snapshot.parentUID]; ok && snapshot.parentUID != 0 {
+			snapshot.Parent = parent
+			parent.Children = append(parent.Children, snapshot)
+		}
+	}
+	if current, err := strconv.Atoi(vmsd["snapshot.current"]); err == nil {
+		vm.CurrentSnapshot = byUID[current]
+	}
+	return nil
+}
+
+// vmsdTime converts the createTimeHigh/createTimeLow pair, the two halves of
+// a microsecond unix timestamp.
+func vmsdTime(high, low string) time.Time {
+	h, err := strconv.ParseInt(high, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	l, err := strconv.ParseInt(low, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMicro(h<<32 | int64(uint32(l)))
+}
+
+// OpenDisk opens the disk attached to node at the current point of the VM.
+func (vm *VirtualMachine) OpenDisk(node string) (*VMDK, error) {
+	for _, disk := range vm.Disks {
+		if disk.Node == node {
+			return openDiskFile(disk.FileName, nil)
+		}
+	}
+	return nil, fmt.Errorf("no disk attached to %s", node)
+}
+
+// OpenDisk opens the disk attached to node as it was when the snapshot was
+// taken.
+func (s *Snapshot) OpenDisk(node string) (*VMDK, error) {
+	for _, disk := range s.Disks {
+		if disk.Node == node {
+			return openDiskFile(disk.FileName, nil)
+		}
+	}
+	return nil, fmt.Errorf("snapshot %d has no disk attached to %s", s.UID, node)
+}
+
+// Chain returns the descriptor files making up the current disk of node,
+// from the top delta down to the base disk.
+func (vm *VirtualMachine) Chain(node string) ([]string, error) {
+	for _, disk := range vm.Disks {
+		if disk.Node == node {
+			return DiskChain(disk.FileName)
+		}
+	}
+	return nil, fmt.Errorf("no disk attached to %s", node)
+}
+
+// Chain returns the descriptor files making up the disk of node in the
+// snapshot, from the snapshot's delta down to the base disk.
+func (s *Snapshot) Chain(node string) ([]string, error) {
+	for _, disk := range s.Disks {
+		if disk.Node == node {
+			return DiskChain(disk.FileName)
+		}
+	}
+	return nil, fmt.Errorf("snapshot %d has no disk attached to %s", s.UID, node)
+}
+
+// DiskChain follows parentFileNameHint from fileName without opening the
+// extents and returns every file of the chain.
+func DiskChain(fileName string) ([]string, error) {
+	if FileAccessor == nil {
+		return nil, ErrFileAccessorNotAvailable
+	}
+
+	var chain []string
+	seen := make(map[string]bool)
+	for fileName != "" {
+		fileName = strings.ReplaceAll(fileName, "\\", "/")
+		if seen[fileName] {
+			return nil, fmt.Errorf("disk chain loops at %s", fileName)
+		}
+		seen[fileName] = true
+		chain = append(chain, fileName)
+
+		fh, err := FileAccessor(fileName)
+		if err != nil {
+			return nil, err
+		}
+		descriptor, err := readDescriptor(fh)
+		if err != nil {
+			return nil, err
+		}
+		if descriptor == nil || descriptor.Attr["parentCID"] == "ffffffff" {
+			break
+		}
+		fileName = resolvePath(path.Dir(fileName), descriptor.Attr["parentFileNameHint"])
+	}
+	return chain, nil
+}
+
+// readDescriptor reads a descriptor file or the descriptor embedded in a
+// hosted sparse extent. It returns nil for extents without descriptor.
+func readDescriptor(fh io.ReadSeeker) (*DiskDescriptor, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(fh, magic); err != nil {
+		return nil, err
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	switch string(magic) {
+	case CONFIG_FILE_MAGIC:
+		data, err := io.ReadAll(fh)
+		if err != nil {
+			return nil, err
+		}
+		return ParseDiskDescriptor(string(data))
+	case VMDK_MAGIC:
+		header, err := ParseSparseExtentHeader(fh)
+		if err != nil {
+			return nil, err
+		}
+		h, _ := header.AsVMDK()
+		if h.DescriptorSize == 0 {
+			return nil, nil
+		}
+		if _, err := fh.Seek(int64(h.DescriptorOffset)*SECTOR_SIZE, io.SeekStart); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, h.DescriptorSize*SECTOR_SIZE)
+		if _, err := io.ReadFull(fh, buf); err != nil {
+			return nil, err
+		}
+		return ParseDiskDescriptor(string(buf))
+	default:
+		return nil, nil
+	}
+}
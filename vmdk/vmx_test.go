@@ -0,0 +1,184 @@
+package vmdk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testVMX = `.encoding = "UTF-8"
+# comment
+displayName = "test vm"
+scsi0.present = "TRUE"
+scsi0:0.present = "TRUE"
+scsi0:0.fileName = "disk-000002.vmdk"
+scsi0:1.present = "FALSE"
+scsi0:1.fileName = "removed.vmdk"
+ide1:0.deviceType = "cdrom-image"
+ide1:0.fileName = "install.iso"
+snapshot.fileName = "snapshots.vmsd"
+`
+
+// snapshot1 was deleted, leaving a gap in the indices
+const testVMSD = `.encoding = "UTF-8"
+snapshot.lastUID = "4"
+snapshot.current = "2"
+snapshot.numSnapshots = "3"
+snapshot0.uid = "1"
+snapshot0.filename = "test-Snapshot1.vmsn"
+snapshot0.displayName = "base"
+snapshot0.createTimeHigh = "395329"
+snapshot0.createTimeLow = "-1258291200"
+snapshot0.numDisks = "1"
+snapshot0.disk0.fileName = "disk.vmdk"
+snapshot0.disk0.node = "scsi0:0"
+snapshot2.uid = "2"
+snapshot2.parent = "1"
+snapshot2.displayName = "update"
+snapshot2.numDisks = "1"
+snapshot2.disk0.fileName = "disk-000001.vmdk"
+snapshot2.disk0.node = "scsi0:0"
+snapshot3.uid = "4"
+snapshot3.parent = "1"
+snapshot3.displayName = "branch"
+snapshot3.numDisks = "1"
+snapshot3.disk0.fileName = "disk.vmdk"
+snapshot3.disk0.node = "scsi0:0"
+`
+
+// createTestDelta creates a delta disk on top of parent, both named relative
+// to the FileAccessor root, with a parentFileNameHint relative to the delta.
+func createTestDelta(t *testing.T, name, parent string, capacity int64) {
+	if err := Create(name, &CreateOptions{CreateType: CREATE_TYPE_TWO_GB_MAX_SPARSE, Capacity: capacity}); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := FileAccessor(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentDescriptor, err := readDescriptor(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentCID, err := parentDescriptor.CID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err = FileAccessor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor, err := readDescriptor(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor.SetParentCID(parentCID)
+	descriptor.SetParentFileNameHint(filepath.Base(parent))
+	if err := writeDescriptor(fh.(io.WriteSeeker), descriptor); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseVMX(t *testing.T) {
+	config, err := ParseVMX(strings.NewReader(testVMX))
+	if err != nil {
+		t.Fatalf("ParseVMX() error = %v", err)
+	}
+	if got, want := config["displayname"], "test vm"; got != want {
+		t.Fatalf("displayname = %q, want %q", got, want)
+	}
+	if got, want := config["scsi0:0.filename"], "disk-000002.vmdk"; got != want {
+		t.Fatalf("scsi0:0.filename = %q, want %q", got, want)
+	}
+	if _, ok := config["# comment"]; ok || len(config) != 10 {
+		t.Fatalf("ParseVMX() = %v", config)
+	}
+}
+
+func TestOpenVirtualMachine(t *testing.T) {
+	dir := useTempDir(t)
+	vmDir := filepath.Join(dir, "vms", "test")
+	if err := os.MkdirAll(vmDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"test.vmx": testVMX, "snapshots.vmsd": testVMSD} {
+		if err := os.WriteFile(filepath.Join(vmDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	capacity := int64(1024 * 1024)
+	if err := Create("vms/test/disk.vmdk", &CreateOptions{CreateType: CREATE_TYPE_MONOLITHIC_SPARSE, Capacity: capacity}); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := openDiskFile("vms/test/disk.vmdk", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, capacity)
+	data := newTestDiskData(100000)
+	if _, err := disk.WriteAt(data, 7); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[7:], data)
+	createTestDelta(t, "vms/test/disk-000001.vmdk", "vms/test/disk.vmdk", capacity)
+	createTestDelta(t, "vms/test/disk-000002.vmdk", "vms/test/disk-000001.vmdk", capacity)
+
+	vm, err := OpenVirtualMachine("vms/test/test.vmx")
+	if err != nil {
+		t.Fatalf("OpenVirtualMachine() error = %v", err)
+	}
+	if want := []VMXDisk{{Node: "scsi0:0", FileName: "vms/test/disk-000002.vmdk"}}; !reflect.DeepEqual(vm.Disks, want) {
+		t.Fatalf("Disks = %v, want %v", vm.Disks, want)
+	}
+
+	if len(vm.Snapshots) != 3 {
+		t.Fatalf("len(Snapshots) = %d, want 3", len(vm.Snapshots))
+	}
+	base := vm.Snapshots[0]
+	if base.UID != 1 || base.Parent != nil || len(base.Children) != 2 || base.Children[0].UID != 2 || base.Children[1].UID != 4 {
+		t.Fatalf("base snapshot = %+v", base)
+	}
+	if want := time.UnixMicro(395329<<32 | 3036676096); !base.CreateTime.Equal(want) {
+		t.Fatalf("CreateTime = %v, want %v", base.CreateTime, want)
+	}
+	if vm.CurrentSnapshot == nil || vm.CurrentSnapshot.DisplayName != "update" || vm.CurrentSnapshot.Parent != base {
+		t.Fatalf("CurrentSnapshot = %+v", vm.CurrentSnapshot)
+	}
+
+	chain, err := vm.Chain("scsi0:0")
+	if err != nil {
+		t.Fatalf("Chain() error = %v", err)
+	}
+	if want := []string{"vms/test/disk-000002.vmdk", "vms/test/disk-000001.vmdk", "vms/test/disk.vmdk"}; !reflect.DeepEqual(chain, want) {
+		t.Fatalf("Chain() = %v, want %v", chain, want)
+	}
+	chain, err = vm.CurrentSnapshot.Chain("scsi0:0")
+	if err != nil {
+		t.Fatalf("Snapshot.Chain() error = %v", err)
+	}
+	if want := []string{"vms/test/disk-000001.vmdk", "vms/test/disk.vmdk"}; !reflect.DeepEqual(chain, want) {
+		t.Fatalf("Snapshot.Chain() = %v, want %v", chain, want)
+	}
+
+	// the base data shows through the whole chain
+	for _, open := range []func(string) (*VMDK, error){base.OpenDisk, vm.OpenDisk} {
+		disk, err := open("scsi0:0")
+		if err != nil {
+			t.Fatalf("OpenDisk() error = %v", err)
+		}
+		if !bytes.Equal(readTestDisk(t, disk), want) {
+			t.Fatal("ReadAt() data does not match the base disk")
+		}
+	}
+
+	if _, err := vm.OpenDisk("scsi0:1"); err == nil {
+		t.Fatal("OpenDisk() opened a disk that is not present")
+	}
+}